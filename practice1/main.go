@@ -15,7 +15,7 @@ func gracefulShutdown(storage *Storage, router *Router, l *http.Server) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigChan
-	slog.Info("Got signal", sig)
+	slog.Info("Got signal", "signal", sig)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	storage.Stop()
@@ -35,6 +35,6 @@ func main() {
 
 	slog.Info("Listen http://" + server.Addr)
 	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-		slog.Error("Fatal error", err)
+		slog.Error("Fatal error", "error", err)
 	}
 }
@@ -139,23 +139,23 @@ func (s *Storage) loadFromDisk() {
 
 	data, err := os.ReadFile(s.dataFile)
 	if err != nil {
-		slog.Error("Failed to read data from file", err)
+		slog.Error("Failed to read data from file", "error", err)
 		return
 	}
 
 	if err = json.Unmarshal(data, &s.data); err != nil {
-		slog.Error("Failed to unmarshal data", err)
+		slog.Error("Failed to unmarshal data", "error", err)
 	}
 }
 
 func (s *Storage) saveToDisk() {
 	data, err := json.Marshal(s.data)
 	if err != nil {
-		slog.Error("Failed to marshal data", err)
+		slog.Error("Failed to marshal data", "error", err)
 		return
 	}
 
 	if err = os.WriteFile(s.dataFile, data, 0666); err != nil {
-		slog.Error("Failed to write data to file", err)
+		slog.Error("Failed to write data to file", "error", err)
 	}
 }
@@ -4,13 +4,19 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
-	"fmt"
 	"github.com/paulmach/orb/geojson"
 	"github.com/tidwall/rtree"
 	"log/slog"
 	"os"
 )
 
+// snapshot is the content of the snapshot file, the LSN is kept with the data
+// since the WAL it could be rebuilt from is truncated after the snapshot
+type snapshot struct {
+	LSN      uint64                      `json:"lsn"`
+	Features map[string]*geojson.Feature `json:"features"`
+}
+
 type Engine struct {
 	name         string
 	data         map[string]*geojson.Feature
@@ -162,14 +168,25 @@ func (e *Engine) loadSnapshot() error {
 
 	data, err := os.ReadFile(e.snapshotFile)
 	if err != nil {
-		slog.Error("Failed to read data from snapshot", err)
+		slog.Error("Failed to read data from snapshot", "error", err)
 		return err
 	}
 
-	if err = json.Unmarshal(data, &e.data); err != nil {
-		slog.Error("Failed to unmarshal data", err)
+	var s snapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		slog.Error("Failed to unmarshal data", "error", err)
 		return err
 	}
+	if s.Features == nil {
+		// the older snapshots are the bare features without the LSN
+		if err = json.Unmarshal(data, &e.data); err != nil {
+			slog.Error("Failed to unmarshal data", "error", err)
+			return err
+		}
+		return nil
+	}
+	e.data = s.Features
+	e.lsn = s.LSN
 
 	return nil
 }
@@ -180,7 +197,7 @@ func (e *Engine) loadWAL() ([]Transaction, error) {
 		if os.IsNotExist(err) {
 			return []Transaction{}, nil
 		}
-		slog.Error("Failed to open WAL file", err)
+		slog.Error("Failed to open WAL file", "error", err)
 		return nil, err
 	}
 	defer file.Close()
@@ -191,14 +208,14 @@ func (e *Engine) loadWAL() ([]Transaction, error) {
 		var tx Transaction
 		line := scanner.Text()
 		if err := json.Unmarshal([]byte(line), &tx); err != nil {
-			slog.Error("Failed to unmarshal transaction from WAL", err)
+			slog.Error("Failed to unmarshal transaction from WAL", "error", err)
 			continue
 		}
 		wal = append(wal, tx)
 	}
 
 	if err := scanner.Err(); err != nil {
-		slog.Error("Error reading WAL file", err)
+		slog.Error("Error reading WAL file", "error", err)
 		return nil, err
 	}
 
@@ -209,11 +226,11 @@ func (e *Engine) applyWAL(wal []Transaction) {
 	for _, tx := range wal {
 		ID, ok := tx.Feature.ID.(string)
 		if !ok {
-			slog.Error(fmt.Sprintf("Cannot parse ID from WAL %v", tx))
+			slog.Error("Cannot parse ID from WAL", "id", tx.Feature.ID)
 			continue
 		}
 
-		if tx.Lsn < e.lsn {
+		if tx.Lsn <= e.lsn {
 			continue // tx is already applied
 		}
 		e.lsn = tx.Lsn
@@ -224,7 +241,7 @@ func (e *Engine) applyWAL(wal []Transaction) {
 		case Delete:
 			delete(e.data, ID)
 		default:
-			slog.Warn(fmt.Sprintf("Unknown action in WAL %v", tx.Action))
+			slog.Warn("Unknown action in WAL", "action", tx.Action)
 		}
 	}
 }
@@ -238,14 +255,14 @@ func (e *Engine) restoreRTree() {
 // utils for save data
 
 func (e *Engine) saveSnapshot() error {
-	data, err := json.Marshal(e.data)
+	data, err := json.Marshal(snapshot{LSN: e.lsn, Features: e.data})
 	if err != nil {
-		slog.Error("Failed to marshal data for snapshot", err)
+		slog.Error("Failed to marshal data for snapshot", "error", err)
 		return err
 	}
 
 	if err = os.WriteFile(e.snapshotFile, data, 0666); err != nil {
-		slog.Error("Failed to write data to snapshot", err)
+		slog.Error("Failed to write data to snapshot", "error", err)
 		return err
 	}
 
@@ -255,20 +272,20 @@ func (e *Engine) saveSnapshot() error {
 func (e *Engine) saveTransactionToWAL(tx *Transaction) error {
 	file, err := os.OpenFile(e.walFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		slog.Error("Failed to open the WAL file", err)
+		slog.Error("Failed to open the WAL file", "error", err)
 		return err
 	}
 	defer file.Close()
 
 	data, err := json.Marshal(tx)
 	if err != nil {
-		slog.Error(fmt.Sprintf("Failed to serialize the transaction %v", tx), err)
+		slog.Error("Failed to serialize the transaction", "lsn", tx.Lsn, "error", err)
 		return err
 	}
 
 	_, err = file.Write(append(data, '\n'))
 	if err != nil {
-		slog.Error(fmt.Sprintf("Failed to save the transaction to WAL %v", tx), err)
+		slog.Error("Failed to save the transaction to WAL", "lsn", tx.Lsn, "error", err)
 		return err
 	}
 
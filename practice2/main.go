@@ -15,7 +15,7 @@ func gracefulShutdown(storage *Storage, router *Router, l *http.Server) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigChan
-	slog.Info("Got signal", sig)
+	slog.Info("Got signal", "signal", sig)
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	storage.Stop()
@@ -25,7 +25,7 @@ func gracefulShutdown(storage *Storage, router *Router, l *http.Server) {
 
 func main() {
 	mux := http.ServeMux{}
-	storage := NewStorage(&mux, "storage", []string{}, true, "../data/snapshot.json", "../data/wal.txt")
+	storage := NewStorage(&mux, "storage", []string{}, true, "../data/snapshot.json", "../data/wal.txt", DefaultMaxConcurrentSelects)
 	router := NewRouter(&mux, [][]string{{storage.name}}, "../front/dist")
 	server := http.Server{Addr: "127.0.0.1:8080", Handler: &mux}
 
@@ -35,6 +35,6 @@ func main() {
 
 	slog.Info("Listen http://" + server.Addr)
 	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-		slog.Error("Fatal error", err)
+		slog.Error("Fatal error", "error", err)
 	}
 }
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,7 +17,7 @@ import (
 func TestSimple(t *testing.T) {
 	mux := http.NewServeMux()
 
-	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt")
+	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt", DefaultMaxConcurrentSelects)
 	router := NewRouter(mux, [][]string{{"test"}}, "../front/dist")
 
 	go storage.Run()
@@ -64,7 +66,7 @@ func TestSimple(t *testing.T) {
 func TestGet(t *testing.T) {
 	mux := http.NewServeMux()
 
-	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt")
+	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt", DefaultMaxConcurrentSelects)
 	router := NewRouter(mux, [][]string{{"test"}}, "../front/dist")
 
 	go storage.Run()
@@ -111,7 +113,7 @@ func TestGet(t *testing.T) {
 func TestInsert(t *testing.T) {
 	mux := http.NewServeMux()
 
-	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt")
+	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt", DefaultMaxConcurrentSelects)
 	router := NewRouter(mux, [][]string{{"test"}}, "../front/dist")
 
 	go storage.Run()
@@ -184,7 +186,7 @@ func TestInsert(t *testing.T) {
 func TestReplace(t *testing.T) {
 	mux := http.NewServeMux()
 
-	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt")
+	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt", DefaultMaxConcurrentSelects)
 	router := NewRouter(mux, [][]string{{"test"}}, "../front/dist")
 
 	go storage.Run()
@@ -259,10 +261,98 @@ func TestReplace(t *testing.T) {
 	}
 }
 
+func TestLoadShedding(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt", 1)
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.Remove("test.json")
+		_ = os.Remove("wal.txt")
+	})
+	t.Cleanup(storage.Stop)
+
+	// a select is in flight
+	atomic.AddInt32(&storage.curSelects, 1)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("overloaded node does not tell when to retry")
+	}
+
+	atomic.AddInt32(&storage.curSelects, -1)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if got := atomic.LoadInt32(&storage.curSelects); got != 0 {
+		t.Errorf("%d selects are left in flight", got)
+	}
+}
+
+func TestSnapshotLSN(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.Remove("test.json")
+		_ = os.Remove("wal.txt")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	engine := NewEngine("test", ctx, "test.json", "wal.txt")
+	go engine.Start()
+
+	for _, ID := range []string{"a", "b"} {
+		if err := engine.ApplyTransaction(Upsert, newFeatureWithID(orb.Point{0.0, 0.0}, ID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the snapshot truncates the WAL
+	if err := engine.MakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.ApplyTransaction(Upsert, newFeatureWithID(orb.Point{1.0, 1.0}, "c")); err != nil {
+		t.Fatal(err)
+	}
+	// nothing is left in the WAL to restore the LSN from
+	if err := engine.MakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	engine = NewEngine("test", context.Background(), "test.json", "wal.txt")
+	go engine.Start()
+	if got := len(engine.GetAllData()); got != 3 {
+		t.Fatalf("got %d features after restart, want 3", got)
+	}
+	if err := engine.ApplyTransaction(Upsert, newFeatureWithID(orb.Point{2.0, 2.0}, "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := engine.loadWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lsns []uint64
+	for _, tx := range wal {
+		lsns = append(lsns, tx.Lsn)
+	}
+	if len(lsns) != 1 || lsns[0] != 4 {
+		t.Errorf("LSNs went backward after restart: got %v want [4]", lsns)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	mux := http.NewServeMux()
 
-	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt")
+	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt", DefaultMaxConcurrentSelects)
 	router := NewRouter(mux, [][]string{{"test"}}, "../front/dist")
 
 	go storage.Run()
@@ -10,22 +10,30 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type Storage struct {
-	mux      *http.ServeMux
-	name     string
-	replicas []string
-	leader   bool
-	engine   *Engine
-	ctx      context.Context
-	cancel   context.CancelFunc
+	mux        *http.ServeMux
+	name       string
+	replicas   []string
+	leader     bool
+	engine     *Engine
+	ctx        context.Context
+	cancel     context.CancelFunc
+	curSelects int32
+	maxSelects int32
 }
 
-func NewStorage(mux *http.ServeMux, name string, replicas []string, leader bool, snapshotFile string, walFile string) *Storage {
+// DefaultMaxConcurrentSelects is the number of selects served at once, the next ones get 503
+// since a single node has no replicas to redirect them to
+const DefaultMaxConcurrentSelects int32 = 16
+
+// NewStorage creates a storage serving up to maxSelects selects at once, 0 disables the limit
+func NewStorage(mux *http.ServeMux, name string, replicas []string, leader bool, snapshotFile string, walFile string, maxSelects int32) *Storage {
 	ctx, cancel := context.WithCancel(context.Background())
 	engine := NewEngine(name, ctx, snapshotFile, walFile)
-	return &Storage{mux, name, replicas, leader, engine, ctx, cancel}
+	return &Storage{mux: mux, name: name, replicas: replicas, leader: leader, engine: engine, ctx: ctx, cancel: cancel, maxSelects: maxSelects}
 }
 
 func (s *Storage) Run() {
@@ -46,6 +54,15 @@ func (s *Storage) initHandlers() {
 }
 
 func (s *Storage) selectHandler(w http.ResponseWriter, r *http.Request) {
+	curSelects := atomic.AddInt32(&s.curSelects, 1)
+	defer atomic.AddInt32(&s.curSelects, -1)
+
+	if s.maxSelects > 0 && curSelects > s.maxSelects {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many concurrent selects", http.StatusServiceUnavailable)
+		return
+	}
+
 	rectParam := r.URL.Query().Get("rect")
 
 	var data map[string]*geojson.Feature
@@ -76,7 +93,7 @@ func (s *Storage) selectHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	if _, err = w.Write(bytes); err != nil {
-		slog.Error("Failed to respond with all features", err)
+		slog.Error("Failed to respond with all features", "error", err)
 	}
 }
 
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+)
+
+// BalanceStrategy is how the router chooses a node among the healthy ones
+type BalanceStrategy string
+
+const (
+	RandomBalance BalanceStrategy = "random"
+	// RoundRobinBalance takes the nodes in turn, it spreads the load more evenly than random for a few nodes
+	RoundRobinBalance BalanceStrategy = "round-robin"
+	// LeastConnectionsBalance takes the node with the fewest requests in flight, only the requests
+	// the router makes itself are counted: the proxied ones and the scatter-gather queries,
+	// the redirected clients are not seen after the redirect
+	LeastConnectionsBalance BalanceStrategy = "least-connections"
+)
+
+func ParseBalanceStrategy(value string) (BalanceStrategy, error) {
+	switch strategy := BalanceStrategy(value); strategy {
+	case RandomBalance, RoundRobinBalance, LeastConnectionsBalance:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown balance strategy %q", value)
+}
+
+type balancer interface {
+	// choose returns one of the nodes, the list is never empty
+	choose(nodes []string) string
+	// track counts the request to the node in flight until the returned func is called
+	track(node string) func()
+}
+
+func newBalancer(strategy BalanceStrategy) balancer {
+	switch strategy {
+	case RoundRobinBalance:
+		return &roundRobinBalancer{}
+	case LeastConnectionsBalance:
+		return &leastConnectionsBalancer{inFlight: make(map[string]int)}
+	}
+	return randomBalancer{}
+}
+
+type randomBalancer struct{}
+
+func (randomBalancer) choose(nodes []string) string {
+	return nodes[rand.IntN(len(nodes))]
+}
+
+func (randomBalancer) track(string) func() {
+	return func() {}
+}
+
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func (b *roundRobinBalancer) choose(nodes []string) string {
+	return nodes[(b.next.Add(1)-1)%uint64(len(nodes))]
+}
+
+func (b *roundRobinBalancer) track(string) func() {
+	return func() {}
+}
+
+type leastConnectionsBalancer struct {
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+// choose takes a random node of the least loaded ones, so the idle nodes share the load
+func (b *leastConnectionsBalancer) choose(nodes []string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	least := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		switch {
+		case len(least) == 0 || b.inFlight[node] < b.inFlight[least[0]]:
+			least = append(least[:0], node)
+		case b.inFlight[node] == b.inFlight[least[0]]:
+			least = append(least, node)
+		}
+	}
+	return least[rand.IntN(len(least))]
+}
+
+func (b *leastConnectionsBalancer) track(node string) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight[node]++
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.inFlight[node]--; b.inFlight[node] == 0 {
+			delete(b.inFlight, node)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/paulmach/orb/geojson"
+	"time"
+)
+
+// ErrBatchAborted is the result of the operations which are not applied since another one has failed
+var ErrBatchAborted = errors.New("batch is aborted by a failed operation")
+
+// the operations of the batch
+const (
+	BatchInsert  = "insert"
+	BatchReplace = "replace"
+	BatchDelete  = "delete"
+)
+
+// BatchOp is an operation of the batch, the replace and the delete require the feature to exist
+type BatchOp struct {
+	Op      string           `json:"op"`
+	Feature *geojson.Feature `json:"feature"`
+}
+
+// BatchResult is the result of every operation of the batch in their order
+type BatchResult struct {
+	ops []ApplyResult
+	err error
+}
+
+// batchState is the state of the features as the operations of the batch are checked one by one,
+// the features changed by the previous operations hide the stored ones
+type batchState struct {
+	engine  *Engine
+	now     time.Time
+	changed map[string]*geojson.Feature // nil if deleted
+}
+
+func (s *batchState) get(ID string) (*geojson.Feature, bool) {
+	if feature, ok := s.changed[ID]; ok {
+		return feature, feature != nil
+	}
+	stored, ok := s.engine.get(ID)
+	if !ok || stored.expired(s.now) {
+		return nil, false
+	}
+	return stored.Feature, true
+}
+
+// check returns the error the operation fails with and whether the feature is created by it
+func (s *batchState) check(op BatchOp) (bool, error) {
+	ID := op.Feature.ID.(string)
+	stored, exists := s.get(ID)
+	switch op.Op {
+	case BatchInsert, BatchReplace:
+		if op.Op == BatchReplace && !exists {
+			return false, ErrFeatureNotFound
+		}
+		if exists && s.engine.lockGeometryType && stored.Geometry != nil {
+			if stored, given := stored.Geometry.GeoJSONType(), op.Feature.Geometry.GeoJSONType(); stored != given {
+				return false, fmt.Errorf("%w: %s is stored, %s is given", ErrGeometryTypeChanged, stored, given)
+			}
+		}
+		s.changed[ID] = op.Feature
+	case BatchDelete:
+		if !exists {
+			return false, ErrFeatureNotFound
+		}
+		s.changed[ID] = nil
+	default:
+		return false, fmt.Errorf("unknown batch operation %q", op.Op)
+	}
+	return !exists, nil
+}
+
+// applyBatch checks the operations in their order and applies the valid ones as a single group:
+// the transactions are written to the WAL by a single write and are broadcast at once.
+// If stopOnError is set, the operations after the first failed one are not checked and nothing is applied
+func (e *Engine) applyBatch(ops []BatchOp, stopOnError bool) BatchResult {
+	state := &batchState{engine: e, now: time.Now(), changed: make(map[string]*geojson.Feature)}
+	results := make([]ApplyResult, len(ops))
+	failed := false
+	for i, op := range ops {
+		if failed && stopOnError {
+			results[i].err = ErrBatchAborted
+			continue
+		}
+		results[i].created, results[i].err = state.check(op)
+		failed = failed || results[i].err != nil
+	}
+	if failed && stopOnError {
+		for i := range results {
+			if results[i].err == nil {
+				results[i] = ApplyResult{err: ErrBatchAborted}
+			}
+		}
+		return BatchResult{ops: results}
+	}
+
+	txs := make([]*Transaction, 0, len(ops))
+	for i, op := range ops {
+		if results[i].err != nil {
+			continue
+		}
+		tx := &Transaction{Action: Upsert, Name: e.name, Feature: op.Feature}
+		if op.Op == BatchDelete {
+			stored, _ := e.get(op.Feature.ID.(string))
+			tx = &Transaction{Action: Delete, Name: e.name, Feature: stored.Feature} // the deletion carries the stored geometry
+		}
+		e.assignLSN(tx)
+		if _, err := e.applyTransaction(tx); err != nil {
+			return BatchResult{ops: results, err: err}
+		}
+		results[i].lsn = tx.Lsn
+		txs = append(txs, tx)
+	}
+	if len(txs) == 0 {
+		return BatchResult{ops: results}
+	}
+
+	for _, tx := range txs {
+		tx.Batch = txs[len(txs)-1].Lsn
+	}
+	if err := e.saveTransactionsToWAL(txs...); err != nil {
+		return BatchResult{ops: results, err: err}
+	}
+	e.connections.Broadcast(txs...)
+	return BatchResult{ops: results}
+}
+
+// dropTornBatch drops the batch torn at the end of the WAL, it is written by a single write,
+// so only the last one may miss its tail. The leader broadcasts the batch after it is written,
+// so the replicas have not seen it, and a replica gets the dropped batch again by the re-sync
+func dropTornBatch(wal []Transaction) []Transaction {
+	if len(wal) == 0 {
+		return wal
+	}
+	last := &wal[len(wal)-1]
+	if last.Batch == 0 || last.Lsn == last.Batch {
+		return wal
+	}
+	end := len(wal) - 1
+	for end > 0 && sameBatch(&wal[end-1], last) {
+		end--
+	}
+	return wal[:end]
+}
@@ -0,0 +1,235 @@
+// Package client calls the top-level endpoints of the storage router.
+// The router redirects every request to a node by 307, the client follows the redirects
+// re-sending the body, so the callers see the response of the node only.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxRedirects bounds the redirects of a request, the router and the overloaded nodes may redirect in turn
+	MaxRedirects = 10
+
+	// CommittedLSNHeader is the LSN of the write as node:lsn, see Select
+	CommittedLSNHeader = "X-Committed-LSN"
+)
+
+// ErrTooManyRedirects is returned when the request is redirected more than MaxRedirects times
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// Error is the error response of the storage
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("storage responded with %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound checks whether the feature does not exist
+func IsNotFound(err error) bool {
+	var storageErr *Error
+	return errors.As(err, &storageErr) && storageErr.StatusCode == http.StatusNotFound
+}
+
+// Client talks to the router at the base URL, e.g. http://127.0.0.1:8080
+type Client struct {
+	base *url.URL
+	http *http.Client
+}
+
+func New(baseURL string) (*Client, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithHTTPClient(base, &http.Client{})
+}
+
+// NewWithHTTPClient uses a copy of the given HTTP client, the copy follows up to MaxRedirects redirects
+// whatever the redirect policy of the given one is, the given client is left as it is
+func NewWithHTTPClient(base *url.URL, httpClient *http.Client) (*Client, error) {
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("base URL %q must have a scheme and a host", base)
+	}
+	copied := *httpClient
+	copied.CheckRedirect = func(_ *http.Request, via []*http.Request) error {
+		if len(via) >= MaxRedirects {
+			return ErrTooManyRedirects
+		}
+		return nil // the 307 redirects re-send the body since the requests have GetBody
+	}
+	return &Client{base: base, http: &copied}, nil
+}
+
+// Insert creates or replaces the feature, it returns the committed LSN
+func (c *Client) Insert(ctx context.Context, feature *geojson.Feature) (string, error) {
+	return c.write(ctx, http.MethodPost, "/insert", nil, feature)
+}
+
+// Replace replaces the existing feature, the missing one is an error checked by IsNotFound
+func (c *Client) Replace(ctx context.Context, feature *geojson.Feature) (string, error) {
+	return c.write(ctx, http.MethodPost, "/replace", nil, feature)
+}
+
+// Delete deletes the feature by its ID
+func (c *Client) Delete(ctx context.Context, ID string) (string, error) {
+	return c.write(ctx, http.MethodPost, "/delete", url.Values{"id": {ID}}, nil)
+}
+
+// Patch merges the properties into the feature keeping its geometry, the nil properties are removed
+func (c *Client) Patch(ctx context.Context, ID string, properties geojson.Properties) (string, error) {
+	body := struct {
+		ID         string             `json:"id"`
+		Properties geojson.Properties `json:"properties"`
+	}{ID, properties}
+	return c.write(ctx, http.MethodPatch, "/patch", nil, body)
+}
+
+// Move replaces the geometry of the feature keeping its properties
+func (c *Client) Move(ctx context.Context, ID string, geometry orb.Geometry) (string, error) {
+	body := struct {
+		ID       string            `json:"id"`
+		Geometry *geojson.Geometry `json:"geometry"`
+	}{ID, geojson.NewGeometry(geometry)}
+	return c.write(ctx, http.MethodPost, "/move", nil, body)
+}
+
+// Feature returns the feature by its ID, the missing one is an error checked by IsNotFound
+func (c *Client) Feature(ctx context.Context, ID string) (*geojson.Feature, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/feature", url.Values{"id": {ID}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return geojson.UnmarshalFeature(data)
+}
+
+// SelectOptions narrow the selected features, the zero value selects all of them
+type SelectOptions struct {
+	// Rect is the bounding box to search, Min.X > Max.X crosses the antimeridian
+	Rect *orb.Bound
+	// Where are the property values the features must have
+	Where map[string]string
+	// MinLSN are the committed LSNs the nodes must have applied, so the own writes are seen
+	MinLSN []string
+	// BBox asks for the bbox of the selected features in the collection, it is nil if there are none
+	BBox bool
+}
+
+// Select returns the features of all the shards
+func (c *Client) Select(ctx context.Context, options SelectOptions) (*geojson.FeatureCollection, error) {
+	query := url.Values{}
+	if rect := options.Rect; rect != nil {
+		query.Set("rect", formatFloats(rect.Min[0], rect.Min[1], rect.Max[0], rect.Max[1]))
+	}
+	for key, value := range options.Where {
+		query.Add("where", key+":"+value)
+	}
+	if len(options.MinLSN) > 0 {
+		query.Set("min_lsn", strings.Join(options.MinLSN, ","))
+	}
+	if options.BBox {
+		query.Set("bbox", "true")
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, "/select", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return geojson.UnmarshalFeatureCollection(data)
+}
+
+// Snapshot asks every node to make a snapshot
+func (c *Client) Snapshot(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodPost, "/snapshot", nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *Client) write(ctx context.Context, method string, path string, query url.Values, body any) (string, error) {
+	resp, err := c.do(ctx, method, path, query, body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.Header.Get(CommittedLSNHeader), nil
+}
+
+// do sends the body as JSON and returns the successful response, the error response is returned as *Error
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	target := c.base.JoinPath(path)
+	target.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var errorResponse struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(data, &errorResponse); err != nil || errorResponse.Error == "" {
+		errorResponse.Error = string(bytes.TrimSpace(data))
+	}
+	return nil, &Error{StatusCode: resp.StatusCode, Message: errorResponse.Error}
+}
+
+func formatFloats(values ...float64) string {
+	var buf []byte
+	for i, value := range values {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendFloat(buf, value, 'f', -1, 64)
+	}
+	return string(buf)
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newRouter serves the top-level paths by redirecting them to the node like the router does
+func newRouter(t *testing.T, node http.HandlerFunc) *Client {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		target := *r.URL
+		target.Path = "/node" + r.URL.Path
+		http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/node/", node)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestRedirects(t *testing.T) {
+	client := newRouter(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/node/insert" {
+			t.Errorf("node got %s %s", r.Method, r.URL.Path)
+		}
+		feature, err := readFeature(r)
+		if err != nil || feature.ID != "id" {
+			t.Errorf("redirected body is lost: %v, %v", feature, err)
+		}
+		w.Header().Set(CommittedLSNHeader, "node:1")
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	feature := geojson.NewFeature(orb.Point{1, 2})
+	feature.ID = "id"
+	lsn, err := client.Insert(context.Background(), feature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lsn != "node:1" {
+		t.Errorf("got committed LSN %q, want %q", lsn, "node:1")
+	}
+}
+
+func TestTooManyRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.String(), http.StatusTemporaryRedirect)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Delete(context.Background(), "id"); !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("got %v, want %v", err, ErrTooManyRedirects)
+	}
+
+	// the shared client keeps its own redirect policy
+	shared := &http.Client{}
+	if _, err := NewWithHTTPClient(client.base, shared); err != nil {
+		t.Fatal(err)
+	}
+	if shared.CheckRedirect != nil {
+		t.Errorf("redirect policy of the given client is replaced")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	client := newRouter(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") == "plain" {
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error":"Feature does not exist","code":404}`))
+	})
+
+	_, err := client.Feature(context.Background(), "missing-id")
+	var storageErr *Error
+	if !errors.As(err, &storageErr) || storageErr.Message != "Feature does not exist" || !IsNotFound(err) {
+		t.Errorf("got %v, want the not found error", err)
+	}
+
+	_, err = client.Feature(context.Background(), "plain")
+	if !errors.As(err, &storageErr) || storageErr.StatusCode != http.StatusBadGateway || storageErr.Message != "bad gateway" || IsNotFound(err) {
+		t.Errorf("got %v, want the bad gateway error", err)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	client := newRouter(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("rect") != "-10.5,0,10,20" || query.Get("where") != "category:park" || query.Get("min_lsn") != "a:1,b:2" || query.Get("bbox") != "true" {
+			t.Errorf("node got query %v", query)
+		}
+		fc := geojson.NewFeatureCollection()
+		fc.Append(geojson.NewFeature(orb.Point{1, 1}))
+		_ = json.NewEncoder(w).Encode(fc)
+	})
+
+	fc, err := client.Select(context.Background(), SelectOptions{
+		Rect:   &orb.Bound{Min: orb.Point{-10.5, 0}, Max: orb.Point{10, 20}},
+		Where:  map[string]string{"category": "park"},
+		MinLSN: []string{"a:1", "b:2"},
+		BBox:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 1 {
+		t.Errorf("got %d features, want %d", len(fc.Features), 1)
+	}
+}
+
+func readFeature(r *http.Request) (*geojson.Feature, error) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return geojson.UnmarshalFeature(data)
+}
@@ -1,6 +1,11 @@
 package main
 
-import "github.com/paulmach/orb/geojson"
+import (
+	"github.com/gorilla/websocket"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"time"
+)
 
 type Command interface {
 	Execute(engine *Engine)
@@ -23,31 +28,319 @@ func (cmd *GetCommand) Execute(engine *Engine) {
 	cmd.response <- engine.getData(cmd.coordinates)
 }
 
+type GetFilteredCommand struct {
+	rect     *[4]float64
+	where    map[string]string
+	response chan map[string]*geojson.Feature
+}
+
+func (cmd *GetFilteredCommand) Execute(engine *Engine) {
+	cmd.response <- engine.getDataFiltered(cmd.rect, cmd.where)
+}
+
+type GetInPolygonCommand struct {
+	polygon  orb.Polygon
+	response chan map[string]*geojson.Feature
+}
+
+func (cmd *GetInPolygonCommand) Execute(engine *Engine) {
+	cmd.response <- engine.getDataInPolygon(cmd.polygon)
+}
+
+type WithinCommand struct {
+	center   orb.Point
+	radius   float64
+	response chan []*geojson.Feature
+}
+
+func (cmd *WithinCommand) Execute(engine *Engine) {
+	cmd.response <- engine.getWithin(cmd.center, cmd.radius)
+}
+
+type ExtentCommand struct {
+	response chan ExtentResult
+}
+
+type ExtentResult struct {
+	extent [4]float64
+	ok     bool
+}
+
+func (cmd *ExtentCommand) Execute(engine *Engine) {
+	extent, ok := engine.extent()
+	cmd.response <- ExtentResult{extent, ok}
+}
+
 type ExistsCommand struct {
 	ID       string
 	response chan bool
 }
 
 func (cmd *ExistsCommand) Execute(engine *Engine) {
-	_, exists := engine.getAllData()[cmd.ID]
+	_, exists := engine.get(cmd.ID)
 	cmd.response <- exists
 }
 
 type ApplyCommand struct {
-	tx     *Transaction
-	errors chan error
+	tx       *Transaction
+	response chan ApplyResult
 }
 
 func (cmd *ApplyCommand) Execute(engine *Engine) {
+	if err := cmd.tx.validate(); err != nil {
+		cmd.response <- ApplyResult{err: err}
+		return
+	}
+	stored, existed := engine.get(cmd.tx.Feature.ID.(string))
+	existed = existed && !stored.expired(time.Now())
 	err := engine.applyTransactionAndSave(cmd.tx)
+	cmd.response <- ApplyResult{lsn: cmd.tx.Lsn, created: !existed, err: err}
+}
+
+type ReplicatedCommand struct {
+	from   string
+	txs    []*Transaction
+	errors chan error
+}
+
+func (cmd *ReplicatedCommand) Execute(engine *Engine) {
+	cmd.errors <- engine.applyReplicated(cmd.from, cmd.txs)
+}
+
+type BatchCommand struct {
+	ops         []BatchOp
+	stopOnError bool
+	response    chan BatchResult
+}
+
+func (cmd *BatchCommand) Execute(engine *Engine) {
+	cmd.response <- engine.applyBatch(cmd.ops, cmd.stopOnError)
+}
+
+type CompareAndApplyCommand struct {
+	tx          *Transaction
+	expectedLSN uint64
+	errors      chan error
+}
+
+func (cmd *CompareAndApplyCommand) Execute(engine *Engine) {
+	if err := cmd.tx.validate(); err != nil {
+		cmd.errors <- err
+		return
+	}
+	err := engine.compareAndApplyTransaction(cmd.tx, cmd.expectedLSN)
 	cmd.errors <- err
 }
 
+type FeatureCommand struct {
+	ID       string
+	response chan FeatureResult
+}
+
+type FeatureResult struct {
+	feature *geojson.Feature
+	lsn     uint64
+	err     error
+}
+
+func (cmd *FeatureCommand) Execute(engine *Engine) {
+	feature, lsn, err := engine.getFeature(cmd.ID)
+	cmd.response <- FeatureResult{feature, lsn, err}
+}
+
+type PersistedCommand struct {
+	response chan PersistedResult
+}
+
+type PersistedResult struct {
+	state *persistedState
+	err   error
+}
+
+func (cmd *PersistedCommand) Execute(engine *Engine) {
+	state, err := engine.readPersisted()
+	cmd.response <- PersistedResult{state, err}
+}
+
+type HistoryCommand struct {
+	ID       string
+	limit    int
+	response chan HistoryResult
+}
+
+type HistoryResult struct {
+	features []*geojson.Feature
+	err      error
+}
+
+func (cmd *HistoryCommand) Execute(engine *Engine) {
+	features, err := engine.getHistory(cmd.ID, cmd.limit)
+	cmd.response <- HistoryResult{features, err}
+}
+
+type PatchCommand struct {
+	patch    *Patch
+	response chan ApplyResult
+}
+
+func (cmd *PatchCommand) Execute(engine *Engine) {
+	lsn, err := engine.patch(cmd.patch)
+	cmd.response <- ApplyResult{lsn: lsn, err: err}
+}
+
+type MoveCommand struct {
+	move     *Move
+	response chan ApplyResult
+}
+
+func (cmd *MoveCommand) Execute(engine *Engine) {
+	lsn, err := engine.move(cmd.move)
+	cmd.response <- ApplyResult{lsn: lsn, err: err}
+}
+
+type DeleteByIDCommand struct {
+	ID       string
+	response chan ApplyResult
+}
+
+// ApplyResult is the LSN of the applied transaction, created is set if the feature did not exist
+type ApplyResult struct {
+	lsn     uint64
+	created bool
+	err     error
+}
+
+func (cmd *DeleteByIDCommand) Execute(engine *Engine) {
+	lsn, err := engine.deleteByID(cmd.ID)
+	cmd.response <- ApplyResult{lsn: lsn, err: err}
+}
+
+type TruncateCommand struct {
+	response chan ApplyResult
+}
+
+func (cmd *TruncateCommand) Execute(engine *Engine) {
+	tx := &Transaction{Action: Truncate, Name: engine.name}
+	err := engine.applyTransactionAndSave(tx)
+	cmd.response <- ApplyResult{lsn: tx.Lsn, err: err}
+}
+
+type CompactCommand struct {
+	response chan CompactResult
+}
+
+// CompactResult is the number of the WAL records before and after compaction
+type CompactResult struct {
+	Before int `json:"before"`
+	After  int `json:"after"`
+	err    error
+}
+
+func (cmd *CompactCommand) Execute(engine *Engine) {
+	cmd.response <- engine.compactWAL()
+}
+
+type AddReplicaCommand struct {
+	replica  string
+	conn     *websocket.Conn
+	response chan struct{}
+}
+
+func (cmd *AddReplicaCommand) Execute(engine *Engine) {
+	engine.addReplica(cmd.replica, cmd.conn)
+	cmd.response <- struct{}{}
+}
+
+type ResyncCommand struct {
+	replica  string
+	response chan ResyncResult
+}
+
+// ResyncResult is the number of the transactions sent to the replica
+type ResyncResult struct {
+	Sent int `json:"sent"`
+	err  error
+}
+
+func (cmd *ResyncCommand) Execute(engine *Engine) {
+	cmd.response <- engine.resync(cmd.replica)
+}
+
+type ExportCommand struct {
+	response chan []*geojson.Feature
+}
+
+func (cmd *ExportCommand) Execute(engine *Engine) {
+	cmd.response <- engine.export()
+}
+
+type ImportCommand struct {
+	features []*geojson.Feature
+	replace  bool
+	response chan ImportResult
+}
+
+// ImportResult is the number of the imported features, the skipped invalid ones
+// and the existing ones deleted by the replace mode
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+	Deleted  int `json:"deleted"`
+	// LSN is the last transaction of the import, 0 if nothing has changed
+	LSN uint64 `json:"lsn,omitempty"`
+	err error
+}
+
+func (cmd *ImportCommand) Execute(engine *Engine) {
+	cmd.response <- engine.importFeatures(cmd.features, cmd.replace)
+}
+
+type RestoreCommand struct {
+	name     string
+	response chan ImportResult
+}
+
+func (cmd *RestoreCommand) Execute(engine *Engine) {
+	cmd.response <- engine.restoreSnapshot(cmd.name)
+}
+
+type StatsCommand struct {
+	response chan Stats
+}
+
+// Stats are the engine internals for capacity planning, SnapshotTime is nil if there is no snapshot
+type Stats struct {
+	Features   int `json:"features"`
+	Tombstones int `json:"tombstones"`
+	// RTreeSize is the number of the indexed features. The depth of the R-tree is not reported,
+	// since tidwall/rtree does not expose its nodes, the tree is balanced with up to 64 entries
+	// in a node, so its depth is about log64 of the size
+	RTreeSize     int        `json:"rtree_size"`
+	WALBytes      int64      `json:"wal_bytes"`
+	WALRecords    int        `json:"wal_records"`
+	SnapshotTime  *time.Time `json:"snapshot_time,omitempty"`
+	SnapshotBytes int64      `json:"snapshot_bytes"`
+	LSN           uint64     `json:"lsn"`
+	Replicas      int        `json:"replicas"`
+	Commands      int        `json:"commands"`
+	WALSync       string     `json:"wal_sync"`
+	// Unknown is the number of the kept transactions of the actions made by a newer version
+	Unknown int `json:"unknown_transactions"`
+}
+
+func (cmd *StatsCommand) Execute(engine *Engine) {
+	cmd.response <- engine.stats()
+}
+
 type SnapshotCommand struct {
-	errors chan error
+	response chan SnapshotResult
+}
+
+type SnapshotResult struct {
+	written bool
+	err     error
 }
 
 func (cmd *SnapshotCommand) Execute(engine *Engine) {
-	err := engine.makeSnapshot()
-	cmd.errors <- err
+	engine.makeSnapshot(cmd.response)
 }
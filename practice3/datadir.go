@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	SnapshotFileName = "snapshot.json"
+	WALFileName      = "wal.txt"
+	LockFileName     = "LOCK"
+)
+
+// ErrDataDirLocked is returned by Claim if another storage, of this or another process, uses the directory
+var ErrDataDirLocked = errors.New("data directory is used by another storage")
+
+// DataLayout derives the files of a storage node from its data directory
+type DataLayout struct {
+	dir  string
+	lock *os.File // the locked LockFileName while the directory is claimed
+}
+
+func NewDataLayout(dir string) *DataLayout {
+	return &DataLayout{dir: dir}
+}
+
+func (l *DataLayout) SnapshotFile() string {
+	return filepath.Join(l.dir, SnapshotFileName)
+}
+
+func (l *DataLayout) WALFile() string {
+	return filepath.Join(l.dir, WALFileName)
+}
+
+// Claim creates the directory tree and locks the LockFileName inside it, so no other storage uses
+// the directory, since two nodes writing the same WAL would corrupt each other. The lock is taken
+// on the file itself, so another path to the same directory, e.g. through a symlink, is rejected as well
+func (l *DataLayout) Claim() error {
+	if err := os.MkdirAll(l.dir, os.ModePerm); err != nil {
+		return err
+	}
+	lock, err := lockFile(filepath.Join(l.dir, LockFileName))
+	if err != nil {
+		return fmt.Errorf("failed to claim %s: %w", l.dir, err)
+	}
+	l.lock = lock
+	return nil
+}
+
+// Release lets another storage use the directory after this one is stopped
+func (l *DataLayout) Release() {
+	if l.lock != nil {
+		unlockFile(l.lock)
+		l.lock = nil
+	}
+}
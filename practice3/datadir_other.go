@@ -0,0 +1,28 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile creates the file exclusively, the file of a crashed process is left behind
+// and has to be removed by hand
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		return nil, ErrDataDirLocked
+	}
+	return file, err
+}
+
+func unlockFile(file *os.File) {
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+}
+
+// syncDir does nothing, the directories cannot be flushed on every platform
+func syncDir(string) error {
+	return nil
+}
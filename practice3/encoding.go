@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/project"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+// MaxPrecision is the number of decimal places beyond which float64 coordinates are not rounded
+const MaxPrecision = 15
+
+// EncodingConfig shapes the features returned by the selects, the query parameters
+// ?precision= and ?omit_null= override it per request
+type EncodingConfig struct {
+	// Precision is the number of decimal places the coordinates are rounded to,
+	// e.g. 6 is about 0.1m, negative keeps the full precision
+	Precision int
+	// OmitNull drops the properties which are null, empty strings, arrays or objects
+	OmitNull bool
+}
+
+func DefaultEncodingConfig() EncodingConfig {
+	return EncodingConfig{Precision: -1}
+}
+
+// withQuery returns the config overridden by the query parameters of the request
+func (c EncodingConfig) withQuery(query url.Values) (EncodingConfig, error) {
+	if value := query.Get("precision"); value != "" {
+		precision, err := strconv.Atoi(value)
+		if err != nil || precision > MaxPrecision {
+			return c, fmt.Errorf("precision must be an integer up to %d", MaxPrecision)
+		}
+		c.Precision = precision
+	}
+	if value := query.Get("omit_null"); value != "" {
+		omitNull, err := strconv.ParseBool(value)
+		if err != nil {
+			return c, fmt.Errorf("omit_null must be a boolean")
+		}
+		c.OmitNull = omitNull
+	}
+	return c, nil
+}
+
+// apply returns the copies of the changed features, the stored features are shared with the engine
+// and are never modified, the features are returned as is if the config changes nothing
+func (c EncodingConfig) apply(features []*geojson.Feature) []*geojson.Feature {
+	if c.Precision < 0 && !c.OmitNull {
+		return features
+	}
+
+	encoded := make([]*geojson.Feature, 0, len(features))
+	for _, feature := range features {
+		clone := *feature
+		if c.Precision >= 0 && feature.Geometry != nil {
+			clone.Geometry = roundCoordinates(orb.Clone(feature.Geometry), c.Precision)
+		}
+		if c.OmitNull {
+			clone.Properties = omitNull(feature.Properties)
+		}
+		encoded = append(encoded, &clone)
+	}
+	return encoded
+}
+
+// roundCoordinates rounds the coordinates of the geometry in place
+func roundCoordinates(geometry orb.Geometry, precision int) orb.Geometry {
+	scale := math.Pow10(precision)
+	return project.Geometry(geometry, func(p orb.Point) orb.Point {
+		return orb.Point{math.Round(p[0]*scale) / scale, math.Round(p[1]*scale) / scale}
+	})
+}
+
+func omitNull(properties geojson.Properties) geojson.Properties {
+	result := make(geojson.Properties, len(properties))
+	for key, value := range properties {
+		switch v := value.(type) {
+		case nil:
+			continue
+		case string:
+			if v == "" {
+				continue
+			}
+		case []any:
+			if len(v) == 0 {
+				continue
+			}
+		case map[string]any:
+			if len(v) == 0 {
+				continue
+			}
+		}
+		result[key] = value
+	}
+	return result
+}
@@ -1,9 +1,119 @@
 package main
 
-import "github.com/paulmach/orb/geojson"
+import (
+	"fmt"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"time"
+)
 
+// ExpiresAtProperty is the unix time after which the feature is deleted
+const ExpiresAtProperty = "expires_at"
+
+// Feature is a stored feature or a tombstone of a deleted one,
+// tombstones are kept until every replica has seen the deletion
 type Feature struct {
-	Name    string
-	LSN     uint64
-	Feature *geojson.Feature
+	Shard      string `json:",omitempty"`
+	Name       string
+	LSN        uint64
+	Feature    *geojson.Feature
+	CreatedBy  string
+	CreatedLSN uint64
+	Deleted    bool `json:",omitempty"`
+
+	// IdempotencyKey of the last transaction, the recent keys are restored from the snapshot
+	IdempotencyKey string `json:",omitempty"`
+}
+
+// origin is the vclock key of the node which made the last transaction of the feature
+func (f *Feature) origin() string {
+	return vclockKey(f.Shard, f.Name)
+}
+
+// Patch is merged into the properties of the stored feature, the null properties are removed
+type Patch struct {
+	ID         string             `json:"id"`
+	Properties geojson.Properties `json:"properties"`
+}
+
+// apply returns a copy of the feature with the patched properties and the same geometry
+func (p *Patch) apply(stored *geojson.Feature) *geojson.Feature {
+	feature := *stored
+	feature.Properties = stored.Properties.Clone()
+	if feature.Properties == nil {
+		feature.Properties = make(geojson.Properties)
+	}
+	for key, value := range p.Properties {
+		if value == nil {
+			delete(feature.Properties, key)
+		} else {
+			feature.Properties[key] = value
+		}
+	}
+	return &feature
+}
+
+// Move replaces the geometry of the stored feature keeping its properties
+type Move struct {
+	ID       string            `json:"id"`
+	Geometry *geojson.Geometry `json:"geometry"`
+}
+
+// geometry is nil if the move has no geometry, so validateGeometry rejects it
+func (m *Move) geometry() orb.Geometry {
+	if m.Geometry == nil {
+		return nil
+	}
+	return m.Geometry.Geometry()
+}
+
+// apply returns a copy of the feature with the moved geometry and the same properties
+func (m *Move) apply(stored *geojson.Feature) *geojson.Feature {
+	feature := *stored
+	feature.Geometry = m.geometry()
+	feature.BBox = nil // the bounding box of the old geometry
+	return &feature
+}
+
+// withProvenance returns a copy of the stored feature with
+// its creation and last modification in the properties
+func (f *Feature) withProvenance() *geojson.Feature {
+	feature := *f.Feature
+	feature.Properties = f.Feature.Properties.Clone()
+	if feature.Properties == nil {
+		feature.Properties = make(geojson.Properties)
+	}
+	feature.Properties["_created_by"] = f.CreatedBy
+	feature.Properties["_created_lsn"] = f.CreatedLSN
+	feature.Properties["_modified_by"] = f.Name
+	feature.Properties["_modified_lsn"] = f.LSN
+	return &feature
+}
+
+// expired reports whether the feature has an expiration time which is not after now
+func (f *Feature) expired(now time.Time) bool {
+	expiration, ok, err := expiresAt(f.Feature)
+	return err == nil && ok && !expiration.After(now)
+}
+
+// expiresAt returns the expiration time of the feature if it has one,
+// the property may be fractional to expire in less than a second
+func expiresAt(feature *geojson.Feature) (time.Time, bool, error) {
+	value, ok := feature.Properties[ExpiresAtProperty]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	var seconds float64
+	switch v := value.(type) {
+	case float64:
+		seconds = v
+	case int:
+		seconds = float64(v)
+	case int64:
+		seconds = float64(v)
+	default:
+		return time.Time{}, false, fmt.Errorf("property %s must be a unix timestamp", ExpiresAtProperty)
+	}
+	return time.UnixMilli(int64(seconds * 1000)), true, nil
 }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+)
+
+//go:generate sh -c "rm -rf front && cp -r ../front/dist front"
+
+// DefaultFrontDir is the built front-end of the repository, it is served by the binary
+// which is built without the embedded one and is run from this directory
+const DefaultFrontDir = "../front/dist"
+
+// FrontFS is the front-end the router serves: the directory if it is given, so the front-end
+// is developed without rebuilding the binary, otherwise the embedded one if the binary is built
+// with the embedfront tag after go generate, otherwise DefaultFrontDir
+func FrontFS(dir string) http.FileSystem {
+	if dir != "" {
+		return http.Dir(dir)
+	}
+	if embedded, ok := embeddedFront(); ok {
+		return http.FS(embedded)
+	}
+	return http.Dir(DefaultFrontDir)
+}
@@ -0,0 +1,12 @@
+//go:build !embedfront
+
+package main
+
+import (
+	"io/fs"
+)
+
+// embeddedFront is missing without the embedfront tag, the front-end is served from a directory
+func embeddedFront() (fs.FS, bool) {
+	return nil, false
+}
@@ -0,0 +1,18 @@
+//go:build embedfront
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// frontFiles is the front-end copied to the front directory by go generate
+//
+//go:embed all:front
+var frontFiles embed.FS
+
+func embeddedFront() (fs.FS, bool) {
+	front, err := fs.Sub(frontFiles, "front")
+	return front, err == nil
+}
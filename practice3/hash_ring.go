@@ -0,0 +1,65 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+const VirtualNodesPerShard = 64
+
+// HashRing maps feature IDs onto shards with consistent hashing.
+//
+// The ID of a feature never changes, so a feature is always owned by the same
+// shard as long as the set of shards is the same. When shards are added or removed,
+// only the IDs between the moved virtual nodes change their owner: such features stay
+// on the old shard, are still returned by /select (it queries every shard), but
+// /replace and /delete are routed to the new owner until the data is migrated.
+type HashRing struct {
+	points []uint32
+	shards map[uint32]int
+}
+
+func NewHashRing(shards int) *HashRing {
+	ring := &HashRing{
+		points: make([]uint32, 0, shards*VirtualNodesPerShard),
+		shards: make(map[uint32]int, shards*VirtualNodesPerShard),
+	}
+	for shard := 0; shard < shards; shard++ {
+		for i := 0; i < VirtualNodesPerShard; i++ {
+			point := hashKey("shard-" + strconv.Itoa(shard) + "-" + strconv.Itoa(i))
+			ring.points = append(ring.points, point)
+			ring.shards[point] = shard
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i] < ring.points[j]
+	})
+	return ring
+}
+
+// Owner returns the index of the shard which owns the ID
+func (r *HashRing) Owner(ID string) int {
+	hash := hashKey(ID)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+	if i == len(r.points) {
+		i = 0 // wrap around the ring
+	}
+	return r.shards[r.points[i]]
+}
+
+// hashKey is FNV-1a followed by the murmur3 finalizer,
+// plain FNV puts keys differing only in the last bytes close to each other
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	hash := h.Sum32()
+	hash ^= hash >> 16
+	hash *= 0x85ebca6b
+	hash ^= hash >> 13
+	hash *= 0xc2b2ae35
+	hash ^= hash >> 16
+	return hash
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	HeartbeatInterval = 200 * time.Millisecond
+	HeartbeatTimeout  = 1 * time.Second
+
+	// payload of the ping message sent by the current leader
+	leaderHeartbeat = "leader"
+)
+
+// Heartbeats keeps the last time each replica was heard from and
+// the name of the replica which announced itself as the leader
+type Heartbeats struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	leader   string
+}
+
+func NewHeartbeats() *Heartbeats {
+	return &Heartbeats{
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+func (h *Heartbeats) Touch(name string, leader bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastSeen[name] = time.Now()
+	if leader {
+		h.leader = name
+	} else if h.leader == name {
+		h.leader = ""
+	}
+}
+
+func (h *Heartbeats) Alive(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	lastSeen, ok := h.lastSeen[name]
+	return ok && time.Since(lastSeen) < HeartbeatTimeout
+}
+
+func (h *Heartbeats) Leader() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.leader
+}
@@ -0,0 +1,29 @@
+package main
+
+import "github.com/paulmach/orb/geojson"
+
+// HistorySize is the number of the latest versions kept for every feature
+const HistorySize = 10
+
+// History is a ring buffer of the feature versions, it is accessed by the engine goroutine only
+type History struct {
+	versions [HistorySize]*geojson.Feature
+	next     int
+	size     int
+}
+
+func (h *History) Add(feature *geojson.Feature) {
+	h.versions[h.next] = feature
+	h.next = (h.next + 1) % HistorySize
+	h.size = min(h.size+1, HistorySize)
+}
+
+// Latest returns up to limit versions starting from the current one
+func (h *History) Latest(limit int) []*geojson.Feature {
+	limit = min(limit, h.size)
+	result := make([]*geojson.Feature, 0, limit)
+	for i := 1; i <= limit; i++ {
+		result = append(result, h.versions[(h.next-i+HistorySize)%HistorySize])
+	}
+	return result
+}
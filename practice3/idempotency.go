@@ -0,0 +1,57 @@
+package main
+
+import "container/list"
+
+// IdempotencyKeys is the number of the recent idempotency keys the engine remembers
+const IdempotencyKeys = 10000
+
+// IdempotentResult is the outcome of the transaction which came with the idempotency key
+type IdempotentResult struct {
+	ID   string
+	Name string
+	LSN  uint64
+}
+
+// IdempotencyCache is a LRU of the idempotency keys, it is accessed by the engine goroutine only
+type IdempotencyCache struct {
+	capacity int
+	order    *list.List // the most recent key is at the front
+	entries  map[string]*list.Element
+}
+
+type idempotencyEntry struct {
+	key    string
+	result IdempotentResult
+}
+
+func NewIdempotencyCache(capacity int) *IdempotencyCache {
+	return &IdempotencyCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *IdempotencyCache) Get(key string) (IdempotentResult, bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		return IdempotentResult{}, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*idempotencyEntry).result, true
+}
+
+func (c *IdempotencyCache) Add(key string, result IdempotentResult) {
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*idempotencyEntry).result = result
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&idempotencyEntry{key, result})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*idempotencyEntry).key)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// propertyIndex maps the values of the indexed properties to the IDs of the live features having them
+type propertyIndex map[string]map[string]map[string]struct{}
+
+func newPropertyIndex(keys []string) propertyIndex {
+	index := make(propertyIndex, len(keys))
+	for _, key := range keys {
+		index[key] = make(map[string]map[string]struct{})
+	}
+	return index
+}
+
+func (index propertyIndex) add(feature *geojson.Feature) {
+	ID := feature.ID.(string)
+	for key, values := range index {
+		value, ok := propertyValue(feature.Properties, key)
+		if !ok {
+			continue
+		}
+		if values[value] == nil {
+			values[value] = make(map[string]struct{})
+		}
+		values[value][ID] = struct{}{}
+	}
+}
+
+func (index propertyIndex) remove(feature *geojson.Feature) {
+	ID := feature.ID.(string)
+	for key, values := range index {
+		value, ok := propertyValue(feature.Properties, key)
+		if !ok {
+			continue
+		}
+		delete(values[value], ID)
+		if len(values[value]) == 0 {
+			delete(values, value)
+		}
+	}
+}
+
+func (index propertyIndex) clear() {
+	for key := range index {
+		index[key] = make(map[string]map[string]struct{})
+	}
+}
+
+// candidates returns the IDs of the features matching the indexed filter with the fewest of them,
+// false if none of the filters is indexed
+func (index propertyIndex) candidates(where map[string]string) (map[string]struct{}, bool) {
+	var best map[string]struct{}
+	found := false
+	for key, value := range where {
+		values, ok := index[key]
+		if !ok {
+			continue
+		}
+		if IDs := values[value]; !found || len(IDs) < len(best) {
+			best, found = IDs, true
+		}
+	}
+	return best, found
+}
+
+// propertyValue is the value the filters compare, only the strings, the numbers and the booleans are matched
+func propertyValue(properties geojson.Properties, key string) (string, bool) {
+	switch value := properties[key].(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
+
+func matchesWhere(feature *geojson.Feature, where map[string]string) bool {
+	for key, want := range where {
+		if value, ok := propertyValue(feature.Properties, key); !ok || value != want {
+			return false
+		}
+	}
+	return true
+}
+
+// parseWhereParams parses the where=key:value parameters, all of them must match
+func parseWhereParams(params []string) (map[string]string, error) {
+	where := make(map[string]string, len(params))
+	for _, param := range params {
+		key, value, ok := strings.Cut(param, ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("where must be key:value, got %q", param)
+		}
+		where[key] = value
+	}
+	return where, nil
+}
+
+// getDataFiltered returns the features within the rect, or all of them if it is nil, having the property
+// values, the indexed properties give the candidates directly, otherwise the found features are filtered
+func (e *Engine) getDataFiltered(rect *[4]float64, where map[string]string) map[string]*geojson.Feature {
+	candidates, ok := e.propertyIndex.candidates(where)
+	if !ok {
+		var result map[string]*geojson.Feature
+		if rect == nil {
+			result = e.getAllData()
+		} else {
+			result = e.getData(*rect)
+		}
+		for ID := range result {
+			if !matchesWhere(e.data[ID].Feature, where) {
+				delete(result, ID)
+			}
+		}
+		return result
+	}
+
+	var bounds []orb.Bound
+	if rect != nil {
+		bounds = rectBounds(*rect)
+	}
+	now := time.Now()
+	result := make(map[string]*geojson.Feature)
+	for ID := range candidates {
+		feature, ok := e.get(ID)
+		if !ok || feature.expired(now) || !matchesWhere(feature.Feature, where) || !intersectsAny(feature.Feature, bounds) {
+			continue
+		}
+		result[ID] = feature.withProvenance()
+	}
+	return result
+}
+
+// intersectsAny checks the bounds of the feature, nil bounds match any feature
+func intersectsAny(feature *geojson.Feature, bounds []orb.Bound) bool {
+	if bounds == nil {
+		return true
+	}
+	if feature.Geometry == nil {
+		return false
+	}
+	bound := feature.Geometry.Bound()
+	for _, rect := range bounds {
+		if rect.Intersects(bound) {
+			return true
+		}
+	}
+	return false
+}
+
+// rectBounds splits the rect crossing the antimeridian like the R-tree search does
+func rectBounds(coordinates [4]float64) []orb.Bound {
+	if coordinates[0] > coordinates[2] {
+		return []orb.Bound{
+			{Min: orb.Point{coordinates[0], coordinates[1]}, Max: orb.Point{180, coordinates[3]}},
+			{Min: orb.Point{-180, coordinates[1]}, Max: orb.Point{coordinates[2], coordinates[3]}},
+		}
+	}
+	return []orb.Bound{{Min: orb.Point{coordinates[0], coordinates[1]}, Max: orb.Point{coordinates[2], coordinates[3]}}}
+}
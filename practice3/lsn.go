@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CommittedLSNHeader of the write response is the LSN of the transaction as node:lsn,
+	// it can be passed to the min_lsn parameter of the selects to read the own writes
+	CommittedLSNHeader = "X-Committed-LSN"
+	// MinLSNWait is how long a select waits for the transactions of min_lsn to be applied
+	MinLSNWait = 500 * time.Millisecond
+)
+
+func formatLSN(node string, lsn uint64) string {
+	return node + ":" + strconv.FormatUint(lsn, 10)
+}
+
+// parseMinLSN reads the comma separated node:lsn pairs
+func parseMinLSN(param string) (map[string]uint64, error) {
+	minLSN := make(map[string]uint64)
+	for _, pair := range strings.Split(param, ",") {
+		node, value, ok := strings.Cut(pair, ":")
+		if !ok || node == "" {
+			return nil, fmt.Errorf("min_lsn must be a list of node:lsn, got %q", pair)
+		}
+		lsn, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("min_lsn must be a list of node:lsn, got %q", pair)
+		}
+		minLSN[node] = max(minLSN[node], lsn)
+	}
+	return minLSN, nil
+}
+
+func formatMinLSN(minLSN map[string]uint64) string {
+	pairs := make([]string, 0, len(minLSN))
+	for node, lsn := range minLSN {
+		pairs = append(pairs, formatLSN(node, lsn))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// filterMinLSN keeps the LSNs of the given nodes, the other shards never apply the rest
+func filterMinLSN(minLSN map[string]uint64, nodes []string) map[string]uint64 {
+	filtered := make(map[string]uint64)
+	for node, lsn := range minLSN {
+		if slices.Contains(nodes, node) {
+			filtered[node] = lsn
+		}
+	}
+	return filtered
+}
@@ -3,44 +3,135 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// ShutdownTimeout is how long the in-flight requests are waited for on shutdown
+const ShutdownTimeout = 5 * time.Second
+
 func gracefulShutdown(storages []*Storage, router *Router, l *http.Server) {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigChan
-	slog.Info("Got signal", sig)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	slog.Info("Got signal", "signal", sig)
+	shutdown(storages, router, l, ShutdownTimeout)
+}
+
+// shutdown stops accepting the requests and drains the in-flight ones before stopping the storages,
+// otherwise the handlers would find their engines stopped. The change streams never end on their own,
+// so they are closed first
+func shutdown(storages []*Storage, router *Router, l *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 	for _, storage := range storages {
-		storage.Stop()
+		storage.engine.subscribers.Close()
+	}
+	if err := l.Shutdown(ctx); err != nil {
+		slog.Error("Failed to drain the requests", "error", err)
 	}
 	router.Stop()
-	_ = l.Shutdown(ctx)
+	for _, storage := range storages {
+		storage.Stop()
+	}
 }
 
 func main() {
-	mux := http.ServeMux{}
+	address := flag.String("addr", envOrDefault("STORAGE_ADDR", DefaultAddress), "host:port to listen on, env STORAGE_ADDR")
+	dataDir := flag.String("data", envOrDefault("STORAGE_DATA", "../data"), "base directory of the storage data, env STORAGE_DATA")
+	config := flag.String("config", envOrDefault("ROUTER_CONFIG", ""), "JSON topology of the router reloaded on SIGHUP, env ROUTER_CONFIG")
+	memory := flag.Bool("memory", false, "keep the data in memory only, nothing is written to the data directory")
+	precision := flag.Int("precision", -1, "decimal places of the selected coordinates, negative keeps the full precision")
+	omitNull := flag.Bool("omit-null", false, "omit the null and empty properties of the selected features")
+	logLevel := flag.String("log-level", envOrDefault("STORAGE_LOG_LEVEL", "info"), "minimal level of the logs: debug, info, warn or error, env STORAGE_LOG_LEVEL")
+	accessLevel := flag.String("access-log", "info", "level of the request logs, below -log-level they are not written")
+	origins := flag.String("origins", envOrDefault("STORAGE_ORIGINS", ""), "comma separated origins allowed to open websockets besides localhost, env STORAGE_ORIGINS")
+	balance := flag.String("balance", envOrDefault("ROUTER_BALANCE", string(RandomBalance)), "how the router chooses a node: random, round-robin or least-connections, env ROUTER_BALANCE")
+	indexed := flag.String("index", envOrDefault("STORAGE_INDEX", ""), "comma separated property keys indexed for the where= filters of /select, env STORAGE_INDEX")
+	front := flag.String("front", envOrDefault("ROUTER_FRONT", ""), "directory of the front-end to serve instead of the embedded one, env ROUTER_FRONT")
+	maxInFlight := flag.Int64("max-in-flight", DefaultMaxInFlight, "weight of the reads and the writes a node serves at once, the next ones get 503, 0 disables the limit")
+	walFormat := flag.String("wal-format", TextWAL.String(), "encoding of the WAL records: text or binary")
+	walSync := flag.String("wal-sync", DefaultWALSync.String(), "when the WAL is flushed to the disk: never, every_write or the interval of the group commits, e.g. 10ms")
+	snapshotFormat := flag.String("snapshot-format", MapSnapshot.String(), "encoding of the snapshots: map or geojson")
+	snapshots := flag.Int("snapshots", DefaultSnapshotRetention, "number of the retained snapshots, 0 keeps all of them")
+	snapshotWAL := flag.Int64("snapshot-wal", DefaultSnapshotWALBytes, "size of the WAL in bytes which triggers a snapshot, 0 disables it")
+	gossip := flag.Bool("gossip", false, "forward the replicated transactions to the other replicas")
+	compression := flag.Int("compression", DefaultReplicationCompressionLevel, "flate level of the replication messages from -2 to 9")
+	commandBuffer := flag.Int("command-buffer", DefaultCommandBuffer, "number of the commands which may wait for the engine of a node")
+	proxied := flag.String("proxy", envOrDefault("ROUTER_PROXY", ""), "comma separated routes the router proxies instead of redirecting, e.g. /insert,/select, env ROUTER_PROXY")
+	flag.Parse()
 
-	storages := []*Storage{
-		NewStorage(&mux, "storage-1-1", []string{"storage-1-2", "storage-1-3", "storage-1-4"}, true, "../data/1/1/snapshot.json", "../data/1/1/wal.txt"),
-		NewStorage(&mux, "storage-1-2", []string{"storage-1-1", "storage-1-3", "storage-1-4"}, false, "../data/1/2/snapshot.json", "../data/1/2/wal.txt"),
-		NewStorage(&mux, "storage-1-3", []string{"storage-1-1", "storage-1-2", "storage-1-4"}, false, "../data/1/3/snapshot.json", "../data/1/3/wal.txt"),
-		NewStorage(&mux, "storage-1-4", []string{"storage-1-1", "storage-1-2", "storage-1-3"}, false, "../data/1/4/snapshot.json", "../data/1/4/wal.txt"),
+	var level, requestLevel slog.Level
+	if err := errors.Join(level.UnmarshalText([]byte(*logLevel)), requestLevel.UnmarshalText([]byte(*accessLevel))); err != nil {
+		slog.Error("Invalid log level", "error", err)
+		os.Exit(2)
 	}
-	storageNames := make([]string, 0)
-	for _, storage := range storages {
-		storageNames = append(storageNames, storage.name)
+	slog.SetLogLoggerLevel(level)
+
+	strategy, err := ParseBalanceStrategy(*balance)
+	if err != nil {
+		slog.Error("Invalid balance strategy", "error", err)
+		os.Exit(2)
+	}
+
+	storageConfig := DefaultStorageConfig()
+	storageConfig.Encoding = EncodingConfig{Precision: *precision, OmitNull: *omitNull}
+	if *origins != "" {
+		storageConfig.CheckOrigin = AllowOrigins(strings.Split(*origins, ",")...)
+	}
+	storageConfig.Limits = RateLimitConfig{MaxInFlight: *maxInFlight}
+	storageConfig.Engine.Durable = !*memory
+	storageConfig.Engine.SnapshotWALBytes = *snapshotWAL
+	storageConfig.Engine.SnapshotRetention = *snapshots
+	storageConfig.Engine.CommandBuffer = *commandBuffer
+	storageConfig.Engine.CompressionLevel = *compression
+	storageConfig.Engine.Gossip = *gossip
+	if *indexed != "" {
+		storageConfig.Engine.IndexedProperties = strings.Split(*indexed, ",")
+	}
+	var formatErr, syncErr, snapshotErr error
+	storageConfig.Engine.WALFormat, formatErr = ParseWALFormat(*walFormat)
+	storageConfig.Engine.WALSync, syncErr = ParseWALSync(*walSync)
+	storageConfig.Engine.SnapshotFormat, snapshotErr = ParseSnapshotFormat(*snapshotFormat)
+	if err := errors.Join(formatErr, syncErr, snapshotErr); err != nil {
+		slog.Error("Invalid engine config", "error", err)
+		os.Exit(2)
+	}
+
+	mux := http.ServeMux{}
+
+	storageNames := []string{"storage-1-1", "storage-1-2", "storage-1-3", "storage-1-4"}
+	storages := make([]*Storage, 0, len(storageNames))
+	for i, name := range storageNames {
+		replicas := ReplicasAt(*address, slices.Delete(slices.Clone(storageNames), i, i+1)...)
+		storage, err := NewStorage(&mux, name, replicas, i == 0, filepath.Join(*dataDir, "1", strconv.Itoa(i+1)), storageConfig)
+		if err != nil {
+			slog.Error("Failed to create the storage", "name", name, "error", err)
+			os.Exit(1)
+		}
+		storages = append(storages, storage)
 	}
 
-	router := NewRouter(&mux, [][]string{storageNames}, [][]string{{"storage-1-1"}}, "../front/dist")
-	server := http.Server{Addr: "127.0.0.1:8080", Handler: &mux}
+	router := NewRouter(&mux, [][]string{storageNames}, [][]string{{"storage-1-1"}}, FrontFS(*front), strategy)
+	if *config != "" {
+		if router, err = NewRouterFromConfig(&mux, *config, FrontFS(*front), strategy); err != nil {
+			slog.Error("Failed to load the router config", "error", err)
+			os.Exit(1)
+		}
+	}
+	if *proxied != "" {
+		router.SetMode(ProxyMode, strings.Split(*proxied, ",")...)
+	}
+	server := http.Server{Addr: *address, Handler: AccessLog(slog.Default(), requestLevel, &mux)}
 
 	for _, storage := range storages {
 		go storage.Run()
@@ -50,6 +141,13 @@ func main() {
 
 	slog.Info("Listen http://" + server.Addr)
 	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-		slog.Error("Fatal error", err)
+		slog.Error("Fatal error", "error", err)
+	}
+}
+
+func envOrDefault(key string, value string) string {
+	if env, ok := os.LookupEnv(key); ok {
+		return env
 	}
+	return value
 }
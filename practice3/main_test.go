@@ -1,30 +1,51 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"practice3/client"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
 func TestSimple(t *testing.T) {
 	mux := http.NewServeMux()
 
-	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt")
-	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, "../front/dist")
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, http.Dir("../front/dist"), RandomBalance)
 
 	go storage.Run()
 	go router.Run()
 	time.Sleep(100 * time.Millisecond)
 
 	t.Cleanup(func() {
-		_ = os.Remove("test.json")
-		_ = os.Remove("wal.txt")
+		_ = os.RemoveAll("test-data")
 	})
 	t.Cleanup(router.Stop)
 	t.Cleanup(storage.Stop)
@@ -53,8 +74,8 @@ func TestSimple(t *testing.T) {
 
 		mux.ServeHTTP(rr, req)
 
-		if rr.Code != http.StatusOK {
-			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Errorf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
 		}
 	} else if rr.Code != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
@@ -64,16 +85,15 @@ func TestSimple(t *testing.T) {
 func TestGet(t *testing.T) {
 	mux := http.NewServeMux()
 
-	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt")
-	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, "../front/dist")
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, http.Dir("../front/dist"), RandomBalance)
 
 	go storage.Run()
 	go router.Run()
 	time.Sleep(100 * time.Millisecond)
 
 	t.Cleanup(func() {
-		_ = os.Remove("test.json")
-		_ = os.Remove("wal.txt")
+		_ = os.RemoveAll("test-data")
 	})
 	t.Cleanup(router.Stop)
 	t.Cleanup(storage.Stop)
@@ -100,27 +120,118 @@ func TestGet(t *testing.T) {
 
 		mux.ServeHTTP(rr, req)
 
-		if rr.Code != http.StatusOK {
-			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Errorf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+	} else if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+	}
+}
+
+func TestScanThreshold(t *testing.T) {
+	rTree := NewEngine("test", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: "test.json", WALFile: "wal.txt", CommandBuffer: DefaultCommandBuffer})
+	scan := NewEngine("test", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: "test.json", WALFile: "wal.txt", ScanThreshold: math.MaxInt, CommandBuffer: DefaultCommandBuffer})
+	for i := 0; i < 100; i++ {
+		feature := newFeatureWithID(orb.Point{rand.Float64() * 10, rand.Float64() * 10}, "id-"+strconv.Itoa(i))
+		if i%10 == 0 {
+			feature.Geometry = orb.LineString{{rand.Float64() * 10, rand.Float64() * 10}, {rand.Float64() * 10, rand.Float64() * 10}}
+		}
+		for _, engine := range []*Engine{rTree, scan} {
+			action := Upsert
+			if i%7 == 0 {
+				action = Delete
+			}
+			if _, err := engine.applyTransaction(&Transaction{Action: action, Name: "test", Lsn: uint64(i + 1), Feature: feature}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, rect := range [][4]float64{{2, 2, 4, 4}, {0, 0, 10, 10}, {5, 5, 5.5, 9}} {
+		got, want := scan.getData(rect), rTree.getData(rect)
+		if len(got) != len(want) {
+			t.Errorf("%v: scan returned %d features, r-tree returned %d", rect, len(got), len(want))
+		}
+		for ID := range want {
+			if _, ok := got[ID]; !ok {
+				t.Errorf("%v: scan missed feature %s", rect, ID)
+			}
+		}
+	}
+}
+
+func TestPropertyIndex(t *testing.T) {
+	indexed := NewEngine("test", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: "test.json", WALFile: "wal.txt", CommandBuffer: DefaultCommandBuffer, IndexedProperties: []string{"category"}})
+	plain := NewEngine("test", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: "test.json", WALFile: "wal.txt", CommandBuffer: DefaultCommandBuffer})
+	categories := []string{"park", "shop", "road"}
+	for i := 0; i < 300; i++ {
+		// the IDs are reused, so the features are replaced with the other categories and deleted
+		feature := newFeatureWithID(orb.Point{rand.Float64() * 10, rand.Float64() * 10}, "id-"+strconv.Itoa(i%50))
+		feature.Properties["category"] = categories[rand.Intn(len(categories))]
+		feature.Properties["lanes"] = float64(i % 3)
+		action := Upsert
+		if i%7 == 0 {
+			action = Delete
+		}
+		for _, engine := range []*Engine{indexed, plain} {
+			if _, err := engine.applyTransaction(&Transaction{Action: action, Name: "test", Lsn: uint64(i + 1), Feature: feature}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	compare := func(rect *[4]float64, where map[string]string) {
+		t.Helper()
+		got, want := indexed.getDataFiltered(rect, where), plain.getDataFiltered(rect, where)
+		if len(got) != len(want) {
+			t.Errorf("%v %v: index returned %d features, scan returned %d", rect, where, len(got), len(want))
+		}
+		for ID, feature := range want {
+			if _, ok := got[ID]; !ok {
+				t.Errorf("%v %v: index missed feature %s", rect, where, ID)
+			}
+			if !matchesWhere(feature, where) {
+				t.Errorf("%v %v: feature %s does not match", rect, where, ID)
+			}
+		}
+	}
+	for _, category := range append(categories, "lake") {
+		compare(nil, map[string]string{"category": category})
+		compare(&[4]float64{2, 2, 8, 8}, map[string]string{"category": category})
+		compare(nil, map[string]string{"category": category, "lanes": "1"})
+	}
+	if len(plain.getDataFiltered(nil, map[string]string{"category": "park"})) == 0 {
+		t.Fatal("no parks to compare")
+	}
+
+	for _, engine := range []*Engine{indexed, plain} {
+		if _, err := engine.applyTransaction(&Transaction{Action: Truncate, Name: "test", Lsn: 1000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := indexed.getDataFiltered(nil, map[string]string{"category": "park"}); len(got) != 0 {
+		t.Errorf("got %d parks after the truncate, want none", len(got))
+	}
+
+	for _, params := range [][]string{{"category"}, {":park"}} {
+		if _, err := parseWhereParams(params); err == nil {
+			t.Errorf("where %v is accepted", params)
 		}
-	} else if rr.Code != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
 	}
 }
 
 func TestInsert(t *testing.T) {
 	mux := http.NewServeMux()
 
-	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt")
-	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, "../front/dist")
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, http.Dir("../front/dist"), RandomBalance)
 
 	go storage.Run()
 	go router.Run()
 	time.Sleep(100 * time.Millisecond)
 
 	t.Cleanup(func() {
-		_ = os.Remove("test.json")
-		_ = os.Remove("wal.txt")
+		_ = os.RemoveAll("test-data")
 	})
 	t.Cleanup(router.Stop)
 	t.Cleanup(storage.Stop)
@@ -133,7 +244,7 @@ func TestInsert(t *testing.T) {
 		{
 			name:     "Valid Insert",
 			feature:  newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "a15d5061-999e-4168-9b58-7b508a2dadaf"),
-			wantCode: http.StatusOK,
+			wantCode: http.StatusCreated,
 		},
 		{
 			name:     "Insert Without ID",
@@ -174,6 +285,22 @@ func TestInsert(t *testing.T) {
 				if rr.Code != tt.wantCode {
 					t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.wantCode)
 				}
+				if rr.Code != http.StatusCreated {
+					return
+				}
+
+				location := rr.Header().Get("Location")
+				if location != "/feature?id="+tt.feature.ID.(string) {
+					t.Fatalf("created feature has wrong location %q", location)
+				}
+				rr2 := httptest.NewRecorder()
+				mux.ServeHTTP(rr2, httptest.NewRequest("GET", "/test"+location, nil))
+				if rr2.Code != http.StatusOK {
+					t.Fatalf("location returned wrong status code: got %v want %v", rr2.Code, http.StatusOK)
+				}
+				if feature, err := geojson.UnmarshalFeature(rr2.Body.Bytes()); err != nil || feature.ID != tt.feature.ID {
+					t.Errorf("location returned wrong feature: %v, %v", feature, err)
+				}
 			} else if rr.Code != http.StatusOK {
 				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
 			}
@@ -184,16 +311,15 @@ func TestInsert(t *testing.T) {
 func TestReplace(t *testing.T) {
 	mux := http.NewServeMux()
 
-	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt")
-	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, "../front/dist")
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, http.Dir("../front/dist"), RandomBalance)
 
 	go storage.Run()
 	go router.Run()
 	time.Sleep(100 * time.Millisecond)
 
 	t.Cleanup(func() {
-		_ = os.Remove("test.json")
-		_ = os.Remove("wal.txt")
+		_ = os.RemoveAll("test-data")
 	})
 	t.Cleanup(router.Stop)
 	t.Cleanup(storage.Stop)
@@ -262,16 +388,15 @@ func TestReplace(t *testing.T) {
 func TestDelete(t *testing.T) {
 	mux := http.NewServeMux()
 
-	storage := NewStorage(mux, "test", []string{}, true, "test.json", "wal.txt")
-	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, "../front/dist")
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, http.Dir("../front/dist"), RandomBalance)
 
 	go storage.Run()
 	go router.Run()
 	time.Sleep(100 * time.Millisecond)
 
 	t.Cleanup(func() {
-		_ = os.Remove("test.json")
-		_ = os.Remove("wal.txt")
+		_ = os.RemoveAll("test-data")
 	})
 	t.Cleanup(router.Stop)
 	t.Cleanup(storage.Stop)
@@ -332,38 +457,6335 @@ func TestDelete(t *testing.T) {
 	}
 }
 
-func newFeatureWithID(geometry orb.Geometry, id string) *geojson.Feature {
-	feature := geojson.NewFeature(geometry)
-	feature.ID = id
-	return feature
+func TestInsertInvalidGeometry(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{
+			name: "NaN Coordinates",
+			body: `{"type":"Feature","id":"nan-id","geometry":{"type":"Point","coordinates":[NaN,NaN]},"properties":{}}`,
+		},
+		{
+			name: "Out Of Range Coordinates",
+			body: `{"type":"Feature","id":"far-id","geometry":{"type":"Point","coordinates":[200,0]},"properties":{}}`,
+		},
+		{
+			name: "Empty Geometry",
+			body: `{"type":"Feature","id":"empty-id","geometry":{"type":"LineString","coordinates":[]},"properties":{}}`,
+		},
+		{
+			name: "Numeric ID",
+			body: `{"type":"Feature","id":1,"geometry":{"type":"Point","coordinates":[0,0]},"properties":{}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", strings.NewReader(tt.body)))
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+			}
+		})
+	}
+
+	// JSON can not carry NaN, but replicated or programmatic features can
+	if err := validateGeometry(orb.Point{math.NaN(), math.NaN()}, false); err == nil {
+		t.Errorf("NaN coordinates are valid")
+	}
+
+	// the error names the offending coordinate
+	rr := httptest.NewRecorder()
+	body := `{"type":"Feature","id":"projected-id","geometry":{"type":"LineString","coordinates":[[0,0],[10,4187000]]},"properties":{}}`
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", strings.NewReader(body)))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "latitude 4.187e+06") {
+		t.Errorf("handler returned %v %q, want %v naming the latitude", rr.Code, rr.Body.String(), http.StatusBadRequest)
+	}
+	if err := validateGeometry(orb.LineString{{0, 0}, {10, 4187000}}, false); err != nil {
+		t.Errorf("projected coordinates are rejected without WGS84 validation: %v", err)
+	}
+
+	if features := storage.engine.State().Features; features != 0 {
+		t.Errorf("invalid features were stored: %d", features)
+	}
+	if extent, ok, _ := storage.engine.Extent(context.Background()); ok {
+		t.Errorf("r-tree is affected by invalid features: %v", extent)
+	}
 }
 
-func insert(t *testing.T, feature *geojson.Feature, mux *http.ServeMux, rr *httptest.ResponseRecorder) {
-	body, err := feature.MarshalJSON()
+func TestNullGeometry(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	body := `{"type":"Feature","id":"null-id","geometry":null,"properties":{}}`
+	for _, target := range []string{"/test/insert", "/test/replace"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", target, strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "missing geometry") {
+			t.Errorf("%s returned %v %q, want %v", target, rr.Code, rr.Body.String(), http.StatusBadRequest)
+		}
+	}
+	moved := httptest.NewRecorder()
+	mux.ServeHTTP(moved, httptest.NewRequest("POST", "/test/move", strings.NewReader(`{"id":"null-id","geometry":null}`)))
+	if moved.Code != http.StatusBadRequest || !strings.Contains(moved.Body.String(), "missing geometry") {
+		t.Errorf("/test/move returned %v %q, want %v", moved.Code, moved.Body.String(), http.StatusBadRequest)
+	}
+
+	// the replicated feature is rejected by the engine instead of panicking
+	tx := &Transaction{Action: Upsert, Name: "leader", Lsn: 1, Feature: &geojson.Feature{ID: "null-id", Type: "Feature"}}
+	if err := storage.engine.ApplyReplicated(context.Background(), "leader", tx); !errors.Is(err, ErrInvalidFeature) {
+		t.Errorf("replicated feature without geometry: got %v want %v", err, ErrInvalidFeature)
+	}
+
+	// and so is the one in the WAL
+	dir := t.TempDir()
+	walFile := filepath.Join(dir, WALFileName)
+	line, err := json.Marshal(tx)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := os.WriteFile(walFile, append(line, '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewEngine("test", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: filepath.Join(dir, SnapshotFileName), WALFile: walFile, CommandBuffer: DefaultCommandBuffer})
+	go restored.Start()
+	if data, err := restored.GetAllData(context.Background()); err != nil || len(data) != 0 {
+		t.Errorf("restored %d features without geometry: %v", len(data), err)
+	}
 
-	req, err := http.NewRequest("POST", "/insert", bytes.NewReader(body))
+	// the engine is still alive
+	valid, err := newFeatureWithID(orb.Point{0, 0}, "id").MarshalJSON()
 	if err != nil {
 		t.Fatal(err)
 	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(valid)))
+	if rr.Code != http.StatusCreated {
+		t.Errorf("insert returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if features := storage.engine.State().Features; features != 1 {
+		t.Errorf("got %d features after the insert, want %d", features, 1)
+	}
+}
 
-	mux.ServeHTTP(rr, req)
+func TestUnknownAction(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile, walFile := filepath.Join(dir, SnapshotFileName), filepath.Join(dir, WALFileName)
 
-	if rr.Code == http.StatusTemporaryRedirect {
-		req, err := http.NewRequest("POST", rr.Header().Get("location"), bytes.NewReader(body))
+	// the WAL written by a newer version with a future action between the known ones
+	var wal []byte
+	for _, tx := range []*Transaction{
+		{Action: Upsert, Name: "leader", Lsn: 1, Feature: newFeatureWithID(orb.Point{1, 1}, "first")},
+		{Action: "merge", Name: "leader", Lsn: 2, Feature: newFeatureWithID(orb.Point{1, 1}, "first")},
+		{Action: Upsert, Name: "leader", Lsn: 3, Feature: newFeatureWithID(orb.Point{2, 2}, "second")},
+	} {
+		line, err := json.Marshal(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wal = append(append(wal, line...), '\n')
+	}
+	if err := os.WriteFile(walFile, wal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := func() (*Engine, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		engine := NewEngine("test", nil, ctx, EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, CommandBuffer: DefaultCommandBuffer})
+		go engine.Start()
+		return engine, cancel
+	}
+	engine, cancel := start()
+	stats, err := engine.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Features != 2 || stats.Unknown != 1 {
+		t.Errorf("got %d features and %d unknown transactions, want 2 and 1", stats.Features, stats.Unknown)
+	}
+
+	// the replicated one is rejected and kept as well
+	future := &Transaction{Action: "merge", Name: "other", Lsn: 1, Feature: newFeatureWithID(orb.Point{3, 3}, "third")}
+	if err := engine.ApplyReplicated(context.Background(), "other", future); !errors.Is(err, ErrUnknownAction) {
+		t.Errorf("replicated unknown action: got %v want %v", err, ErrUnknownAction)
+	}
+	if vclock := engine.State().Vclock; vclock["other"] != 0 {
+		t.Errorf("unknown action advanced the vclock to %d", vclock["other"])
+	}
+
+	// the snapshot does not claim them applied and the WAL keeps them
+	if _, err := engine.ApplyTransaction(context.Background(), Upsert, newFeatureWithID(orb.Point{4, 4}, "own"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if written, err := engine.MakeSnapshot(context.Background()); err != nil || !written {
+		t.Fatalf("snapshot is not written: %v", err)
+	}
+	if _, err := engine.CompactWAL(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	kept, err := os.ReadFile(walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(string(kept), `"action":"merge"`); count != 2 {
+		t.Errorf("WAL keeps %d unknown transactions, want 2", count)
+	}
+	path, _, ok := engine.latestSnapshot()
+	if !ok {
+		t.Fatal("snapshot is not found")
+	}
+	snapshot, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, vclock, err := decodeSnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vclock["leader"] != 1 || vclock["other"] != 0 || vclock["test"] != 1 {
+		t.Errorf("snapshot has vclock %v, want it held below the unknown transactions", vclock)
+	}
+
+	restarted, cancel := start()
+	defer cancel()
+	stats, err = restarted.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Features != 3 || stats.Unknown != 2 {
+		t.Errorf("restarted with %d features and %d unknown transactions, want 3 and 2", stats.Features, stats.Unknown)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	body := `{"type":"FeatureCollection","features":[
+		{"type":"Feature","id":"valid-id","geometry":{"type":"Point","coordinates":[1,1]},"properties":{}},
+		{"type":"Feature","geometry":{"type":"Point","coordinates":[1,1]},"properties":{}},
+		{"type":"Feature","id":5,"geometry":{"type":"Point","coordinates":[1,1]},"properties":{}},
+		{"type":"Feature","id":"out-of-range-id","geometry":{"type":"Point","coordinates":[200,1]},"properties":{}}
+	]}`
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/validate", strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var report ValidationReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid != 1 || report.Invalid != 3 || len(report.Features) != 4 {
+		t.Fatalf("wrong report: %+v", report)
+	}
+	for i, wantError := range []string{"", "missing field ID", "field ID must be a string", "longitude 200"} {
+		got := report.Features[i]
+		if got.Index != i || got.Valid != (wantError == "") || !strings.Contains(got.Error, wantError) {
+			t.Errorf("feature %d is reported as %+v, want error %q", i, got, wantError)
+		}
+	}
+
+	if features := storage.engine.State().Features; features != 0 {
+		t.Errorf("validation stored %d features", features)
+	}
+}
+
+func TestReplaceKeepsProvenance(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	steps := []struct {
+		path string
+		ID   string
+	}{
+		{"/test/insert", "existing-id"},
+		{"/test/insert", "another-id"},
+		{"/test/replace", "existing-id"},
+	}
+	for _, step := range steps {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, step.ID).MarshalJSON()
 		if err != nil {
 			t.Fatal(err)
 		}
 		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", step.path, bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+	}
 
-		mux.ServeHTTP(rr, req)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select", nil))
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		if rr.Code != http.StatusOK {
-			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	for _, feature := range fc.Features {
+		if feature.ID != "existing-id" {
+			continue
 		}
-	} else if rr.Code != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		if feature.Properties["_created_by"] != "test" || feature.Properties["_created_lsn"] != 1.0 {
+			t.Errorf("replace changed the provenance: %v", feature.Properties)
+		}
+		if feature.Properties["_modified_by"] != "test" || feature.Properties["_modified_lsn"] != 3.0 {
+			t.Errorf("replace is not the last modification: %v", feature.Properties)
+		}
+		return
+	}
+	t.Errorf("replaced feature is not selected")
+}
+
+func TestPatch(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	feature := newFeatureWithID(orb.Point{1, 2}, "id")
+	feature.Properties["status"] = "new"
+	feature.Properties["note"] = "to be removed"
+	body, err := feature.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("PATCH", "/test/patch", strings.NewReader(body)))
+		return rr
+	}
+
+	// the concurrent patches of different properties are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rr := patch(fmt.Sprintf(`{"id":"id","properties":{"p%d":%d}}`, i, i)); rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+	if rr := patch(`{"id":"id","properties":{"status":"done","note":null}}`); rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	features, err := storage.engine.GetAllData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched := features["id"]
+	if patched.Properties["status"] != "done" || patched.Properties["note"] != nil {
+		t.Errorf("feature has wrong properties: %v", patched.Properties)
+	}
+	for i := 0; i < 10; i++ {
+		if patched.Properties[fmt.Sprintf("p%d", i)] != float64(i) {
+			t.Errorf("patch of p%d is lost: %v", i, patched.Properties)
+		}
+	}
+	if !orb.Equal(patched.Geometry, feature.Geometry) {
+		t.Errorf("patch changed geometry: got %v want %v", patched.Geometry, feature.Geometry)
+	}
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"id":"missing-id","properties":{"status":"done"}}`, http.StatusNotFound},
+		{`{"properties":{"status":"done"}}`, http.StatusBadRequest},
+		{`{"id":"id","properties":{"expires_at":"tomorrow"}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rr := patch(tt.body); rr.Code != tt.code {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.body, rr.Code, tt.code)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, http.Dir("../front/dist"), RandomBalance)
+
+	go storage.Run()
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(router.Stop)
+	t.Cleanup(storage.Stop)
+
+	feature := newFeatureWithID(orb.Point{1, 2}, "vehicle")
+	feature.Properties["plate"] = "A123BC"
+	insert(t, feature, mux, httptest.NewRecorder())
+
+	move := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/move", strings.NewReader(body)))
+		if rr.Code == http.StatusTemporaryRedirect {
+			location := rr.Header().Get("Location")
+			rr = httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("POST", location, strings.NewReader(body)))
+		}
+		return rr
+	}
+	rr := move(`{"id":"vehicle","geometry":{"type":"Point","coordinates":[30,40]}}`)
+	if rr.Code != http.StatusOK || rr.Header().Get(CommittedLSNHeader) != "test:2" {
+		t.Fatalf("move returned %v with LSN %q, want %v with %q", rr.Code, rr.Header().Get(CommittedLSNHeader), http.StatusOK, "test:2")
+	}
+
+	// the R-tree has the new bounds only
+	for _, tt := range []struct {
+		rect [4]float64
+		want int
+	}{{[4]float64{0, 0, 5, 5}, 0}, {[4]float64{25, 35, 35, 45}, 1}} {
+		data, err := storage.engine.GetData(context.Background(), tt.rect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != tt.want {
+			t.Errorf("%v: got %d features, want %d", tt.rect, len(data), tt.want)
+		}
+	}
+	moved, _, err := storage.engine.GetFeature(context.Background(), "vehicle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !orb.Equal(moved.Geometry, orb.Point{30, 40}) || moved.Properties["plate"] != "A123BC" {
+		t.Errorf("moved feature is %v with %v", moved.Geometry, moved.Properties)
+	}
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"id":"missing-id","geometry":{"type":"Point","coordinates":[30,40]}}`, http.StatusNotFound},
+		{`{"geometry":{"type":"Point","coordinates":[30,40]}}`, http.StatusBadRequest},
+		{`{"id":"vehicle"}`, http.StatusBadRequest},
+		{`{"id":"vehicle","geometry":{"type":"Point","coordinates":[300,40]}}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if rr := move(tt.body); rr.Code != tt.code {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.body, rr.Code, tt.code)
+		}
+	}
+}
+
+func TestReplaceIfMatch(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "existing-id").MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	tests := []struct {
+		name     string
+		ID       string
+		ifMatch  string
+		wantCode int
+	}{
+		{
+			name:     "Replace Current LSN",
+			ID:       "existing-id",
+			ifMatch:  "1",
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Replace Stale LSN",
+			ID:       "existing-id",
+			ifMatch:  "1",
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "Replace Quoted Current LSN",
+			ID:       "existing-id",
+			ifMatch:  `"2"`,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "Replace Invalid LSN",
+			ID:       "existing-id",
+			ifMatch:  "latest",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Replace Non-Existing ID",
+			ID:       "non-existing-id",
+			ifMatch:  "1",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, tt.ID).MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("POST", "/test/replace", bytes.NewReader(body))
+			req.Header.Set("If-Match", tt.ifMatch)
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.wantCode)
+			}
+		})
+	}
+
+	features, err := storage.engine.GetAllData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if features["existing-id"].Properties["_modified_lsn"] != uint64(3) {
+		t.Errorf("stale write was applied: %v", features["existing-id"].Properties)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	mux := http.NewServeMux()
+
+	config := DefaultStorageConfig()
+	config.LockGeometryType = true
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", config)
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	post := func(target string, feature *geojson.Feature) *httptest.ResponseRecorder {
+		body, err := feature.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", target, bytes.NewReader(body)))
+		return rr
+	}
+	if rr := post("/test/insert", newFeatureWithID(orb.Point{0, 0}, "id")); rr.Code != http.StatusCreated {
+		t.Fatalf("insert returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	// the rejections are told apart by the engine errors
+	_, err := storage.engine.ApplyTransaction(context.Background(), Upsert, &geojson.Feature{ID: 1, Geometry: orb.Point{0, 0}}, "")
+	if !errors.Is(err, ErrInvalidFeature) {
+		t.Errorf("non-string ID: got %v want %v", err, ErrInvalidFeature)
+	}
+	_, err = storage.engine.ApplyTransactionIfMatch(context.Background(), Upsert, newFeatureWithID(orb.Point{1, 1}, "id"), 100, "")
+	if !errors.Is(err, ErrConflict) || !errors.Is(err, ErrLSNMismatch) {
+		t.Errorf("stale LSN: got %v want %v", err, ErrLSNMismatch)
+	}
+
+	polygon := newFeatureWithID(orb.Polygon{{{10, 10}, {20, 10}, {20, 20}, {10, 20}, {10, 10}}}, "id")
+	if rr := post("/test/replace", polygon); rr.Code != http.StatusConflict {
+		t.Errorf("geometry type change returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+
+	// the WAL can not be opened as a file, the write is applied in memory but is not acknowledged
+	if err := os.Remove(storage.engine.walFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(storage.engine.walFile, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	rr := post("/test/insert", newFeatureWithID(orb.Point{2, 2}, "other-id"))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("failed WAL write returned wrong status code: got %v want %v", rr.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(rr.Body.String(), ErrWALWrite.Error()) {
+		t.Errorf("failed WAL write is not reported: %s", rr.Body.String())
+	}
+	_, err = storage.engine.ApplyTransaction(context.Background(), Delete, newFeatureWithID(orb.Point{0, 0}, "id"), "")
+	if !errors.Is(err, ErrWALWrite) {
+		t.Errorf("failed WAL write: got %v want %v", err, ErrWALWrite)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+
+	mux := http.NewServeMux()
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	post := func(mux *http.ServeMux, ID string, key string) *httptest.ResponseRecorder {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, ID).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body))
+		req.Header.Set("Idempotency-Key", key)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name         string
+		ID           string
+		key          string
+		wantCode     int
+		wantReplayed string
+	}{
+		{name: "First Request", ID: "retried-id", key: "key-1", wantCode: http.StatusCreated, wantReplayed: ""},
+		{name: "Retry", ID: "retried-id", key: "key-1", wantCode: http.StatusOK, wantReplayed: "true"},
+		{name: "Key Of Another Feature", ID: "other-id", key: "key-1", wantCode: http.StatusUnprocessableEntity},
+		{name: "New Key", ID: "retried-id", key: "key-2", wantCode: http.StatusOK, wantReplayed: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := post(mux, tt.ID, tt.key)
+			if rr.Code != tt.wantCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.wantCode)
+			}
+			if replayed := rr.Header().Get("Idempotent-Replayed"); replayed != tt.wantReplayed {
+				t.Errorf("handler returned wrong Idempotent-Replayed: got %q want %q", replayed, tt.wantReplayed)
+			}
+		})
+	}
+
+	if lsn := storage.engine.State().Vclock["test"]; lsn != 2 {
+		t.Errorf("retries are applied: got LSN %v want %v", lsn, 2)
+	}
+
+	// the key of the last write survives the snapshot and the restart
+	if _, err := storage.engine.MakeSnapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	storage.Stop()
+
+	mux = http.NewServeMux()
+	restored := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	go restored.Run()
+	t.Cleanup(restored.Stop)
+	time.Sleep(100 * time.Millisecond)
+
+	if rr := post(mux, "retried-id", "key-2"); rr.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry after restart is applied: %v", rr.Code)
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	insert := func(ID string) string {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, ID).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+		return rr.Header().Get(CommittedLSNHeader)
+	}
+
+	if lsn := insert("first-id"); lsn != "test:1" {
+		t.Errorf("insert returned wrong committed LSN: got %q want %q", lsn, "test:1")
+	}
+
+	// the select waits for the insert made after it has been received
+	selected := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?min_lsn=test:2", nil))
+		selected <- rr
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if lsn := insert("second-id"); lsn != "test:2" {
+		t.Errorf("insert returned wrong committed LSN: got %q want %q", lsn, "test:2")
+	}
+
+	rr := <-selected
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 2 {
+		t.Errorf("select does not see the own write: got %d features want %d", len(fc.Features), 2)
+	}
+
+	// the import is committed by its last transaction
+	imported := geojson.NewFeatureCollection()
+	imported.Append(newFeatureWithID(orb.Point{1, 1}, "third-id"))
+	imported.Append(newFeatureWithID(orb.Point{2, 2}, "fourth-id"))
+	body, err := json.Marshal(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/import", bytes.NewReader(body)))
+	var result ImportResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if lsn := rr.Header().Get(CommittedLSNHeader); lsn != "test:4" || result.LSN != 4 {
+		t.Errorf("import returned wrong committed LSN: got %q and %d want %q", lsn, result.LSN, "test:4")
+	}
+
+	tests := []struct {
+		name     string
+		minLSN   string
+		wantCode int
+	}{
+		{name: "Not Applied", minLSN: "test:5", wantCode: http.StatusServiceUnavailable},
+		{name: "Invalid", minLSN: "test", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?min_lsn="+tt.minLSN, nil))
+			if rr.Code != tt.wantCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	feature := newFeatureWithID(orb.Point{1, 1}, "existing-id")
+	feature.Properties["name"] = "Cafe"
+	feature.Properties["category"] = "food"
+	feature.Properties["description"] = strings.Repeat("long text ", 100)
+	body, err := feature.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+
+	tests := []struct {
+		name   string
+		fields string
+		want   geojson.Properties
+	}{
+		{name: "Subset", fields: "name,category", want: geojson.Properties{"name": "Cafe", "category": "food"}},
+		{name: "Unknown Field", fields: "name,missing", want: geojson.Properties{"name": "Cafe"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?fields="+tt.fields, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fc.Features) != 1 || fc.Features[0].Geometry == nil {
+				t.Fatalf("select returned wrong features: %v", fc.Features)
+			}
+			if got := fc.Features[0].Properties; len(got) != len(tt.want) || got["name"] != tt.want["name"] || got["category"] != tt.want["category"] {
+				t.Errorf("select returned wrong properties: got %v want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the stored feature keeps all its properties
+	data, err := storage.engine.GetAllData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data["existing-id"].Properties["description"]; !ok {
+		t.Errorf("stored feature lost its properties: %v", data["existing-id"].Properties)
+	}
+}
+
+func TestSelectWhere(t *testing.T) {
+	mux := http.NewServeMux()
+
+	config := DefaultStorageConfig()
+	config.Engine.IndexedProperties = []string{"category"}
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", config)
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	for i, category := range []string{"park", "park", "shop"} {
+		feature := newFeatureWithID(orb.Point{float64(i), float64(i)}, "id-"+strconv.Itoa(i))
+		feature.Properties["category"] = category
+		feature.Properties["open"] = i != 1
+		body, err := feature.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{name: "Indexed", query: "where=category:park", want: 2},
+		{name: "Indexed And Rect", query: "where=category:park&rect=0.5,0.5,2,2", want: 1},
+		{name: "Not Indexed", query: "where=open:true", want: 2},
+		{name: "Both", query: "where=category:park&where=open:true", want: 1},
+		{name: "Missing Value", query: "where=category:lake", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?"+tt.query, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fc.Features) != tt.want {
+				t.Errorf("select returned %d features, want %d", len(fc.Features), tt.want)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?where=category", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSelectBBox(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	for i, geometry := range []orb.Geometry{orb.Point{-10, 5}, orb.LineString{{20, -3}, {30, 1}}} {
+		body, err := newFeatureWithID(geometry, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  geojson.BBox
+	}{
+		{name: "All", query: "bbox=true", want: geojson.BBox{-10, -3, 30, 5}},
+		{name: "Rect", query: "bbox=true&rect=0,-5,40,5", want: geojson.BBox{20, -3, 30, 1}},
+		{name: "Empty", query: "bbox=true&rect=100,0,110,10", want: nil},
+		{name: "False", query: "bbox=false", want: nil},
+		{name: "Missing", query: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?"+tt.query, nil))
+			if rr.Code != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			var fc struct {
+				BBox geojson.BBox `json:"bbox"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &fc); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(fc.BBox, tt.want) {
+				t.Errorf("select returned bbox %v, want %v", fc.BBox, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectStreaming(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	count := 2*StreamChunkSize + 1
+	for i := 0; i < count; i++ {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if !rr.Flushed {
+		t.Errorf("response was not flushed while streaming")
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("wrong content type: %v", contentType)
+	}
+
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != count {
+		t.Errorf("select returned %d features, want %d", len(fc.Features), count)
+	}
+}
+
+func TestSelectNDJSON(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	const count = 3
+	for i := 0; i < count; i++ {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	}
+
+	byHeader := httptest.NewRequest("GET", "/test/select", nil)
+	byHeader.Header.Set("Accept", "application/x-ndjson")
+
+	for _, req := range []*http.Request{byHeader, httptest.NewRequest("GET", "/test/select?format=ndjson", nil)} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+			t.Errorf("wrong content type: %v", contentType)
+		}
+
+		lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+		if len(lines) != count {
+			t.Fatalf("select returned %d lines, want %d", len(lines), count)
+		}
+		for _, line := range lines {
+			if _, err := geojson.UnmarshalFeature([]byte(line)); err != nil {
+				t.Errorf("line is not a feature: %v", err)
+			}
+		}
+	}
+}
+
+func TestSelectOrder(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	const count = 20
+	for _, i := range rand.Perm(count) {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	}
+
+	selectIDs := func(target string) []string {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		IDs := make([]string, 0, len(fc.Features))
+		for _, f := range fc.Features {
+			IDs = append(IDs, f.ID.(string))
+		}
+		return IDs
+	}
+
+	first, second := selectIDs("/test/select"), selectIDs("/test/select")
+	if len(first) != count || !slices.Equal(first, second) {
+		t.Errorf("consecutive selects differ: %v and %v", first, second)
+	}
+	if !slices.IsSorted(first) {
+		t.Errorf("select is not sorted by ID: %v", first)
+	}
+
+	if unsorted := selectIDs("/test/select?sort=none"); len(unsorted) != count {
+		t.Errorf("select returned %d features, want %d", len(unsorted), count)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	insert := func(feature *geojson.Feature) {
+		body, err := feature.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v", rr.Code)
+		}
+	}
+	get := func(target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	insert(newFeatureWithID(orb.Point{0, 0}, "id"))
+
+	for _, target := range []string{"/test/feature?id=id", "/test/select"} {
+		t.Run(strings.TrimPrefix(target, "/test/"), func(t *testing.T) {
+			rr := get(target, nil)
+			etag := rr.Header().Get("ETag")
+			if rr.Code != http.StatusOK || etag == "" {
+				t.Fatalf("handler returned %v without ETag %q", rr.Code, etag)
+			}
+
+			if rr := get(target, http.Header{"If-None-Match": {etag}}); rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotModified)
+			}
+			if rr := get(target, http.Header{"If-None-Match": {`"other", ` + etag}}); rr.Code != http.StatusNotModified {
+				t.Errorf("handler returned wrong status code for the ETag list: got %v want %v", rr.Code, http.StatusNotModified)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			insert(newFeatureWithID(orb.Point{1, 1}, "id")) // replaces the feature
+
+			rr = get(target, http.Header{"If-None-Match": {etag}})
+			if rr.Code != http.StatusOK {
+				t.Errorf("handler returned wrong status code after the change: got %v want %v", rr.Code, http.StatusOK)
+			}
+			if rr.Header().Get("ETag") == etag {
+				t.Errorf("ETag %s is not changed by the write", etag)
+			}
+		})
+	}
+
+	// the select is modified within the last second
+	rr := get("/test/select", nil)
+	modified, err := http.ParseTime(rr.Header().Get("Last-Modified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr := get("/test/select", http.Header{"If-Modified-Since": {modified.Add(-time.Second).Format(http.TimeFormat)}}); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := get("/test/select", http.Header{"If-Modified-Since": {modified.Format(http.TimeFormat)}}); rr.Code != http.StatusNotModified {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotModified)
+	}
+
+	// the expiring feature leaves the select without a transaction, so the select has no validators
+	expiring := newFeatureWithID(orb.Point{2, 2}, "expiring-id")
+	expiring.Properties[ExpiresAtProperty] = time.Now().Add(time.Hour).Unix()
+	insert(expiring)
+	rr = get("/test/select", nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != "" || rr.Header().Get("Last-Modified") != "" {
+		t.Errorf("select of the expiring feature returned %v with ETag %q", rr.Code, rr.Header().Get("ETag"))
+	}
+	if rr := get("/test/select", http.Header{"If-Modified-Since": {time.Now().Add(time.Hour).Format(http.TimeFormat)}}); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestSelectAntimeridian(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	features := []*geojson.Feature{
+		newFeatureWithID(orb.Point{175, 0}, "east"),
+		newFeatureWithID(orb.Point{-175, 5}, "west"),
+		newFeatureWithID(orb.Point{180, -5}, "dateline"), // in both halves of the rect
+		newFeatureWithID(orb.Point{0, 0}, "greenwich"),
+		newFeatureWithID(orb.Point{175, 20}, "north"),
+	}
+	for _, feature := range features {
+		body, err := feature.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?rect=170,-10,-170,10", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, feature := range fc.Features {
+		got = append(got, feature.ID.(string))
+	}
+	if want := []string{"dateline", "east", "west"}; !slices.Equal(got, want) {
+		t.Errorf("select returned wrong features: got %v want %v", got, want)
+	}
+
+	// the swapped latitudes are a typo rather than an empty area
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?rect=170,10,-170,-10", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+	if !strings.Contains(rr.Body.String(), "minY") {
+		t.Errorf("unclear error for swapped latitudes: %s", rr.Body.String())
+	}
+}
+
+func TestSelectAt(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	post := func(target string, feature *geojson.Feature) {
+		body, err := feature.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", target, bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("%s returned wrong status code: got %v", target, rr.Code)
+		}
+	}
+	selectAt := func(at time.Time, want int) []*geojson.Feature {
+		ts := strconv.FormatFloat(float64(at.UnixMilli())/1000, 'f', 3, 64)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select_at?ts="+ts, nil))
+		if rr.Code != want {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, want)
+		}
+		if want != http.StatusOK {
+			return nil
+		}
+		fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fc.Features
+	}
+	ids := func(features []*geojson.Feature) []string {
+		result := make([]string, 0, len(features))
+		for _, feature := range features {
+			result = append(result, feature.ID.(string))
+		}
+		return result
+	}
+
+	before := time.Now().Add(-time.Second)
+	a := newFeatureWithID(orb.Point{0, 0}, "a")
+	b := newFeatureWithID(orb.Point{1, 1}, "b")
+	b.Properties["version"] = 1
+	post("/test/insert", a)
+	post("/test/insert", b)
+
+	time.Sleep(50 * time.Millisecond)
+	middle := time.Now()
+	time.Sleep(50 * time.Millisecond)
+
+	b = newFeatureWithID(orb.Point{2, 2}, "b")
+	b.Properties["version"] = 2
+	post("/test/delete", a)
+	post("/test/replace", b)
+	post("/test/insert", newFeatureWithID(orb.Point{3, 3}, "c"))
+
+	if got := ids(selectAt(before, http.StatusOK)); len(got) != 0 {
+		t.Errorf("select_at before the inserts returned %v", got)
+	}
+	features := selectAt(middle, http.StatusOK)
+	if got, want := ids(features), []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Errorf("select_at returned wrong features: got %v want %v", got, want)
+	} else if version := features[1].Properties["version"]; version != 1.0 {
+		t.Errorf("select_at returned wrong version of b: got %v want %v", version, 1)
+	}
+	// ts is truncated to milliseconds, so the next one is after the last insert
+	if got, want := ids(selectAt(time.Now().Add(time.Millisecond), http.StatusOK)), []string{"b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("select_at returned wrong features: got %v want %v", got, want)
+	}
+
+	// the live state is not changed by the replay
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select", nil))
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(fc.Features), []string{"b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("select returned wrong features: got %v want %v", got, want)
+	}
+
+	// the WAL before the snapshot is removed
+	time.Sleep(10 * time.Millisecond)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/snapshot", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("snapshot returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	time.Sleep(100 * time.Millisecond)
+	selectAt(middle, http.StatusGone)
+	if got, want := ids(selectAt(time.Now(), http.StatusOK)), []string{"b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("select_at after the snapshot returned wrong features: got %v want %v", got, want)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select_at?ts=yesterday", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGeometryTypeChange(t *testing.T) {
+	point := newFeatureWithID(orb.Point{0, 0}, "id")
+	polygon := newFeatureWithID(orb.Polygon{{{10, 10}, {20, 10}, {20, 20}, {10, 20}, {10, 10}}}, "id")
+
+	tests := []struct {
+		name     string
+		lock     bool
+		wantCode int
+		want     *geojson.Feature
+	}{
+		{name: "Locked", lock: true, wantCode: http.StatusConflict, want: point},
+		{name: "Allowed", lock: false, wantCode: http.StatusOK, want: polygon},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+
+			config := DefaultStorageConfig()
+			config.LockGeometryType = tt.lock
+			storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", config)
+
+			go storage.Run()
+			time.Sleep(100 * time.Millisecond)
+
+			t.Cleanup(func() {
+				_ = os.RemoveAll("test-data")
+			})
+			t.Cleanup(storage.Stop)
+
+			post := func(target string, feature *geojson.Feature) int {
+				body, err := feature.MarshalJSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				rr := httptest.NewRecorder()
+				mux.ServeHTTP(rr, httptest.NewRequest("POST", target, bytes.NewReader(body)))
+				return rr.Code
+			}
+			if code := post("/test/insert", point); code != http.StatusCreated {
+				t.Fatalf("insert returned wrong status code: got %v want %v", code, http.StatusCreated)
+			}
+			if code := post("/test/replace", polygon); code != tt.wantCode {
+				t.Errorf("replace returned wrong status code: got %v want %v", code, tt.wantCode)
+			}
+			if code := post("/test/insert", polygon); code != tt.wantCode {
+				t.Errorf("insert returned wrong status code: got %v want %v", code, tt.wantCode)
+			}
+
+			stored, _, err := storage.engine.GetFeature(context.Background(), "id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !orb.Equal(stored.Geometry, tt.want.Geometry) {
+				t.Errorf("stored wrong geometry: got %v want %v", stored.Geometry, tt.want.Geometry)
+			}
+
+			// the R-tree has the single entry at the bounds of the stored geometry
+			if size := storage.engine.rTree.Len(); size != 1 {
+				t.Errorf("R-tree has %d entries, want %d", size, 1)
+			}
+			for _, rect := range []string{"-1,-1,1,1", "15,15,16,16"} {
+				data, err := storage.engine.GetData(context.Background(), mustParseRect(t, rect))
+				if err != nil {
+					t.Fatal(err)
+				}
+				bound := tt.want.Geometry.Bound()
+				if found, want := len(data) == 1, mustParseBound(t, rect).Intersects(bound); found != want {
+					t.Errorf("select %s found the feature: %v, want %v", rect, found, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectPolygon(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	// a triangle with the vertices (0, 0), (10, 0), (0, 10)
+	triangle := orb.Polygon{{{0, 0}, {10, 0}, {0, 10}, {0, 0}}}
+
+	features := []*geojson.Feature{
+		newFeatureWithID(orb.Point{1, 1}, "inside-point"),
+		newFeatureWithID(orb.Point{9, 9}, "outside-point"), // inside the bbox only
+		newFeatureWithID(orb.LineString{{4, 4}, {8, 8}}, "crossing-line"),
+		newFeatureWithID(orb.LineString{{8, 8}, {9, 6}}, "outside-line"),
+		newFeatureWithID(orb.Polygon{{{-5, -5}, {20, -5}, {20, 20}, {-5, 20}, {-5, -5}}}, "containing-polygon"),
+		newFeatureWithID(orb.Point{20, 20}, "far-point"),
+	}
+	for _, feature := range features {
+		body, err := feature.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+	}
+
+	body, err := json.Marshal(geojson.NewGeometry(triangle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/select_polygon", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := make(map[any]bool)
+	for _, feature := range fc.Features {
+		selected[feature.ID] = true
+	}
+	for _, ID := range []string{"inside-point", "crossing-line", "containing-polygon"} {
+		if !selected[ID] {
+			t.Errorf("%s is not selected", ID)
+		}
+	}
+	if len(selected) != 3 {
+		t.Errorf("select returned %d features, want %d: %v", len(selected), 3, selected)
+	}
+
+	body, err = json.Marshal(geojson.NewGeometry(orb.Point{0, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/select_polygon", bytes.NewReader(body)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMoveFeature(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	for _, point := range []orb.Point{{1, 1}, {1.5, 1.5}, {1.5, 1.5}} {
+		body, err := newFeatureWithID(point, "moving-id").MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?rect=0,0,2,2", nil))
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 1 {
+		t.Errorf("select returned %d features, want %d", len(fc.Features), 1)
+	}
+
+	// the engine is idle after the response, so the r-tree can be read directly
+	if entries := storage.engine.rTree.Len(); entries != 1 {
+		t.Errorf("r-tree has %d entries, want %d", entries, 1)
+	}
+}
+
+func TestReplaceMovesFeature(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	for _, tt := range []struct {
+		target string
+		point  orb.Point
+	}{
+		{"/test/insert", orb.Point{10, 10}},
+		{"/test/replace", orb.Point{-120, -45}},
+	} {
+		body, err := newFeatureWithID(tt.point, "moving-id").MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", tt.target, bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+	}
+
+	for _, tt := range []struct {
+		rect         string
+		wantFeatures int
+	}{
+		{"9,9,11,11", 0},
+		{"-121,-46,-119,-44", 1},
+	} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?rect="+tt.rect, nil))
+		fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fc.Features) != tt.wantFeatures {
+			t.Errorf("select %s returned %d features, want %d", tt.rect, len(fc.Features), tt.wantFeatures)
+		}
+	}
+}
+
+func TestDeleteGeometries(t *testing.T) {
+	tests := []struct {
+		name     string
+		geometry orb.Geometry
+	}{
+		{name: "MultiPoint", geometry: orb.MultiPoint{{1, 1}, {3, 4}}},
+		{name: "LineString", geometry: orb.LineString{{1, 1}, {2, 3}, {4, 2}}},
+		{name: "Polygon", geometry: orb.Polygon{{{1, 1}, {5, 1}, {5, 5}, {1, 5}, {1, 1}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+
+			storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+			go storage.Run()
+			time.Sleep(100 * time.Millisecond)
+
+			t.Cleanup(func() {
+				_ = os.RemoveAll("test-data")
+			})
+			t.Cleanup(storage.Stop)
+
+			// the deletion carries a geometry different from the stored one
+			for _, tx := range []struct {
+				target   string
+				geometry orb.Geometry
+			}{
+				{"/test/insert", tt.geometry},
+				{"/test/delete", orb.Point{-50, -50}},
+			} {
+				body, err := newFeatureWithID(tx.geometry, "shape-id").MarshalJSON()
+				if err != nil {
+					t.Fatal(err)
+				}
+				rr := httptest.NewRecorder()
+				mux.ServeHTTP(rr, httptest.NewRequest("POST", tx.target, bytes.NewReader(body)))
+				if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+					t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+				}
+			}
+
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?rect=0,0,6,6", nil))
+			fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fc.Features) != 0 {
+				t.Errorf("select returned deleted features: %v", fc.Features)
+			}
+			if entries := storage.engine.rTree.Len(); entries != 0 {
+				t.Errorf("r-tree has %d entries, want %d", entries, 0)
+			}
+		})
+	}
+}
+
+func TestReadFeatureID(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/delete", want: "query"},
+		{path: "/feature", want: "query"},
+		{path: "/move", want: "body"},
+		{path: "/insert", want: "body"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", tt.path+"?id=query", strings.NewReader(`{"id":"body"}`))
+		ID, err := readFeatureID(req, idParamRoutes[tt.path])
+		if err != nil || ID != tt.want {
+			t.Errorf("%s: got ID %q, want %q: %v", tt.path, ID, tt.want, err)
+		}
+	}
+}
+
+func TestDeleteByID(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, http.Dir("../front/dist"), RandomBalance)
+
+	go storage.Run()
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+	t.Cleanup(router.Stop)
+
+	insert(t, newFeatureWithID(orb.Polygon{{{1, 1}, {3, 1}, {3, 3}, {1, 1}}}, "existing-id"), mux, httptest.NewRecorder())
+
+	// the id parameter deletes only on /delete, the replace with it keeps the feature
+	body, err := newFeatureWithID(orb.Polygon{{{1, 1}, {4, 1}, {4, 4}, {1, 1}}}, "existing-id").MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/replace?id=existing-id", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("replace returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if exists, _ := storage.engine.Exists(context.Background(), "existing-id"); !exists {
+		t.Fatalf("replace with the id parameter deleted the feature")
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		wantCode int
+	}{
+		{name: "Existing Feature", target: "/delete?id=existing-id", wantCode: http.StatusOK},
+		{name: "Deleted Feature", target: "/delete?id=existing-id", wantCode: http.StatusNotFound},
+		{name: "Missing Feature", target: "/delete?id=missing-id", wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("DELETE", tt.target, nil))
+			if rr.Code != http.StatusTemporaryRedirect {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTemporaryRedirect)
+			}
+
+			rr2 := httptest.NewRecorder()
+			mux.ServeHTTP(rr2, httptest.NewRequest("DELETE", rr.Header().Get("Location"), nil))
+			if rr2.Code != tt.wantCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr2.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusOK {
+				return
+			}
+
+			var body ErrorResponse
+			if ct := rr2.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("error has wrong content type: got %q want %q", ct, "application/json")
+			}
+			if err := json.NewDecoder(rr2.Body).Decode(&body); err != nil {
+				t.Fatalf("error is not JSON: %v", err)
+			}
+			if body.Code != tt.wantCode || body.Error == "" {
+				t.Errorf("error body is wrong: %+v", body)
+			}
+		})
+	}
+
+	txs := storage.engine.allTransactions()
+	if len(txs) != 1 || txs[0].Action != Delete || txs[0].Feature.Geometry == nil {
+		t.Errorf("deletion does not carry the stored geometry: %v", txs)
+	}
+	if entries := storage.engine.rTree.Len(); entries != 0 {
+		t.Errorf("r-tree has %d entries, want %d", entries, 0)
+	}
+}
+
+func TestWithin(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	features := []*geojson.Feature{
+		newFeatureWithID(orb.Point{0, 0.002}, "far-id"),        // ~222m
+		newFeatureWithID(orb.Point{0, 0.001}, "near-id"),       // ~111m
+		newFeatureWithID(orb.Point{0.01, 0}, "outside-id"),     // ~1.1km
+		newFeatureWithID(orb.Point{0.004, 0.004}, "corner-id"), // in the bounding box, but ~629m away
+	}
+	for _, feature := range features {
+		body, err := feature.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/within?lon=0&lat=0&radius_m=500", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 2 || fc.Features[0].ID != "near-id" || fc.Features[1].ID != "far-id" {
+		t.Fatalf("within returned wrong features: %v", fc.Features)
+	}
+	if distance := fc.Features[0].Properties.MustFloat64(DistanceProperty); math.Abs(distance-111) > 1 {
+		t.Errorf("within returned wrong distance: got %v want ~111", distance)
+	}
+
+	for _, query := range []string{"lon=0&lat=0", "lon=0&lat=100&radius_m=1", "lon=0&lat=0&radius_m=-1"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/within?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	for i := 0; i < HistorySize+2; i++ {
+		body, err := newFeatureWithID(orb.Point{float64(i), 0}, "id").MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := "/test/replace"
+		if i == 0 {
+			path = "/test/insert"
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", path, bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []float64 // longitudes of the versions
+	}{
+		{"id=id&limit=3", []float64{11, 10, 9}},
+		{"id=id", []float64{11, 10, 9, 8, 7, 6, 5, 4, 3, 2}},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/history?"+tt.query, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: handler returned wrong status code: got %v want %v", tt.query, rr.Code, http.StatusOK)
+		}
+		fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]float64, 0, len(fc.Features))
+		for _, feature := range fc.Features {
+			got = append(got, feature.Geometry.(orb.Point).Lon())
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: history returned wrong versions: got %v want %v", tt.query, got, tt.want)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/delete?id=id", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	for query, code := range map[string]int{"id=id": http.StatusNotFound, "": http.StatusBadRequest, "id=id&limit=0": http.StatusBadRequest} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/history?"+query, nil))
+		if rr.Code != code {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", query, rr.Code, code)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/test/subscribe?rect=0,0,1,1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("handler returned %v %q, want %v text/event-stream", resp.StatusCode, resp.Header.Get("Content-Type"), http.StatusOK)
+	}
+
+	changes := []struct {
+		path    string
+		feature *geojson.Feature
+	}{
+		{"/test/insert", newFeatureWithID(orb.Point{5, 5}, "outside-id")},
+		{"/test/insert", newFeatureWithID(orb.Point{0.5, 0.5}, "inside-id")},
+		{"/test/replace", newFeatureWithID(orb.Point{5, 5}, "inside-id")}, // leaves the rect
+		{"/test/replace", newFeatureWithID(orb.Point{6, 6}, "inside-id")},
+	}
+	for _, change := range changes {
+		body, err := change.feature.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", change.path, bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	lsns := make([]uint64, 0)
+	for len(lsns) < 2 && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event ChangeEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Feature.ID != "inside-id" || event.Action != Upsert {
+			t.Errorf("subscriber got change out of its rect: %+v", event)
+		}
+		lsns = append(lsns, event.LSN)
+	}
+	if !slices.Equal(lsns, []uint64{2, 3}) {
+		t.Errorf("subscriber got changes with wrong LSNs: got %v want %v", lsns, []uint64{2, 3})
+	}
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	if n := storage.engine.subscribers.Len(); n != 0 {
+		t.Errorf("subscriber was not removed after the request was cancelled: %d left", n)
+	}
+
+	// the slow subscriber is dropped instead of blocking the engine
+	registry := NewSubscriberRegistry()
+	slow := registry.Subscribe(nil)
+	for i := 0; i <= SubscriberBufferSize; i++ {
+		registry.Publish(&ChangeEvent{Action: Upsert, LSN: uint64(i + 1)})
+	}
+	if registry.Len() != 0 {
+		t.Errorf("slow subscriber was not dropped")
+	}
+	for range slow.events {
+	}
+}
+
+func TestWatch(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	watchURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/test/watch"
+	conn, _, err := websocket.DefaultDialer.Dial(watchURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteJSON(WatchMessage{Rect: []float64{0, 0, 1, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // the subscription is made after the message is read
+
+	changes := []struct {
+		path    string
+		feature *geojson.Feature
+	}{
+		{"/test/insert", newFeatureWithID(orb.Point{5, 5}, "outside-id")},
+		{"/test/insert", newFeatureWithID(orb.Point{0.5, 0.5}, "inside-id")},
+		{"/test/replace", newFeatureWithID(orb.Point{5, 5}, "inside-id")}, // leaves the rect
+		{"/test/replace", newFeatureWithID(orb.Point{6, 6}, "inside-id")},
+	}
+	for _, change := range changes {
+		body, err := change.feature.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", change.path, bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+	}
+
+	lsns := make([]uint64, 0)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(lsns) < 2 {
+		var event ChangeEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Feature.ID != "inside-id" {
+			t.Errorf("watcher got change out of its rect: %+v", event)
+		}
+		lsns = append(lsns, event.LSN)
+	}
+	if !slices.Equal(lsns, []uint64{2, 3}) {
+		t.Errorf("watcher got changes with wrong LSNs: got %v want %v", lsns, []uint64{2, 3})
+	}
+
+	invalid, _, err := websocket.DefaultDialer.Dial(watchURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer invalid.Close()
+	if err := invalid.WriteJSON(WatchMessage{Rect: []float64{0, 0}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := invalid.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("invalid subscribe message got %v, want close with policy violation", err)
+	}
+}
+
+func TestDeleteLeavesTombstone(t *testing.T) {
+	tests := []struct {
+		name          string
+		replicas      []string
+		wantTombstone bool
+	}{
+		{
+			name:          "Without Replicas",
+			replicas:      []string{},
+			wantTombstone: false,
+		},
+		{
+			name:          "Unreachable Replica",
+			replicas:      []string{"unreachable"},
+			wantTombstone: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+
+			storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress, tt.replicas...), true, "test-data", DefaultStorageConfig())
+
+			go storage.Run()
+			time.Sleep(100 * time.Millisecond)
+
+			t.Cleanup(func() {
+				_ = os.RemoveAll("test-data")
+			})
+			t.Cleanup(storage.Stop)
+
+			body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "deleted-id").MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, req := range []*http.Request{
+				httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)),
+				httptest.NewRequest("DELETE", "/test/delete", bytes.NewReader(body)),
+			} {
+				rr := httptest.NewRecorder()
+				mux.ServeHTTP(rr, req)
+				if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+					t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+				}
+			}
+
+			if exists, _ := storage.engine.Exists(context.Background(), "deleted-id"); exists {
+				t.Fatalf("deleted feature still exists")
+			}
+			txs := storage.engine.allTransactions()
+			if len(txs) != 1 || txs[0].Action != Delete {
+				t.Fatalf("deletion is not propagated to replicas: %v", txs)
+			}
+
+			if _, err := storage.engine.MakeSnapshot(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := storage.engine.data["deleted-id"]; ok != tt.wantTombstone {
+				t.Errorf("tombstone is kept after snapshot: got %v want %v", ok, tt.wantTombstone)
+			}
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		feature := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i))
+		if _, err := storage.engine.ApplyTransaction(context.Background(), Upsert, feature, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/truncate", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if header, want := rr.Header().Get(CommittedLSNHeader), formatLSN("test", count+1); header != want {
+		t.Errorf("truncate is not a single transaction: %s is %q, want %q", CommittedLSNHeader, header, want)
+	}
+
+	data, err := storage.engine.GetData(context.Background(), mustParseRect(t, "-1,-1,2,2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 || storage.engine.State().Features != 0 {
+		t.Errorf("%d features are selected after truncate", len(data))
+	}
+
+	// the truncate is a single WAL record which the replicas apply as well
+	file, err := os.Open(storage.engine.walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal, err := readWALRecords(file)
+	_ = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wal) != count+1 || wal[count].Action != Truncate {
+		t.Fatalf("got %d WAL records, want %d ending with the truncate", len(wal), count+1)
+	}
+
+	replica := NewEngine("replica", nil, context.Background(), EngineConfig{CommandBuffer: DefaultCommandBuffer})
+	go replica.Start()
+	txs := make([]*Transaction, len(wal))
+	for i := range wal {
+		txs[i] = &wal[i]
+	}
+	if err := replica.ApplyReplicated(context.Background(), "test", txs...); err != nil {
+		t.Fatal(err)
+	}
+	if features := replica.State().Features; features != 0 {
+		t.Errorf("replica has %d features after truncate", features)
+	}
+
+	// the features inserted after the truncate are kept by the replay of the compacted WAL
+	if _, err := storage.engine.ApplyTransaction(context.Background(), Upsert, newFeatureWithID(orb.Point{0, 0}, "id-0"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.engine.CompactWAL(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewEngine("test", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: storage.engine.snapshotFile, WALFile: storage.engine.walFile, CommandBuffer: DefaultCommandBuffer})
+	go restarted.Start()
+	all, err := restarted.GetAllData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all["id-0"] == nil {
+		t.Errorf("restored %d features, want only id-0", len(all))
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	tests := []struct {
+		name          string
+		sweepInterval time.Duration
+		wantFeatures  int
+	}{
+		{name: "Filtered Before Sweep", sweepInterval: 0, wantFeatures: 2},
+		{name: "Deleted By Sweep", sweepInterval: 50 * time.Millisecond, wantFeatures: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+
+			storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+			storage.engine.sweepInterval = tt.sweepInterval
+
+			go storage.Run()
+			time.Sleep(100 * time.Millisecond)
+
+			t.Cleanup(func() {
+				_ = os.RemoveAll("test-data")
+			})
+			t.Cleanup(storage.Stop)
+
+			expiresAt := float64(time.Now().Add(100*time.Millisecond).UnixMilli()) / 1000
+			bodies := []string{
+				`{"type":"Feature","id":"expiring-id","geometry":{"type":"Point","coordinates":[1,1]},"properties":{"expires_at":` + strconv.FormatFloat(expiresAt, 'f', -1, 64) + `}}`,
+				`{"type":"Feature","id":"permanent-id","geometry":{"type":"Point","coordinates":[2,2]},"properties":{}}`,
+			}
+			for _, body := range bodies {
+				rr := httptest.NewRecorder()
+				mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", strings.NewReader(body)))
+				if rr.Code != http.StatusCreated {
+					t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+				}
+			}
+
+			time.Sleep(300 * time.Millisecond)
+
+			for _, target := range []string{"/test/select", "/test/select?rect=0,0,3,3"} {
+				rr := httptest.NewRecorder()
+				mux.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+				fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(fc.Features) != 1 || fc.Features[0].ID != "permanent-id" {
+					t.Errorf("%s returned expired features: %v", target, fc.Features)
+				}
+			}
+
+			if features := storage.engine.State().Features; features != tt.wantFeatures {
+				t.Errorf("engine stores wrong number of features: got %v want %v", features, tt.wantFeatures)
+			}
+		})
+	}
+
+	mux := http.NewServeMux()
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	storage.initHandlers()
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	rr := httptest.NewRecorder()
+	body := `{"type":"Feature","id":"invalid-id","geometry":{"type":"Point","coordinates":[1,1]},"properties":{"expires_at":"tomorrow"}}`
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", strings.NewReader(body)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestExtent(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	extent := func() (int, Extent) {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/extent", nil))
+		var extent Extent
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &extent); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Code, extent
+	}
+
+	if code, _ := extent(); code != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusNoContent)
+	}
+
+	far := newFeatureWithID(orb.Point{10, 20}, "far-id")
+	for _, feature := range []*geojson.Feature{newFeatureWithID(orb.Point{-1, 2}, "near-id"), far} {
+		body, err := feature.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	}
+
+	if code, got := extent(); code != http.StatusOK || got != (Extent{-1, 2, 10, 20}) {
+		t.Errorf("unexpected extent: %v %+v", code, got)
+	}
+
+	body, err := far.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", "/test/delete", bytes.NewReader(body)))
+
+	if code, got := extent(); code != http.StatusOK || got != (Extent{-1, 2, -1, 2}) {
+		t.Errorf("extent did not shrink after delete: %v %+v", code, got)
+	}
+}
+
+func TestDataDir(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+
+	mux := http.NewServeMux()
+	storage := mustNewStorage(t, mux, "test-1", ReplicasAt(DefaultAddress), true, "test-data/nested", DefaultStorageConfig())
+	if info, err := os.Stat("test-data/nested"); err != nil || !info.IsDir() {
+		t.Fatalf("data directory is not created: %v", err)
+	}
+	if storage.engine.walFile != filepath.Join("test-data", "nested", WALFileName) || storage.engine.snapshotFile != filepath.Join("test-data", "nested", SnapshotFileName) {
+		t.Errorf("files are not in the data directory: %s, %s", storage.engine.walFile, storage.engine.snapshotFile)
+	}
+
+	if _, err := NewStorage(mux, "test-2", ReplicasAt(DefaultAddress), true, "test-data/../test-data/nested", DefaultStorageConfig()); !errors.Is(err, ErrDataDirLocked) {
+		t.Errorf("second storage shares the data directory: %v", err)
+	}
+
+	// the symlink leads to the same WAL
+	if err := os.Symlink("nested", "test-data/link"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStorage(mux, "test-2", ReplicasAt(DefaultAddress), true, "test-data/link", DefaultStorageConfig()); !errors.Is(err, ErrDataDirLocked) {
+		t.Errorf("second storage shares the data directory through a symlink: %v", err)
+	}
+
+	// the lock is held on the file, so it is seen by another process opening it as well
+	if _, err := lockFile(filepath.Join("test-data", "nested", LockFileName)); !errors.Is(err, ErrDataDirLocked) {
+		t.Errorf("lock file is not locked: %v", err)
+	}
+
+	// the directory is free once the storage is stopped
+	storage.Stop()
+	mustNewStorage(t, mux, "test-3", ReplicasAt(DefaultAddress), true, "test-data/nested", DefaultStorageConfig()).Stop()
+}
+
+func TestSnapshotIfDirty(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	snapshot := func() string {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/snapshot", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		return rr.Header().Get("X-Snapshot-Written")
+	}
+
+	if written := snapshot(); written != "false" {
+		t.Errorf("snapshot of empty storage is written: %v", written)
+	}
+
+	body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "existing-id").MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+
+	if written := snapshot(); written != "true" {
+		t.Errorf("snapshot after insert is not written: %v", written)
+	}
+	if written := snapshot(); written != "false" {
+		t.Errorf("snapshot without changes is written: %v", written)
+	}
+	if snapshots := storage.metrics.Snapshots.Load(); snapshots != 1 {
+		t.Errorf("snapshots made: got %v want %v", snapshots, 1)
+	}
+}
+
+func TestSnapshotDuringWrites(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+		_ = os.Remove("test-data/wal.txt.rotated")
+	})
+
+	mux := http.NewServeMux()
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	insert := func(i int) {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusCreated {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+	}
+
+	const features = 200
+	for i := 0; i < features/2; i++ {
+		insert(i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/snapshot", nil))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusConflict {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+	}()
+	for i := features / 2; i < features; i++ {
+		insert(i)
+	}
+	wg.Wait()
+	storage.Stop()
+
+	// every feature is restored from the snapshot and the WALs written around it
+	restored := mustNewStorage(t, http.NewServeMux(), "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	go restored.Run()
+	t.Cleanup(restored.Stop)
+	time.Sleep(100 * time.Millisecond)
+
+	data, err := restored.engine.GetAllData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != features {
+		t.Errorf("restored %d features, want %d", len(data), features)
+	}
+	if _, err := os.Stat("test-data/wal.txt.rotated"); !os.IsNotExist(err) {
+		t.Errorf("rotated WAL is left after the snapshot: %v", err)
+	}
+}
+
+func TestSelectEncoding(t *testing.T) {
+	mux := http.NewServeMux()
+
+	config := DefaultStorageConfig()
+	config.Encoding = EncodingConfig{Precision: 2, OmitNull: true}
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", config)
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	feature := newFeatureWithID(orb.Point{1.23456789, 2.98765432}, "id")
+	feature.Properties["null"] = nil
+	feature.Properties["empty"] = ""
+	feature.Properties["list"] = []any{}
+	feature.Properties["name"] = "point"
+	body, err := feature.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	tests := []struct {
+		query      string
+		point      orb.Point
+		properties []string
+	}{
+		{"", orb.Point{1.23, 2.99}, []string{"name"}},
+		{"?precision=4", orb.Point{1.2346, 2.9877}, []string{"name"}},
+		{"?precision=-1&omit_null=false", orb.Point{1.23456789, 2.98765432}, []string{"empty", "list", "name", "null"}},
+		{"?precision=4", orb.Point{1.2346, 2.9877}, []string{"name"}}, // the stored feature is not rounded
+	}
+	for _, test := range tests {
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select"+test.query, nil))
+		fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fc.Features) != 1 {
+			t.Fatalf("%s: got %d features, want 1", test.query, len(fc.Features))
+		}
+		if got := fc.Features[0].Point(); got != test.point {
+			t.Errorf("%s: got point %v, want %v", test.query, got, test.point)
+		}
+		var properties []string
+		for key := range fc.Features[0].Properties {
+			if !strings.HasPrefix(key, "_") {
+				properties = append(properties, key)
+			}
+		}
+		slices.Sort(properties)
+		if !slices.Equal(properties, test.properties) {
+			t.Errorf("%s: got properties %v, want %v", test.query, properties, test.properties)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select?precision=six", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	start := func() (*http.ServeMux, *Storage) {
+		mux := http.NewServeMux()
+		config := DefaultStorageConfig()
+		config.Engine.Durable = false
+		storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-memory", config)
+		go storage.Run()
+		time.Sleep(100 * time.Millisecond)
+		return mux, storage
+	}
+	mux, storage := start()
+
+	body, err := newFeatureWithID(orb.Point{1, 1}, "id").MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select", nil))
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 1 {
+		t.Fatalf("got %d features, want 1", len(fc.Features))
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/snapshot", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Snapshot-Written") == "true" {
+		t.Errorf("snapshot is written: %v %s", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select_at?ts="+strconv.FormatInt(time.Now().Unix(), 10), nil))
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotImplemented)
+	}
+
+	if _, err := os.Stat("test-memory"); !os.IsNotExist(err) {
+		t.Errorf("data directory is created: %v", err)
+	}
+
+	// the data is gone with the process, the directory is not claimed either
+	storage.Stop()
+	mux, storage = start()
+	t.Cleanup(storage.Stop)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select", nil))
+	if fc, err = geojson.UnmarshalFeatureCollection(rr.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 0 {
+		t.Errorf("got %d features after restart, want 0", len(fc.Features))
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	mux := http.NewServeMux()
+
+	config := DefaultStorageConfig()
+	config.Engine.SnapshotRetention = 2
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", config)
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+
+	for i := 0; i < 3; i++ {
+		body, err := newFeatureWithID(orb.Point{float64(i), 0}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+		}
+
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/snapshot", nil))
+		if rr.Code != http.StatusOK || rr.Header().Get("X-Snapshot-Written") != "true" {
+			t.Fatalf("snapshot is not written: %v %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/snapshots", nil))
+	var snapshots []SnapshotInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &snapshots); err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("got %d snapshots, want %d: %v", len(snapshots), 2, snapshots)
+	}
+	if snapshots[0].LSN != 3 || snapshots[1].LSN != 2 || !snapshots[0].Time.After(snapshots[1].Time) {
+		t.Errorf("snapshots are not listed from the newest one: %v", snapshots)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/restore?snapshot=../wal.txt", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/restore?snapshot="+snapshots[1].Name, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var result ImportResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 2 || result.Deleted != 1 {
+		t.Errorf("restore returned wrong result: got %+v", result)
+	}
+	storage.Stop()
+
+	// the newest snapshot is loaded and the restore is replayed from the WAL
+	restarted := mustNewStorage(t, http.NewServeMux(), "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	go restarted.Run()
+	t.Cleanup(restarted.Stop)
+	time.Sleep(100 * time.Millisecond)
+
+	data, err := restarted.engine.GetAllData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0, len(data))
+	for ID := range data {
+		got = append(got, ID)
+	}
+	slices.Sort(got)
+	if want := []string{"id-0", "id-1"}; !slices.Equal(got, want) {
+		t.Errorf("restarted with wrong features: got %v want %v", got, want)
+	}
+}
+
+func TestCompactWAL(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+
+	mux := http.NewServeMux()
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	write := func(target string, ID string, point orb.Point) {
+		body, err := newFeatureWithID(point, ID).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", target, bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		write("/test/insert", "moving-id", orb.Point{float64(i), float64(i)})
+	}
+	write("/test/insert", "deleted-id", orb.Point{1, 1})
+	write("/test/delete", "deleted-id", orb.Point{1, 1})
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/compact", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var result CompactResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Before != 7 || result.After != 2 {
+		t.Errorf("compaction kept wrong number of transactions: got %+v want 7 -> 2", result)
+	}
+	storage.Stop()
+
+	// the replay of the compacted WAL ends in the same state
+	restored := mustNewStorage(t, http.NewServeMux(), "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	go restored.Run()
+	t.Cleanup(restored.Stop)
+	time.Sleep(100 * time.Millisecond)
+
+	data, err := restored.engine.GetAllData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || data["moving-id"].Geometry.(orb.Point) != (orb.Point{4, 4}) {
+		t.Errorf("compacted WAL is replayed to wrong state: %v", data)
+	}
+	if lsn := restored.engine.State().Vclock["test"]; lsn != 7 {
+		t.Errorf("compacted WAL is replayed to wrong LSN: got %v want %v", lsn, 7)
+	}
+}
+
+func TestCompactWALRecords(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile, walFile := filepath.Join(dir, SnapshotFileName), filepath.Join(dir, WALFileName)
+
+	// the same node of two shards, and the invalid records which the replay skips
+	wal := []*Transaction{
+		{Action: Upsert, Shard: "1", Name: "peer", Lsn: 1, Feature: newFeatureWithID(orb.Point{1, 1}, "a")},
+		{Action: Upsert, Shard: "2", Name: "peer", Lsn: 5, Feature: newFeatureWithID(orb.Point{2, 2}, "b")},
+		{Action: Upsert, Shard: "1", Name: "peer", Lsn: 2, Feature: newFeatureWithID(orb.Point{1, 1}, "b")},
+		{Action: Upsert, Shard: "1", Name: "peer", Lsn: 3},
+		{Action: Delete, Shard: "1", Name: "peer", Lsn: 4, Feature: newFeatureWithID(orb.Point{1, 1}, "c")},
+	}
+	wal[4].Feature.ID = 42
+	var records []byte
+	for _, tx := range wal {
+		record, err := encodeWALRecord(TextWAL, tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record...)
+	}
+	if err := os.WriteFile(walFile, records, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	start := func() (*Engine, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		engine := NewEngine("test", nil, ctx, EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, WALSync: SyncEveryWrite, CommandBuffer: DefaultCommandBuffer})
+		go engine.Start()
+		return engine, cancel
+	}
+	engine, stop := start()
+	result, err := engine.CompactWAL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Before != 5 || result.After != 3 {
+		t.Errorf("compaction kept wrong number of transactions: got %+v want 5 -> 3", result)
+	}
+	stop()
+
+	// the last transaction of every origin is kept, so the vclock is restored
+	engine, stop = start()
+	t.Cleanup(stop)
+	if _, err := engine.GetAllData(context.Background()); err != nil {
+		t.Fatal(err) // waits for the replay
+	}
+	vclock := engine.State().Vclock
+	if vclock["1/peer"] != 2 || vclock["2/peer"] != 5 {
+		t.Errorf("compacted WAL is replayed to wrong vclock: %v", vclock)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	rr := httptest.NewRecorder()
+	feature := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "existing-id")
+	body, err := feature.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+	}
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/health", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var health HealthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if health.Name != "test" || !health.Leader || health.LSN != 1 || health.Features != 1 {
+		t.Errorf("unexpected health response: %+v", health)
+	}
+
+	// the stopped node is not ready, but the process is still alive
+	storage.Stop()
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/health", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestVclock(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	before := fetchVclock(t, mux, "test")
+	for i := 0; i < 2; i++ {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	}
+	after := fetchVclock(t, mux, "test")
+
+	if after["test"] != 2 {
+		t.Errorf("vclock has wrong LSN: got %v want %v", after["test"], 2)
+	}
+	if lag := vclockLag(after, before); lag["test"] != 2 || len(lag) != 1 {
+		t.Errorf("vclock lag is wrong: got %v want %v", lag, map[string]uint64{"test": 2})
+	}
+	if lag := vclockLag(before, after); len(lag) != 0 {
+		t.Errorf("up to date clock lags: %v", lag)
+	}
+}
+
+func TestStats(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	for i := 0; i < 3; i++ {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/test/delete?id=id-0", nil))
+
+	fetchStats := func() Stats {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/stats", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		var stats Stats
+		if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	stats := fetchStats()
+	if stats.Features != 2 || stats.Tombstones != 1 || stats.RTreeSize != 2 || stats.LSN != 4 {
+		t.Errorf("stats have wrong data counters: %+v", stats)
+	}
+	if stats.WALRecords != 4 || stats.WALBytes == 0 {
+		t.Errorf("stats have wrong WAL size: %+v", stats)
+	}
+	if stats.SnapshotTime != nil {
+		t.Errorf("stats have snapshot before it is made: %+v", stats)
+	}
+
+	if _, err := storage.engine.MakeSnapshot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stats = fetchStats()
+	if stats.WALRecords != 0 || stats.WALBytes != 0 || stats.SnapshotTime == nil || stats.SnapshotBytes == 0 {
+		t.Errorf("stats have wrong WAL and snapshot sizes after snapshot: %+v", stats)
+	}
+}
+
+func TestCollectTombstones(t *testing.T) {
+	release := make(chan struct{})
+	replicaMux := http.NewServeMux()
+	replicaMux.HandleFunc("/replica/health", func(w http.ResponseWriter, r *http.Request) {
+		<-release // the replica is slow to report its state
+		_ = json.NewEncoder(w).Encode(HealthResponse{Name: "replica", Vclock: map[string]uint64{"test": 2}})
+	})
+	replica := httptest.NewServer(replicaMux)
+	t.Cleanup(replica.Close)
+	t.Cleanup(func() { close(release) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	engine := NewEngine("test", map[string]string{"replica": replica.URL}, ctx, EngineConfig{CommandBuffer: DefaultCommandBuffer})
+	go engine.Start()
+
+	if _, err := engine.ApplyTransaction(ctx, Upsert, newFeatureWithID(orb.Point{1, 1}, "id"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.ApplyTransaction(ctx, Delete, newFeatureWithID(orb.Point{1, 1}, "id"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.MakeSnapshot(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the engine serves the requests while the replica has not responded
+	requestCtx, cancelRequest := context.WithTimeout(ctx, HeartbeatTimeout/2)
+	defer cancelRequest()
+	stats, err := engine.Stats(requestCtx)
+	if err != nil {
+		t.Fatalf("engine is stalled by the replica: %v", err)
+	}
+	if stats.Tombstones != 1 {
+		t.Errorf("got %d tombstones before the replica has responded, want 1", stats.Tombstones)
+	}
+
+	release <- struct{}{}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if stats, err = engine.Stats(ctx); err == nil && stats.Tombstones == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("tombstone seen by the replica is kept: %+v, %v", stats, err)
+}
+
+func TestMetrics(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	for _, ID := range []string{"first-id", "second-id"} {
+		rr := httptest.NewRecorder()
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, ID).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test/select", nil))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test/snapshot", nil))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	for _, sample := range []string{
+		`storage_inserts_total{node="test"} 2`,
+		`storage_selects_total{node="test"} 1`,
+		`storage_snapshots_total{node="test"} 1`,
+		`storage_features{node="test"} 2`,
+		`storage_wal_bytes{node="test"} 0`,
+	} {
+		if !strings.Contains(rr.Body.String(), sample+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", sample, rr.Body.String())
+		}
+	}
+}
+
+func TestHealthWhileRecovering(t *testing.T) {
+	mux := http.NewServeMux()
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+
+	wal := make([]byte, 0)
+	for i := 1; i <= 3; i++ {
+		tx := Transaction{Action: Upsert, Name: "test", Lsn: uint64(i), Feature: newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i))}
+		line, err := json.Marshal(&tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wal = append(append(wal, line...), '\n')
+	}
+	if err := os.MkdirAll("test-data", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("test-data/wal.txt", wal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	if !storage.engine.State().Recovering {
+		t.Errorf("storage is not recovering before the WAL is replayed")
+	}
+	rr := httptest.NewRecorder()
+	storage.healthHandler(rr, httptest.NewRequest("GET", "/test/health", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"recovering":true`) {
+		t.Errorf("recovering node is not alive: %v %s", rr.Code, rr.Body.String())
+	}
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(storage.Stop)
+
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/health", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var health HealthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if health.Recovering || health.Features != 3 || health.LSN != 3 {
+		t.Errorf("unexpected health response after WAL replay: %+v", health)
+	}
+}
+
+func TestReady(t *testing.T) {
+	mux := http.NewServeMux()
+
+	server := httptest.NewServer(mux)
+	address := server.Listener.Addr().String()
+	leader := mustNewStorage(t, mux, "test-1", ReplicasAt(address, "test-2"), true, "test-1-data", DefaultStorageConfig())
+	follower := mustNewStorage(t, mux, "test-2", ReplicasAt(address, "test-1"), false, "test-2-data", DefaultStorageConfig())
+
+	t.Cleanup(func() {
+		for _, name := range []string{"test-1", "test-2"} {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(server.Close)
+	t.Cleanup(leader.Stop)
+	t.Cleanup(follower.Stop)
+
+	ready := func(storage *Storage) int {
+		rr := httptest.NewRecorder()
+		storage.readyHandler(rr, httptest.NewRequest("GET", "/"+storage.name+"/ready", nil))
+		return rr.Code
+	}
+	if code := ready(follower); code != http.StatusServiceUnavailable {
+		t.Errorf("not started node is ready: got %v want %v", code, http.StatusServiceUnavailable)
+	}
+
+	// the follower has restored the data but has not heard from the leader
+	go follower.Run()
+	time.Sleep(2 * HeartbeatInterval)
+	if code := ready(follower); code != http.StatusServiceUnavailable {
+		t.Errorf("follower without a leader is ready: got %v want %v", code, http.StatusServiceUnavailable)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test-2/health", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("follower without a leader is not alive: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	go leader.Run()
+	time.Sleep(2 * HeartbeatInterval)
+	for _, storage := range []*Storage{leader, follower} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/"+storage.name+"/ready", nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s is not ready: got %v want %v", storage.name, rr.Code, http.StatusOK)
+		}
+	}
+
+	leader.Stop()
+	if code := ready(leader); code != http.StatusServiceUnavailable {
+		t.Errorf("stopped node is ready: got %v want %v", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestLeaderHint(t *testing.T) {
+	mux := http.NewServeMux()
+
+	server := httptest.NewServer(mux)
+	address := server.Listener.Addr().String()
+	leader := mustNewStorage(t, mux, "test-1", ReplicasAt(address, "test-2"), true, "test-1-data", DefaultStorageConfig())
+	follower := mustNewStorage(t, mux, "test-2", ReplicasAt(address, "test-1"), false, "test-2-data", DefaultStorageConfig())
+
+	t.Cleanup(func() {
+		for _, name := range []string{"test-1", "test-2"} {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(server.Close)
+	t.Cleanup(leader.Stop)
+	t.Cleanup(follower.Stop)
+
+	body, err := newFeatureWithID(orb.Point{1, 1}, "id").MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(name string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/"+name+"/insert?fields=name", bytes.NewReader(body)))
+		return rr
+	}
+
+	// the follower has not heard from the leader yet
+	go follower.Run()
+	time.Sleep(2 * HeartbeatInterval)
+	rr := insert("test-2")
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" || rr.Header().Get(LeaderHeader) != "" {
+		t.Errorf("write without a leader returned %v, Retry-After %q, leader %q, want %v with Retry-After",
+			rr.Code, rr.Header().Get("Retry-After"), rr.Header().Get(LeaderHeader), http.StatusServiceUnavailable)
+	}
+
+	go leader.Run()
+	time.Sleep(2 * HeartbeatInterval)
+	rr = insert("test-2")
+	// the leader is redirected to under its base URL, it may be served by another process
+	if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != server.URL+"/test-1/insert?fields=name" || rr.Header().Get(LeaderHeader) != "test-1" {
+		t.Errorf("write to the follower returned %v, Location %q, leader %q, want %v to the leader",
+			rr.Code, rr.Header().Get("Location"), rr.Header().Get(LeaderHeader), http.StatusTemporaryRedirect)
+	}
+
+	rr = insert("test-1")
+	if rr.Code != http.StatusCreated || rr.Header().Get(LeaderHeader) != "test-1" {
+		t.Errorf("write to the leader returned %v, leader %q, want %v", rr.Code, rr.Header().Get(LeaderHeader), http.StatusCreated)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test-2/insert", strings.NewReader("{")))
+	if rr.Header().Get(LeaderHeader) != "test-1" {
+		t.Errorf("error response %v names leader %q, want %q", rr.Code, rr.Header().Get(LeaderHeader), "test-1")
+	}
+}
+
+func TestReplicationShutdown(t *testing.T) {
+	mux := http.NewServeMux()
+
+	server := httptest.NewServer(mux)
+	address := server.Listener.Addr().String()
+	leader := mustNewStorage(t, mux, "test-1", ReplicasAt(address, "test-2"), true, "test-1-data", DefaultStorageConfig())
+	follower := mustNewStorage(t, mux, "test-2", ReplicasAt(address, "test-1"), false, "test-2-data", DefaultStorageConfig())
+
+	t.Cleanup(func() {
+		for _, name := range []string{"test-1", "test-2"} {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(server.Close)
+
+	go leader.Run()
+	go follower.Run()
+	time.Sleep(2 * HeartbeatInterval)
+	if !follower.connections.Has("test-1") {
+		t.Fatal("leader has not connected to the follower")
+	}
+
+	replicationLoops := func() int {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		return strings.Count(stacks, "(*Storage).replicationHandler.func") + strings.Count(stacks, "(*ReplicaRegistry).writeLoop")
+	}
+	if loops := replicationLoops(); loops == 0 {
+		t.Fatal("no replication loops are found")
+	}
+
+	// the read loop of the replaced connection leaves the new one registered
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+address+"/test-2/replication?name=test-1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	first := dial()
+	defer first.Close()
+	second := dial()
+	defer second.Close()
+	time.Sleep(50 * time.Millisecond)
+	if !follower.connections.Has("test-1") {
+		t.Error("reconnected replica is removed by the read loop of its previous connection")
+	}
+
+	// only the configured replicas connecting from their addresses are accepted
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+address+"/test-2/replication?name=test-3", nil)
+	if err != websocket.ErrBadHandshake || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got %v for an unknown replica, want 403", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/test-2/replication?name=test-1", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if err := follower.checkPeer(req, "test-1"); err == nil {
+		t.Error("replica connecting from a foreign address is accepted")
+	}
+
+	follower.Stop()
+	leader.Stop()
+	deadline := time.Now().Add(time.Second)
+	for replicationLoops() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if loops := replicationLoops(); loops > 0 {
+		t.Errorf("%d replication loops are left after Stop", loops)
+	}
+	if follower.connections.Len() != 0 || leader.connections.Len() != 0 {
+		t.Errorf("stopped nodes keep %d and %d replica connections", follower.connections.Len(), leader.connections.Len())
+	}
+}
+
+func TestLeaderFlip(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	// the flag is flipped while the writes read it, the race detector checks the access
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			storage.setLeader(i%2 == 1)
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := newFeatureWithID(orb.Point{1, 1}, "id-"+strconv.Itoa(i)).MarshalJSON()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+			if rr.Code != http.StatusCreated && rr.Code != http.StatusServiceUnavailable {
+				t.Errorf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusCreated, http.StatusServiceUnavailable)
+			}
+		}()
+	}
+	wg.Wait()
+	<-done
+}
+
+func TestLeaderElection(t *testing.T) {
+	mux := http.NewServeMux()
+
+	server := httptest.NewServer(mux)
+
+	names := []string{"test-1", "test-2", "test-3"}
+	storages := make([]*Storage, 0, len(names))
+	for i, name := range names {
+		replicas := make([]string, 0, len(names)-1)
+		for _, replica := range names {
+			if replica != name {
+				replicas = append(replicas, replica)
+			}
+		}
+		address := server.Listener.Addr().String()
+		storages = append(storages, mustNewStorage(t, mux, name, ReplicasAt(address, replicas...), i == 0, name+"-data", DefaultStorageConfig()))
+	}
+
+	for _, storage := range storages {
+		go storage.Run()
+	}
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(server.Close)
+	for _, storage := range storages {
+		t.Cleanup(storage.Stop)
+	}
+
+	time.Sleep(2 * HeartbeatTimeout)
+	for i, storage := range storages {
+		if storage.IsLeader() != (i == 0) {
+			t.Fatalf("unexpected leader flag on %s before failover: %v", storage.name, storage.IsLeader())
+		}
+	}
+
+	// kill the leader
+	storages[0].Stop()
+	time.Sleep(2 * HeartbeatTimeout)
+
+	if !storages[1].IsLeader() {
+		t.Fatalf("%s did not become a leader", storages[1].name)
+	}
+	if storages[2].IsLeader() {
+		t.Fatalf("%s must not become a leader", storages[2].name)
+	}
+
+	feature := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "after-failover")
+	body, err := feature.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/test-2/insert", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+	}
+	if exists, _ := storages[1].engine.Exists(context.Background(), "after-failover"); !exists {
+		t.Errorf("feature was not inserted by the new leader")
+	}
+}
+
+func TestRouterLeaderFailover(t *testing.T) {
+	mux := http.NewServeMux()
+
+	server := httptest.NewServer(mux)
+
+	names := []string{"test-1", "test-2", "test-3"}
+	storages := make([]*Storage, 0, len(names))
+	for i, name := range names {
+		replicas := make([]string, 0, len(names)-1)
+		for _, replica := range names {
+			if replica != name {
+				replicas = append(replicas, replica)
+			}
+		}
+		address := server.Listener.Addr().String()
+		storages = append(storages, mustNewStorage(t, mux, name, ReplicasAt(address, replicas...), i == 0, name+"-data", DefaultStorageConfig()))
+	}
+	// the configured leader is the initial one only
+	router := NewRouter(mux, [][]string{names}, [][]string{{"test-1"}}, http.Dir("../front/dist"), RandomBalance)
+
+	for _, storage := range storages {
+		go storage.Run()
+	}
+	go router.Run()
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(server.Close)
+	t.Cleanup(router.Stop)
+	for _, storage := range storages {
+		t.Cleanup(storage.Stop)
+	}
+
+	insertThrough := func(ID string) string {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, ID).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("router returned wrong status code: got %v want %v", rr.Code, http.StatusTemporaryRedirect)
+		}
+		location := rr.Header().Get("Location")
+
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", location, bytes.NewReader(body)))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("insert redirected to %s returned wrong status code: got %v want %v", location, rr.Code, http.StatusCreated)
+		}
+		return location
+	}
+
+	time.Sleep(2 * HeartbeatTimeout)
+	if location := insertThrough("before-failover"); location != "/test-1/insert" {
+		t.Errorf("insert is redirected to %s before the failover, want %s", location, "/test-1/insert")
+	}
+
+	// kill the leader, the router learns the elected one from the health checks
+	storages[0].Stop()
+	time.Sleep(2*HeartbeatTimeout + 3*HealthCheckInterval)
+	if !storages[1].IsLeader() {
+		t.Fatalf("%s did not become a leader", storages[1].name)
+	}
+
+	for i := 0; i < 10; i++ {
+		if location := insertThrough("after-failover-" + strconv.Itoa(i)); location != "/test-2/insert" {
+			t.Fatalf("insert is redirected to %s after the failover, want %s", location, "/test-2/insert")
+		}
+	}
+}
+
+func TestReplicasOnSeparateServers(t *testing.T) {
+	names := []string{"test-1", "test-2"}
+	muxes := []*http.ServeMux{http.NewServeMux(), http.NewServeMux()}
+	servers := make([]*httptest.Server, 0, len(names))
+	for _, mux := range muxes {
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		servers = append(servers, server)
+	}
+
+	storages := []*Storage{
+		mustNewStorage(t, muxes[0], names[0], map[string]string{names[1]: servers[1].URL}, true, names[0]+"-data", DefaultStorageConfig()),
+		mustNewStorage(t, muxes[1], names[1], map[string]string{names[0]: servers[0].URL}, false, names[1]+"-data", DefaultStorageConfig()),
+	}
+	for _, storage := range storages {
+		go storage.Run()
+		t.Cleanup(storage.Stop)
+	}
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	body, err := newFeatureWithID(orb.Point{1, 1}, "replicated-id").MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	muxes[0].ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/insert", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if exists, _ := storages[1].engine.Exists(context.Background(), "replicated-id"); !exists {
+		t.Errorf("feature was not replicated to the other server")
+	}
+	if lag := vclockLag(fetchVclock(t, muxes[0], names[0]), fetchVclock(t, muxes[1], names[1])); len(lag) != 0 {
+		t.Errorf("replica is missing transactions: %v", lag)
+	}
+}
+
+func TestMutualReplicasNoLoop(t *testing.T) {
+	names := []string{"test-1", "test-2"}
+	muxes := []*http.ServeMux{http.NewServeMux(), http.NewServeMux()}
+	servers := make([]*httptest.Server, 0, len(names))
+	for _, mux := range muxes {
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		servers = append(servers, server)
+	}
+
+	// the nodes are connected to each other in both directions
+	storages := []*Storage{
+		mustNewStorage(t, muxes[0], names[0], map[string]string{names[1]: servers[1].URL}, true, names[0]+"-data", DefaultStorageConfig()),
+		mustNewStorage(t, muxes[1], names[1], map[string]string{names[0]: servers[0].URL}, false, names[1]+"-data", DefaultStorageConfig()),
+	}
+	for _, storage := range storages {
+		go storage.Run()
+		t.Cleanup(storage.Stop)
+	}
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	body, err := newFeatureWithID(orb.Point{1, 1}, "id").MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	muxes[0].ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/insert", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	for _, storage := range storages {
+		stats, err := storage.engine.Stats(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the transaction is saved exactly once by every node and is not sent back
+		if stats.Features != 1 || stats.WALRecords != 1 {
+			t.Errorf("%s has %d features and %d WAL records, want %d", storage.name, stats.Features, stats.WALRecords, 1)
+		}
+		if vclock := storage.engine.State().Vclock; vclock[names[0]] != 1 || vclock[names[1]] != 0 {
+			t.Errorf("%s has vclock %v, want only %s:1", storage.name, vclock, names[0])
+		}
+	}
+}
+
+func TestGossip(t *testing.T) {
+	for _, gossip := range []bool{false, true} {
+		t.Run("gossip="+strconv.FormatBool(gossip), func(t *testing.T) {
+			mux := http.NewServeMux()
+			server := httptest.NewServer(mux)
+			t.Cleanup(server.Close)
+
+			// the chain test-1 - test-2 - test-3, the last node is not connected to the origin
+			names := []string{"test-1", "test-2", "test-3"}
+			config := DefaultStorageConfig()
+			config.Engine.Gossip = gossip
+			storages := []*Storage{
+				mustNewStorage(t, mux, names[0], map[string]string{names[1]: server.URL}, true, names[0]+"-data", DefaultStorageConfig()),
+				mustNewStorage(t, mux, names[1], map[string]string{names[0]: server.URL, names[2]: server.URL}, false, names[1]+"-data", config),
+				mustNewStorage(t, mux, names[2], map[string]string{names[1]: server.URL}, false, names[2]+"-data", DefaultStorageConfig()),
+			}
+			for _, storage := range storages {
+				go storage.Run()
+				t.Cleanup(storage.Stop)
+			}
+
+			t.Cleanup(func() {
+				for _, name := range names {
+					_ = os.RemoveAll(name + "-data")
+				}
+			})
+
+			time.Sleep(500 * time.Millisecond)
+
+			body, err := newFeatureWithID(orb.Point{1, 1}, "id").MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/insert", bytes.NewReader(body)))
+			if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+				t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+			}
+
+			time.Sleep(300 * time.Millisecond)
+
+			if exists, _ := storages[1].engine.Exists(context.Background(), "id"); !exists {
+				t.Errorf("feature was not replicated to the connected node")
+			}
+			if exists, _ := storages[2].engine.Exists(context.Background(), "id"); exists != gossip {
+				t.Errorf("feature exists on the transitive node: %v, want %v", exists, gossip)
+			}
+			if gossip {
+				if lsn := storages[2].engine.State().Vclock[names[0]]; lsn != 1 {
+					t.Errorf("transitive node has LSN %d of the origin, want %d", lsn, 1)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicaResync(t *testing.T) {
+	names := []string{"test-1", "test-2"}
+	muxes := []*http.ServeMux{http.NewServeMux(), http.NewServeMux()}
+	servers := make([]*httptest.Server, 0, len(names))
+	for _, mux := range muxes {
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		servers = append(servers, server)
+	}
+
+	storages := []*Storage{
+		mustNewStorage(t, muxes[0], names[0], map[string]string{names[1]: servers[1].URL}, true, names[0]+"-data", DefaultStorageConfig()),
+		mustNewStorage(t, muxes[1], names[1], map[string]string{names[0]: servers[0].URL}, false, names[1]+"-data", DefaultStorageConfig()),
+	}
+	for _, storage := range storages {
+		go storage.Run()
+		t.Cleanup(storage.Stop)
+	}
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	// the dropped replica misses the transactions until it is reconnected
+	storages[0].engine.connections.Remove(names[1])
+	for i := 0; i < 5; i++ {
+		body, err := newFeatureWithID(orb.Point{float64(i), 1}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		muxes[0].ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+	}
+
+	time.Sleep(3 * HeartbeatInterval)
+
+	if lag := vclockLag(fetchVclock(t, muxes[0], names[0]), fetchVclock(t, muxes[1], names[1])); len(lag) != 0 {
+		t.Errorf("reconnected replica is missing transactions: %v", lag)
+	}
+}
+
+func TestTruncateResync(t *testing.T) {
+	names := []string{"test-1", "test-2"}
+	muxes := []*http.ServeMux{http.NewServeMux(), http.NewServeMux()}
+	servers := make([]*httptest.Server, 0, len(names))
+	for _, mux := range muxes {
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		servers = append(servers, server)
+	}
+
+	storages := []*Storage{
+		mustNewStorage(t, muxes[0], names[0], map[string]string{names[1]: servers[1].URL}, true, names[0]+"-data", DefaultStorageConfig()),
+		mustNewStorage(t, muxes[1], names[1], map[string]string{names[0]: servers[0].URL}, false, names[1]+"-data", DefaultStorageConfig()),
+	}
+	for _, storage := range storages {
+		go storage.Run()
+		t.Cleanup(storage.Stop)
+	}
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		feature := newFeatureWithID(orb.Point{float64(i), 1}, "id-"+strconv.Itoa(i))
+		if _, err := storages[0].engine.ApplyTransaction(context.Background(), Upsert, feature, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(3 * HeartbeatInterval)
+	if features := storages[1].engine.State().Features; features != 5 {
+		t.Fatalf("replica has %d features before truncate, want 5", features)
+	}
+
+	// the dropped replica misses the truncate and gets it by the re-sync after reconnecting
+	storages[0].engine.connections.Remove(names[1])
+	rr := httptest.NewRecorder()
+	muxes[0].ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/truncate", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	feature := newFeatureWithID(orb.Point{0, 0}, "id-after")
+	if _, err := storages[0].engine.ApplyTransaction(context.Background(), Upsert, feature, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * HeartbeatInterval)
+
+	all, err := storages[1].engine.GetAllData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all["id-after"] == nil {
+		t.Errorf("reconnected replica has %d features after truncate, want only id-after", len(all))
+	}
+}
+
+func TestForceResync(t *testing.T) {
+	names := []string{"test-1", "test-2"}
+	muxes := []*http.ServeMux{http.NewServeMux(), http.NewServeMux()}
+	servers := make([]*httptest.Server, 0, len(names))
+	for _, mux := range muxes {
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		servers = append(servers, server)
+	}
+
+	storages := []*Storage{
+		mustNewStorage(t, muxes[0], names[0], map[string]string{names[1]: servers[1].URL}, true, names[0]+"-data", DefaultStorageConfig()),
+		mustNewStorage(t, muxes[1], names[1], map[string]string{names[0]: servers[0].URL}, false, names[1]+"-data", DefaultStorageConfig()),
+	}
+	for _, storage := range storages {
+		go storage.Run()
+		t.Cleanup(storage.Stop)
+	}
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	body, err := newFeatureWithID(orb.Point{1, 1}, "id").MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	muxes[0].ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/insert", bytes.NewReader(body)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// the follower diverges without advancing its vclock of the leader
+	rogue := &Transaction{Action: Upsert, Name: "rogue", Lsn: 1, Feature: newFeatureWithID(orb.Point{2, 2}, "id")}
+	if err := storages[1].engine.ApplyReplicated(context.Background(), "rogue", rogue); err != nil {
+		t.Fatal(err)
+	}
+
+	pointOf := func(storage *Storage) orb.Point {
+		feature, _, err := storage.engine.GetFeature(context.Background(), "id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return feature.Geometry.(orb.Point)
+	}
+	if got := pointOf(storages[1]); got != (orb.Point{2, 2}) {
+		t.Fatalf("follower has not diverged: got %v", got)
+	}
+
+	rr = httptest.NewRecorder()
+	muxes[0].ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/resync?replica=unknown", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	rr = httptest.NewRecorder()
+	muxes[0].ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/resync?replica="+names[1], nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var result ResyncResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Sent != 1 {
+		t.Errorf("re-sync sent %d transactions, want %d", result.Sent, 1)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if got, want := pointOf(storages[1]), pointOf(storages[0]); got != want {
+		t.Errorf("follower is not repaired: got %v want %v", got, want)
+	}
+	if got := fetchVclock(t, muxes[1], names[1])[names[0]]; got != 1 {
+		t.Errorf("re-sync changed the vclock of the leader: got %d want %d", got, 1)
+	}
+}
+
+func TestShardLSNNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile, walFile := filepath.Join(dir, SnapshotFileName), filepath.Join(dir, WALFileName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	engine := NewEngine("archive", nil, ctx, EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, CommandBuffer: DefaultCommandBuffer})
+	go engine.Start()
+
+	// the leaders of both shards have the same name and count their LSNs from 1
+	const txs = 100
+	var wg sync.WaitGroup
+	for _, shard := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for lsn := uint64(1); lsn <= txs; lsn++ {
+				feature := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, fmt.Sprintf("%s-%d", shard, lsn))
+				tx := &Transaction{Action: Upsert, Shard: shard, Name: "leader", Lsn: lsn, Feature: feature}
+				if err := engine.ApplyReplicated(context.Background(), "leader", tx); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := engine.GetAllData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2*txs {
+		t.Errorf("got %d features, want %d", len(data), 2*txs)
+	}
+	want := map[string]uint64{"a/leader": txs, "b/leader": txs}
+	if got := engine.State().Vclock; !maps.Equal(got, want) {
+		t.Errorf("got vclock %v, want %v", got, want)
+	}
+	cancel()
+
+	// the shards are kept in the WAL
+	restarted := NewEngine("archive", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, CommandBuffer: DefaultCommandBuffer})
+	go restarted.Start()
+	data, err = restarted.GetAllData(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2*txs {
+		t.Errorf("restored %d features, want %d", len(data), 2*txs)
+	}
+	if got := restarted.State().Vclock; !maps.Equal(got, want) {
+		t.Errorf("restored vclock %v, want %v", got, want)
+	}
+}
+
+func TestReplicaQueueOverflow(t *testing.T) {
+	// the replica accepts the connection but never reads from it
+	upgrader := websocket.Upgrader{}
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-stalled
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(stalled) })
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := NewReplicaRegistry("test")
+	registry.Add("slow", conn)
+	t.Cleanup(registry.Close)
+
+	feature := newFeatureWithID(orb.Point{1, 1}, "id")
+	feature.Properties["padding"] = strings.Repeat("x", 64<<10)
+	tx := &Transaction{Action: Upsert, Name: "test", Lsn: 1, Feature: feature}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*ReplicaQueueSize && registry.Has("slow"); i++ {
+			registry.Broadcast(tx)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("broadcast is blocked by the slow replica")
+	}
+	if registry.Has("slow") {
+		t.Errorf("slow replica was not dropped after its queue overflow")
+	}
+}
+
+func TestReplicaRegistryConcurrency(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	registry := NewReplicaRegistry("test")
+	t.Cleanup(registry.Close)
+
+	tx := &Transaction{Action: Upsert, Name: "test", Lsn: 1, Feature: newFeatureWithID(orb.Point{1, 1}, "id")}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					registry.Broadcast(tx)
+					registry.Heartbeat("")
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replica := "replica-" + strconv.Itoa(i%5)
+		registry.Add(replica, conn)
+		if i%2 == 0 {
+			registry.Remove(replica)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if registry.Len() > 5 {
+		t.Errorf("registry has %d connections, want at most 5", registry.Len())
+	}
+}
+
+func TestReplicationCompression(t *testing.T) {
+	upgrader := newReplicationUpgrader(LocalOrigin)
+	received := make(chan int, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		messages := 0
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				received <- messages
+				return
+			}
+			messages++
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	// a representative stream of the transactions with random polygons
+	txs := make([]*Transaction, 0, 100)
+	for i := 0; i < cap(txs); i++ {
+		polygon := orb.Polygon{orb.Ring{{0, 0}, {rand.Float64(), 0}, {rand.Float64(), rand.Float64()}, {0, rand.Float64()}, {0, 0}}}
+		feature := newFeatureWithID(polygon, "id-"+strconv.Itoa(i))
+		feature.Properties["name"] = "building " + strconv.Itoa(i)
+		txs = append(txs, &Transaction{Action: Upsert, Name: "test", Lsn: uint64(i + 1), Feature: feature})
+	}
+
+	// send returns the number of bytes written to the network
+	send := func(dialer *websocket.Dialer) int64 {
+		var written atomic.Int64
+		dialer.NetDial = func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			return &countingConn{conn, &written}, err
+		}
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setCompressionLevel(conn, DefaultReplicationCompressionLevel)
+		for _, tx := range txs {
+			if err := conn.WriteJSON(tx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = conn.Close()
+		if messages := <-received; messages != len(txs) {
+			t.Errorf("replica received %d messages, want %d", messages, len(txs))
+		}
+		return written.Load()
+	}
+
+	compressed := send(newReplicationDialer())
+	plain := send(&websocket.Dialer{}) // the node without compression still connects
+	t.Logf("replication stream is %d bytes compressed and %d bytes plain", compressed, plain)
+	if compressed >= plain {
+		t.Errorf("compressed stream of %d bytes is not smaller than plain one of %d bytes", compressed, plain)
+	}
+}
+
+func TestReplicationBatching(t *testing.T) {
+	const count = 1000
+	upgrader := newReplicationUpgrader(LocalOrigin)
+	type result struct {
+		messages int
+		lsns     []uint64
+	}
+	received := make(chan result, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var res result
+		for len(res.lsns) < count {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			txs, err := decodeReplicationMessage(message)
+			if err != nil {
+				t.Error(err)
+				break
+			}
+			res.messages++
+			for _, tx := range txs {
+				res.lsns = append(res.lsns, tx.Lsn)
+			}
+		}
+		received <- res
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := newReplicationDialer().Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewReplicaRegistry("test")
+	registry.Add("replica", conn)
+	t.Cleanup(registry.Close)
+
+	for i := 1; i <= count; i++ {
+		registry.Broadcast(&Transaction{Action: Upsert, Name: "test", Lsn: uint64(i), Feature: newFeatureWithID(orb.Point{1, 1}, "id")})
+	}
+
+	var res result
+	select {
+	case res = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replica has not received the transactions")
+	}
+	if len(res.lsns) != count {
+		t.Fatalf("replica received %d transactions, want %d", len(res.lsns), count)
+	}
+	for i, lsn := range res.lsns {
+		if lsn != uint64(i+1) {
+			t.Fatalf("transaction %d has LSN %d, want %d", i, lsn, i+1)
+		}
+	}
+	if res.messages >= count/10 {
+		t.Errorf("%d transactions were sent in %d messages, want them batched", count, res.messages)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	names := []string{"test-1", "test-2"}
+	muxes := []*http.ServeMux{http.NewServeMux(), http.NewServeMux()}
+	servers := make([]*httptest.Server, 0, len(names))
+	for _, mux := range muxes {
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		servers = append(servers, server)
+	}
+
+	storages := []*Storage{
+		mustNewStorage(t, muxes[0], names[0], map[string]string{names[1]: servers[1].URL}, true, names[0]+"-data", DefaultStorageConfig()),
+		mustNewStorage(t, muxes[1], names[1], map[string]string{names[0]: servers[0].URL}, false, names[1]+"-data", DefaultStorageConfig()),
+	}
+	for _, storage := range storages {
+		go storage.Run()
+		t.Cleanup(storage.Stop)
+	}
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+
+	time.Sleep(500 * time.Millisecond)
+
+	batch := func(query string, ops ...BatchOp) []BatchOpResult {
+		t.Helper()
+		body, err := json.Marshal(ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		muxes[0].ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/batch"+query, bytes.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+		var results []BatchOpResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+	statuses := func(results []BatchOpResult) []int {
+		codes := make([]int, 0, len(results))
+		for _, result := range results {
+			codes = append(codes, result.Status)
+		}
+		return codes
+	}
+	exists := func(storage *Storage, ID string) bool {
+		exists, err := storage.engine.Exists(context.Background(), ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	results := batch("",
+		BatchOp{BatchInsert, newFeatureWithID(orb.Point{1, 1}, "a")},
+		BatchOp{BatchInsert, newFeatureWithID(orb.Point{2, 2}, "b")},
+		BatchOp{BatchReplace, newFeatureWithID(orb.Point{3, 3}, "a")},
+		BatchOp{BatchDelete, newFeatureWithID(orb.Point{2, 2}, "b")},
+	)
+	if want := []int{201, 201, 200, 200}; !slices.Equal(statuses(results), want) {
+		t.Fatalf("got statuses %v, want %v", statuses(results), want)
+	}
+	if results[3].LSN != 4 {
+		t.Errorf("last operation has LSN %d, want 4", results[3].LSN)
+	}
+	if err := storages[1].engine.WaitForLSN(context.Background(), names[0], 4); err != nil {
+		t.Fatal(err)
+	}
+	for _, storage := range storages {
+		if !exists(storage, "a") || exists(storage, "b") {
+			t.Errorf("%s has wrong state after the batch", storage.name)
+		}
+	}
+
+	// the failed operation aborts the whole batch by default
+	missing := BatchOp{BatchReplace, newFeatureWithID(orb.Point{4, 4}, "missing")}
+	results = batch("", BatchOp{BatchInsert, newFeatureWithID(orb.Point{4, 4}, "c")}, missing, BatchOp{BatchDelete, newFeatureWithID(orb.Point{1, 1}, "a")})
+	if want := []int{424, 404, 424}; !slices.Equal(statuses(results), want) {
+		t.Errorf("got statuses %v, want %v", statuses(results), want)
+	}
+	if exists(storages[0], "c") || !exists(storages[0], "a") {
+		t.Errorf("aborted batch is partially applied")
+	}
+
+	results = batch("?on_error=continue", BatchOp{BatchInsert, newFeatureWithID(orb.Point{4, 4}, "c")}, missing)
+	if want := []int{201, 404}; !slices.Equal(statuses(results), want) {
+		t.Errorf("got statuses %v, want %v", statuses(results), want)
+	}
+	if !exists(storages[0], "c") {
+		t.Errorf("valid operation is skipped")
+	}
+
+	for _, body := range []string{`{"op":"insert"}`, `[{"op":"upsert","feature":{"type":"Feature","id":"d","geometry":{"type":"Point","coordinates":[1,1]}}}]`, `[{"op":"insert"}]`} {
+		rr := httptest.NewRecorder()
+		muxes[0].ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/batch", strings.NewReader(body)))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestBatchReplication(t *testing.T) {
+	upgrader := newReplicationUpgrader(LocalOrigin)
+	received := make(chan []Transaction, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		txs, err := decodeReplicationMessage(message)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- txs
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := newReplicationDialer().Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewReplicaRegistry("test")
+	registry.Add("replica", conn)
+	t.Cleanup(registry.Close)
+
+	// the batch larger than a replication message is still sent at once
+	count := ReplicationBatchSize + 10
+	txs := make([]*Transaction, 0, count)
+	for i := 1; i <= count; i++ {
+		txs = append(txs, &Transaction{Action: Upsert, Name: "test", Lsn: uint64(i), Batch: uint64(count), Feature: newFeatureWithID(orb.Point{1, 1}, "id")})
+	}
+	registry.Broadcast(txs...)
+
+	select {
+	case message := <-received:
+		if len(message) != count {
+			t.Errorf("replica received %d transactions of the batch in the first message, want %d", len(message), count)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replica has not received the batch")
+	}
+
+	// the batch torn by a crash is dropped from the end of the WAL
+	wal := []Transaction{{Lsn: 1}, {Lsn: 2, Batch: 3}, {Lsn: 3, Batch: 3}, {Lsn: 4, Batch: 6}, {Lsn: 5, Batch: 6}}
+	if got := dropTornBatch(wal); len(got) != 3 {
+		t.Errorf("got %d transactions after dropping the torn batch, want 3", len(got))
+	}
+	if got := dropTornBatch(wal[:3]); len(got) != 3 {
+		t.Errorf("complete batch is dropped")
+	}
+}
+
+func TestTornBatchRestart(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile, walFile := filepath.Join(dir, SnapshotFileName), filepath.Join(dir, WALFileName)
+	start := func() (*Engine, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		engine := NewEngine("test", nil, ctx, EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, CommandBuffer: DefaultCommandBuffer})
+		go engine.Start()
+		return engine, cancel
+	}
+
+	engine, stop := start()
+	if _, err := engine.ApplyTransaction(context.Background(), Upsert, newFeatureWithID(orb.Point{1, 1}, "before"), ""); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	// the crash has left two records of the batch of three
+	var torn []byte
+	for lsn := uint64(2); lsn <= 3; lsn++ {
+		record, err := encodeWALRecord(TextWAL, &Transaction{Action: Upsert, Name: "test", Lsn: lsn, Batch: 4, Feature: newFeatureWithID(orb.Point{2, 2}, "torn-"+strconv.FormatUint(lsn, 10))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		torn = append(torn, record...)
+	}
+	file, err := os.OpenFile(walFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(torn); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	// the LSNs of the torn batch are reused by the acknowledged writes after the restart
+	engine, stop = start()
+	for _, ID := range []string{"after-1", "after-2"} {
+		if _, err := engine.ApplyTransaction(context.Background(), Upsert, newFeatureWithID(orb.Point{3, 3}, ID), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop()
+
+	engine, stop = start()
+	t.Cleanup(stop)
+	for ID, want := range map[string]bool{"before": true, "after-1": true, "after-2": true, "torn-2": false, "torn-3": false} {
+		if exists, err := engine.Exists(context.Background(), ID); err != nil || exists != want {
+			t.Errorf("feature %s exists %v after the second restart, want %v: %v", ID, exists, want, err)
+		}
+	}
+}
+
+func TestCorruptedWALRestart(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile, walFile := filepath.Join(dir, SnapshotFileName), filepath.Join(dir, WALFileName)
+	start := func() (*Engine, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		engine := NewEngine("test", nil, ctx, EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, WALFormat: BinaryWAL, CommandBuffer: DefaultCommandBuffer})
+		go engine.Start()
+		return engine, cancel
+	}
+
+	engine, stop := start()
+	for _, ID := range []string{"before-1", "before-2"} {
+		if _, err := engine.ApplyTransaction(context.Background(), Upsert, newFeatureWithID(orb.Point{1, 1}, ID), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop()
+
+	// the length of the next record is corrupted, so the records after it cannot be read
+	record, err := encodeWALRecord(BinaryWAL, &Transaction{Action: Upsert, Name: "test", Lsn: 3, Feature: newFeatureWithID(orb.Point{2, 2}, "corrupted")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint32(record, MaxWALRecordSize+1)
+	file, err := os.OpenFile(walFile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	// the good records are replayed and the writes after the restart are appended after them
+	engine, stop = start()
+	if _, err := engine.ApplyTransaction(context.Background(), Upsert, newFeatureWithID(orb.Point{3, 3}, "after"), ""); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+
+	engine, stop = start()
+	t.Cleanup(stop)
+	for ID, want := range map[string]bool{"before-1": true, "before-2": true, "after": true, "corrupted": false} {
+		if exists, err := engine.Exists(context.Background(), ID); err != nil || exists != want {
+			t.Errorf("feature %s exists %v after the second restart, want %v: %v", ID, exists, want, err)
+		}
+	}
+	if lsn := engine.State().Vclock["test"]; lsn != 3 {
+		t.Errorf("got LSN %d after the second restart, want 3", lsn)
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	written *atomic.Int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestRouterFailover(t *testing.T) {
+	mux := http.NewServeMux()
+
+	alive := mustNewStorage(t, mux, "test-1", ReplicasAt(DefaultAddress), true, "test-1-data", DefaultStorageConfig())
+	dead := mustNewStorage(t, mux, "test-2", ReplicasAt(DefaultAddress), true, "test-2-data", DefaultStorageConfig())
+	router := NewRouter(mux, [][]string{{"test-1", "test-2"}}, [][]string{{"test-1", "test-2"}}, http.Dir("../front/dist"), RandomBalance)
+
+	go alive.Run()
+	go dead.Run()
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		for _, name := range []string{"test-1", "test-2"} {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(router.Stop)
+	t.Cleanup(alive.Stop)
+	t.Cleanup(dead.Stop)
+
+	dead.Stop()
+	time.Sleep(3 * HealthCheckInterval)
+
+	for i := 0; i < 20; i++ {
+		for _, path := range []string{"/select", "/insert"} {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+
+			if rr.Code != http.StatusTemporaryRedirect {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTemporaryRedirect)
+			}
+			if location := rr.Header().Get("location"); location != "/test-1"+path {
+				t.Fatalf("redirected to the dead node: %v", location)
+			}
+		}
+	}
+
+	alive.Stop()
+	time.Sleep(3 * HealthCheckInterval)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/select", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestBalanceStrategies(t *testing.T) {
+	nodes := []string{"test-1", "test-2", "test-3"}
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		router := NewRouter(http.NewServeMux(), [][]string{nodes}, [][]string{nodes}, http.Dir("../front/dist"), RoundRobinBalance)
+		for i := 0; i < 3*len(nodes); i++ {
+			replica, ok := router.chooseReplica(router.current(), 0)
+			if !ok {
+				t.Fatal("no healthy replicas")
+			}
+			if want := nodes[i%len(nodes)]; replica != want {
+				t.Errorf("choice %d is %s, want %s", i, replica, want)
+			}
+		}
+	})
+
+	t.Run("LeastConnections", func(t *testing.T) {
+		router := NewRouter(http.NewServeMux(), [][]string{nodes}, [][]string{nodes}, http.Dir("../front/dist"), LeastConnectionsBalance)
+		release := router.balancer.track("test-1")
+		router.balancer.track("test-1")
+		router.balancer.track("test-2")
+		for i := 0; i < 10; i++ {
+			if replica, _ := router.chooseReplica(router.current(), 0); replica != "test-3" {
+				t.Fatalf("chose %s, want the idle %s", replica, "test-3")
+			}
+		}
+
+		release()
+		router.balancer.track("test-3") // every node has a request in flight
+		chosen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			replica, _ := router.chooseReplica(router.current(), 0)
+			chosen[replica] = true
+		}
+		if !chosen["test-1"] || !chosen["test-2"] || !chosen["test-3"] {
+			t.Errorf("equally loaded nodes are not shared: %v", chosen)
+		}
+	})
+
+	if _, err := ParseBalanceStrategy("fastest"); err == nil {
+		t.Errorf("unknown strategy is parsed")
+	}
+}
+
+func TestShards(t *testing.T) {
+	mux := http.NewServeMux()
+
+	names := []string{"test-1", "test-2"}
+	storages := make([]*Storage, 0, len(names))
+	for _, name := range names {
+		storages = append(storages, mustNewStorage(t, mux, name, ReplicasAt(DefaultAddress), true, name+"-data", DefaultStorageConfig()))
+	}
+	router := NewRouter(mux, [][]string{{"test-1"}, {"test-2"}}, [][]string{{"test-1"}, {"test-2"}}, http.Dir("../front/dist"), RandomBalance)
+
+	for _, storage := range storages {
+		go storage.Run()
+	}
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(router.Stop)
+	for _, storage := range storages {
+		t.Cleanup(storage.Stop)
+	}
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		ID := "feature-" + strconv.Itoa(i)
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, ID).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTemporaryRedirect)
+		}
+		shard := router.current().ring.Owner(ID)
+		owner := names[shard]
+		if location := rr.Header().Get("location"); location != "/"+owner+"/insert" {
+			t.Fatalf("feature %s is redirected to %s instead of its shard %s", ID, location, owner)
+		}
+		if header := rr.Header().Get(ShardHeader); header != strconv.Itoa(shard) {
+			t.Errorf("%s is %q, want %q", ShardHeader, header, strconv.Itoa(shard))
+		}
+
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/"+owner+"/insert", bytes.NewReader(body)))
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+		if header := rr.Header().Get(ServedByHeader); header != owner {
+			t.Errorf("%s is %q, want %q", ServedByHeader, header, owner)
+		}
+	}
+
+	for _, storage := range storages {
+		if storage.engine.State().Features == 0 {
+			t.Errorf("shard %s got no features", storage.name)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/select", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != count {
+		t.Errorf("select returned %d features, want %d", len(fc.Features), count)
+	}
+	if header := rr.Header().Get(ServedByHeader); header != "test-1, test-2" {
+		t.Errorf("%s is %q, want %q", ServedByHeader, header, "test-1, test-2")
+	}
+	if header := rr.Header().Get(ShardHeader); header != "0, 1" {
+		t.Errorf("%s is %q, want %q", ShardHeader, header, "0, 1")
+	}
+
+	// the truncate reaches the leaders of all the shards
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/truncate", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if header := rr.Header().Get(ServedByHeader); header != "test-1, test-2" {
+		t.Errorf("%s is %q, want %q", ServedByHeader, header, "test-1, test-2")
+	}
+	for _, storage := range storages {
+		if features := storage.engine.State().Features; features != 0 {
+			t.Errorf("shard %s has %d features after truncate", storage.name, features)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	mux := http.NewServeMux()
+
+	names := []string{"test-1", "test-2"}
+	storages := make([]*Storage, 0, len(names))
+	for _, name := range names {
+		storages = append(storages, mustNewStorage(t, mux, name, ReplicasAt(DefaultAddress), true, name+"-data", DefaultStorageConfig()))
+	}
+	router := NewRouter(mux, [][]string{{"test-1"}, {"test-2"}}, [][]string{{"test-1"}, {"test-2"}}, http.Dir("../front/dist"), RandomBalance)
+	server := httptest.NewServer(mux)
+
+	for _, storage := range storages {
+		go storage.Run()
+	}
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(server.Close)
+	t.Cleanup(router.Stop)
+	for _, storage := range storages {
+		t.Cleanup(storage.Stop)
+	}
+
+	c, err := client.New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	committed := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		feature := newFeatureWithID(orb.Point{float64(i), float64(i)}, "id-"+strconv.Itoa(i))
+		feature.Properties["category"] = "park"
+		lsn, err := c.Insert(ctx, feature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		committed = append(committed, lsn)
+	}
+	if _, err := c.Patch(ctx, "id-1", geojson.Properties{"category": "shop"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Move(ctx, "id-2", orb.Point{50, 50}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Delete(ctx, "id-3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Replace(ctx, newFeatureWithID(orb.Point{0, 0}, "missing-id")); !client.IsNotFound(err) {
+		t.Errorf("replace of the missing feature: got %v, want not found", err)
+	}
+
+	fc, err := c.Select(ctx, client.SelectOptions{MinLSN: committed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 9 {
+		t.Errorf("selected %d features, want %d", len(fc.Features), 9)
+	}
+	fc, err = c.Select(ctx, client.SelectOptions{Rect: &orb.Bound{Min: orb.Point{0, 0}, Max: orb.Point{10, 10}}, Where: map[string]string{"category": "park"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 7 {
+		t.Errorf("selected %d parks in the rect, want %d", len(fc.Features), 7)
+	}
+
+	moved, err := c.Feature(ctx, "id-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !orb.Equal(moved.Geometry, orb.Point{50, 50}) || moved.Properties["category"] != "park" {
+		t.Errorf("moved feature is %v with %v", moved.Geometry, moved.Properties)
+	}
+	if err := c.Snapshot(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFrontFS(t *testing.T) {
+	mux := http.NewServeMux()
+
+	front := fstest.MapFS{"index.html": {Data: []byte("<h1>embedded</h1>")}}
+	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, http.FS(front), RandomBalance)
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+	t.Cleanup(router.Stop)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "embedded") {
+		t.Errorf("front-end returned %v %q", rr.Code, rr.Body.String())
+	}
+
+	if _, embedded := embeddedFront(); embedded {
+		t.Log("the binary is built with the embedded front-end")
+	} else if dir, ok := FrontFS("").(http.Dir); !ok || dir != DefaultFrontDir {
+		t.Errorf("front-end without the embedded one is %v, want %v", FrontFS(""), DefaultFrontDir)
+	}
+	if dir, ok := FrontFS("dev").(http.Dir); !ok || dir != "dev" {
+		t.Errorf("front-end of the directory is %v, want %v", FrontFS("dev"), "dev")
+	}
+}
+
+func TestRouterProxy(t *testing.T) {
+	mux := http.NewServeMux()
+
+	names := []string{"test-1", "test-2"}
+	storages := make([]*Storage, 0, len(names))
+	for _, name := range names {
+		storages = append(storages, mustNewStorage(t, mux, name, ReplicasAt(DefaultAddress), true, name+"-data", DefaultStorageConfig()))
+	}
+	router := NewRouter(mux, [][]string{{"test-1"}, {"test-2"}}, [][]string{{"test-1"}, {"test-2"}}, http.Dir("../front/dist"), RandomBalance)
+	router.SetMode(ProxyMode, "/insert", "/delete")
+
+	for _, storage := range storages {
+		go storage.Run()
+	}
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(router.Stop)
+	for _, storage := range storages {
+		t.Cleanup(storage.Stop)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	post := func(path string, body []byte) *http.Response {
+		resp, err := client.Post(server.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 10; i++ {
+		ID := "feature-" + strconv.Itoa(i)
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, ID).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		shard := router.current().ring.Owner(ID)
+		owner := names[shard]
+
+		// the body read by the router to find the shard reaches the node
+		resp := post("/insert", body)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("proxied insert returned wrong status code: got %v want %v", resp.StatusCode, http.StatusCreated)
+		}
+		if header := resp.Header.Get(ServedByHeader); header != owner {
+			t.Errorf("%s is %q, want %q", ServedByHeader, header, owner)
+		}
+		if header := resp.Header.Get(ShardHeader); header != strconv.Itoa(shard) {
+			t.Errorf("%s is %q, want %q", ShardHeader, header, strconv.Itoa(shard))
+		}
+		if _, _, err := storages[shard].engine.GetFeature(context.Background(), ID); err != nil {
+			t.Errorf("feature %s is not inserted to %s: %v", ID, owner, err)
+		}
+
+		// the other routes are still redirected
+		resp = post("/replace", body)
+		if resp.StatusCode != http.StatusTemporaryRedirect {
+			t.Errorf("replace returned wrong status code: got %v want %v", resp.StatusCode, http.StatusTemporaryRedirect)
+		}
+		if location := resp.Header.Get("Location"); location != "/"+owner+"/replace" {
+			t.Errorf("replace is redirected to %s, want %s", location, "/"+owner+"/replace")
+		}
+
+		resp = post("/delete", body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("proxied delete returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	// the host of the request does not choose where it is proxied to
+	body, err := newFeatureWithID(orb.Point{1, 1}, "feature-host").MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/insert", bytes.NewReader(body))
+	req.Host = "198.51.100.1:9"
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("proxied insert with a foreign host returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/delete?id=feature-host", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("proxied delete returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	for _, storage := range storages {
+		if features := storage.engine.State().Features; features != 0 {
+			t.Errorf("%s has %d features after the deletes", storage.name, features)
+		}
+	}
+}
+
+func TestRouterRedirectKeepsBody(t *testing.T) {
+	mux := http.NewServeMux()
+
+	names := []string{"test-1", "test-2"}
+	storages := make([]*Storage, 0, len(names))
+	for _, name := range names {
+		storages = append(storages, mustNewStorage(t, mux, name, ReplicasAt(DefaultAddress), true, name+"-data", DefaultStorageConfig()))
+	}
+	router := NewRouter(mux, [][]string{{"test-1"}, {"test-2"}}, [][]string{{"test-1"}, {"test-2"}}, http.Dir("../front/dist"), RandomBalance)
+
+	for _, storage := range storages {
+		go storage.Run()
+	}
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(router.Stop)
+	for _, storage := range storages {
+		t.Cleanup(storage.Stop)
+	}
+
+	// the client follows the 307 by itself and sends the body again
+	post := func(path string, body []byte) *http.Response {
+		resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	tests := []struct {
+		path     string
+		point    orb.Point
+		wantCode int
+	}{
+		{path: "/insert", point: orb.Point{1, 1}, wantCode: http.StatusCreated},
+		{path: "/replace", point: orb.Point{2, 2}, wantCode: http.StatusOK},
+		{path: "/delete", point: orb.Point{2, 2}, wantCode: http.StatusOK},
+	}
+	for i := 0; i < 10; i++ {
+		ID := "feature-" + strconv.Itoa(i)
+		owner := names[router.current().ring.Owner(ID)]
+		for _, tt := range tests {
+			body, err := newFeatureWithID(tt.point, ID).MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := post(tt.path, body)
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("%s of %s returned wrong status code: got %v want %v", tt.path, ID, resp.StatusCode, tt.wantCode)
+			}
+			if header := resp.Header.Get(ServedByHeader); header != owner {
+				t.Errorf("%s of %s is served by %q, want %q", tt.path, ID, header, owner)
+			}
+			if resp.Request.Method != http.MethodPost || resp.Request.URL.Path != "/"+owner+tt.path {
+				t.Errorf("%s of %s is followed as %s %s", tt.path, ID, resp.Request.Method, resp.Request.URL.Path)
+			}
+		}
+	}
+}
+
+func TestRouterConfig(t *testing.T) {
+	mux := http.NewServeMux()
+
+	names := []string{"test-1", "test-2"}
+	storages := make([]*Storage, 0, len(names))
+	for _, name := range names {
+		storages = append(storages, mustNewStorage(t, mux, name, ReplicasAt(DefaultAddress), true, name+"-data", DefaultStorageConfig()))
+	}
+
+	writeConfig := func(config string) {
+		if err := os.WriteFile("router.json", []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`{"nodes": [["test-1"]], "leaders": [["test-1"]]}`)
+
+	router, err := NewRouterFromConfig(mux, "router.json", http.Dir("../front/dist"), RandomBalance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, storage := range storages {
+		go storage.Run()
+	}
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.Remove("router.json")
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(router.Stop)
+	for _, storage := range storages {
+		t.Cleanup(storage.Stop)
+	}
+
+	for i, name := range names {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/"+name+"/insert", bytes.NewReader(body)))
+	}
+
+	selectCount := func() int {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/select", nil))
+		if rr.Code == http.StatusTemporaryRedirect {
+			rr2 := httptest.NewRecorder()
+			mux.ServeHTTP(rr2, httptest.NewRequest("GET", rr.Header().Get("Location"), nil))
+			rr = rr2
+		}
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(fc.Features)
+	}
+	if count := selectCount(); count != 1 {
+		t.Errorf("select returned %d features, want %d", count, 1)
+	}
+
+	for _, config := range []string{
+		`{"nodes": [["test-1"], ["test-2"]], "leaders": [["test-1"], ["test-1"]]}`,
+		`{"nodes": [["test-1"], ["test-2"]], "leaders": [["test-1"], []]}`,
+		`{"nodes": [["test-1"], ["test-2"]], "leaders": [["test-1"]]}`,
+		`{"nodes": []}`,
+		`not a config`,
+	} {
+		writeConfig(config)
+		if err := router.Reload(); err == nil {
+			t.Errorf("invalid config %s is reloaded", config)
+		}
+	}
+	if shards := len(router.current().Nodes); shards != 1 {
+		t.Errorf("router has %d shards after invalid reloads, want %d", shards, 1)
+	}
+
+	writeConfig(`{"nodes": [["test-1"], ["test-2"]], "leaders": [["test-1"], ["test-2"]]}`)
+	if err := router.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if count := selectCount(); count != len(names) {
+		t.Errorf("select returned %d features after reload, want %d", count, len(names))
+	}
+}
+
+func TestRouterLeaderChange(t *testing.T) {
+	mux := http.NewServeMux()
+
+	names := []string{"test-1", "test-2"}
+	storages := make([]*Storage, 0, len(names))
+	for i, name := range names {
+		storages = append(storages, mustNewStorage(t, mux, name, ReplicasAt(DefaultAddress), i == 0, name+"-data", DefaultStorageConfig()))
+	}
+
+	config := filepath.Join(t.TempDir(), "router.json")
+	writeLeader := func(leader string) {
+		data := fmt.Sprintf(`{"nodes": [["test-1", "test-2"]], "leaders": [[%q]]}`, leader)
+		if err := os.WriteFile(config, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLeader("test-1")
+
+	router, err := NewRouterFromConfig(mux, config, http.Dir("../front/dist"), RandomBalance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, storage := range storages {
+		go storage.Run()
+	}
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(router.Stop)
+	for _, storage := range storages {
+		t.Cleanup(storage.Stop)
+	}
+
+	assertRedirects := func(leader string) {
+		t.Helper()
+		for _, path := range []string{"/insert", "/replace", "/delete", "/patch"} {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("POST", path, nil))
+			if rr.Code != http.StatusTemporaryRedirect {
+				t.Fatalf("%s returned wrong status code: got %v want %v", path, rr.Code, http.StatusTemporaryRedirect)
+			}
+			if location := rr.Header().Get("Location"); location != "/"+leader+path {
+				t.Errorf("%s is redirected to %s, want %s", path, location, "/"+leader+path)
+			}
+		}
+	}
+	assertRedirects("test-1")
+
+	// the handlers are registered once, the next request goes to the new leader
+	writeLeader("test-2")
+	if err := router.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	assertRedirects("test-2")
+}
+
+func TestImportExport(t *testing.T) {
+	mux := http.NewServeMux()
+
+	names := []string{"test-1", "test-2"}
+	storages := make([]*Storage, 0, len(names))
+	for _, name := range names {
+		storages = append(storages, mustNewStorage(t, mux, name, ReplicasAt(DefaultAddress), true, name+"-data", DefaultStorageConfig()))
+	}
+	router := NewRouter(mux, [][]string{{"test-1"}, {"test-2"}}, [][]string{{"test-1"}, {"test-2"}}, http.Dir("../front/dist"), RandomBalance)
+
+	for _, storage := range storages {
+		go storage.Run()
+	}
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(router.Stop)
+	for _, storage := range storages {
+		t.Cleanup(storage.Stop)
+	}
+
+	importFeatures := func(mode string, fc *geojson.FeatureCollection) ImportResult {
+		body, err := json.Marshal(fc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/import?mode="+mode, bytes.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+		var result ImportResult
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	exportIDs := func() []string {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/export", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		IDs := make([]string, 0, len(fc.Features))
+		for _, feature := range fc.Features {
+			if _, ok := feature.Properties["_created_by"]; ok {
+				t.Errorf("exported feature %v has provenance properties", feature.ID)
+			}
+			IDs = append(IDs, feature.ID.(string))
+		}
+		slices.Sort(IDs)
+		return IDs
+	}
+
+	fc := geojson.NewFeatureCollection()
+	for i := 0; i < 10; i++ {
+		fc.Append(newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)))
+	}
+	fc.Append(newFeatureWithID(orb.Point{0, 0}, ""))
+	fc.Append(newFeatureWithID(orb.Point{500, 0}, "invalid-id"))
+
+	if result := importFeatures("", fc); result.Imported != 10 || result.Skipped != 2 || result.Deleted != 0 {
+		t.Errorf("import returned wrong counts: %+v", result)
+	}
+	if IDs := exportIDs(); len(IDs) != 10 {
+		t.Errorf("export returned %d features, want %d", len(IDs), 10)
+	}
+
+	fc = geojson.NewFeatureCollection()
+	for _, ID := range []string{"id-1", "id-2", "new-id"} {
+		fc.Append(newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, ID))
+	}
+	if result := importFeatures("replace", fc); result.Imported != 3 || result.Deleted != 8 {
+		t.Errorf("import returned wrong counts: %+v", result)
+	}
+	if IDs := exportIDs(); !slices.Equal(IDs, []string{"id-1", "id-2", "new-id"}) {
+		t.Errorf("export returned wrong features after replace: %v", IDs)
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test-1/import?mode=merge", strings.NewReader(`{"type":"FeatureCollection","features":[]}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestScatterGatherSelect(t *testing.T) {
+	mux := http.NewServeMux()
+
+	names := []string{"test-1", "test-2"}
+	storages := make([]*Storage, 0, len(names))
+	for _, name := range names {
+		storages = append(storages, mustNewStorage(t, mux, name, ReplicasAt(DefaultAddress), true, name+"-data", DefaultStorageConfig()))
+	}
+	nodes := [][]string{{"test-1"}, {"test-2"}, {"slow"}}
+	router := NewRouter(mux, nodes, nodes, http.Dir("../front/dist"), RandomBalance)
+	router.shardTimeout = 50 * time.Millisecond
+
+	// a shard which is alive but never answers in time
+	mux.HandleFunc("/slow/health", func(w http.ResponseWriter, _ *http.Request) {})
+	canceled := make(chan struct{}, 1)
+	mux.HandleFunc("/slow/select", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(10 * router.shardTimeout):
+		}
+	})
+
+	for _, storage := range storages {
+		go storage.Run()
+	}
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		for _, name := range names {
+			_ = os.RemoveAll(name + "-data")
+		}
+	})
+	t.Cleanup(router.Stop)
+	for _, storage := range storages {
+		t.Cleanup(storage.Stop)
+	}
+
+	// the duplicated feature is on both shards as if it is being moved
+	for _, name := range names {
+		for _, ID := range []string{"duplicated-id", name + "-id"} {
+			body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, ID).MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("POST", "/"+name+"/insert", bytes.NewReader(body)))
+			if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+				t.Fatalf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+			}
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/select?rect=0,0,1,1", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if !strings.Contains(rr.Header().Get("Warning"), "slow timed out") {
+		t.Errorf("missing partial results warning, got %q", rr.Header().Get("Warning"))
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * router.shardTimeout):
+		t.Error("request to the timed out shard is not canceled")
+	}
+
+	fc, err := geojson.UnmarshalFeatureCollection(rr.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.Features) != 3 {
+		t.Errorf("select returned %d features, want %d", len(fc.Features), 3)
+	}
+}
+
+func TestSelectRedirect(t *testing.T) {
+	tests := []struct {
+		name       string
+		redirects  RedirectConfig
+		wantCode   int
+		wantTarget string
+	}{
+		{
+			name:     "Under Limit",
+			wantCode: http.StatusOK,
+			redirects: RedirectConfig{
+				MaxConcurrentSelects: 1,
+				MaxRedirects:         DefaultMaxRedirects,
+				ChooseReplica:        RandomReplica,
+			},
+		},
+		{
+			name:       "Over Limit",
+			wantCode:   http.StatusTemporaryRedirect,
+			wantTarget: "/replica-2/select",
+			redirects: RedirectConfig{
+				MaxConcurrentSelects: 0,
+				MaxRedirects:         DefaultMaxRedirects,
+				ChooseReplica:        func(replicas []string) string { return replicas[len(replicas)-1] },
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+
+			config := DefaultStorageConfig()
+			config.Redirects = tt.redirects
+			storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress, "replica-1", "replica-2"), true, "test-data", config)
+			storage.initHandlers()
+			go storage.engine.Start()
+
+			t.Cleanup(func() {
+				_ = os.RemoveAll("test-data")
+			})
+			t.Cleanup(storage.Stop)
+
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select", nil))
+
+			if rr.Code != tt.wantCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.wantCode)
+			}
+			if location := rr.Header().Get("Location"); tt.wantTarget != "" && !strings.HasPrefix(location, tt.wantTarget) {
+				t.Errorf("handler redirected to wrong target: got %v want %v", location, tt.wantTarget)
+			}
+		})
+	}
+}
+
+func TestSelectRedirectTTL(t *testing.T) {
+	mux := http.NewServeMux()
+
+	// every select is redirected to the other node until the TTL runs out
+	config := DefaultStorageConfig()
+	config.Redirects = RedirectConfig{MaxConcurrentSelects: 0, MaxRedirects: 2, ChooseReplica: RandomReplica}
+	for _, names := range [][]string{{"test-1", "test-2"}, {"test-2", "test-1"}} {
+		storage := mustNewStorage(t, mux, names[0], ReplicasAt(DefaultAddress, names[1:]...), true, names[0]+"-data", config)
+		storage.initHandlers()
+		go storage.engine.Start()
+		t.Cleanup(func() {
+			_ = os.RemoveAll(storage.name + "-data")
+		})
+		t.Cleanup(storage.Stop)
+	}
+
+	target := "/test-1/select?rect=0,0,1,1"
+	wantTTLs := []string{"1", "0"}
+	for i := 0; ; i++ {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+
+		if i == len(wantTTLs) {
+			if rr.Code != http.StatusTooManyRequests {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTooManyRequests)
+			}
+			break
+		}
+		if rr.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTemporaryRedirect)
+		}
+
+		location, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl := location.Query().Get("ttl"); ttl != wantTTLs[i] {
+			t.Errorf("redirect %d has wrong TTL: got %q want %q", i, ttl, wantTTLs[i])
+		}
+		if rect := location.Query().Get("rect"); rect != "0,0,1,1" {
+			t.Errorf("redirect %d lost the query: got %q", i, location.RawQuery)
+		}
+		target = location.String()
+	}
+}
+
+func TestWALFormats(t *testing.T) {
+	txs := make([]*Transaction, 0)
+	for i := 1; i <= 3; i++ {
+		feature := newFeatureWithID(orb.Point{float64(i), float64(i)}, "id-"+strconv.Itoa(i))
+		feature.Properties["note"] = "line\nbreak"
+		txs = append(txs, &Transaction{Action: Upsert, Name: "test", Lsn: uint64(i), Feature: feature})
+	}
+
+	tests := []struct {
+		name    string
+		formats []WALFormat
+		cut     func(size int) int // the number of bytes of the last record lost on crash
+		wantTxs int
+	}{
+		{name: "Text", formats: []WALFormat{TextWAL, TextWAL, TextWAL}, wantTxs: 3},
+		{name: "Binary", formats: []WALFormat{BinaryWAL, BinaryWAL, BinaryWAL}, wantTxs: 3},
+		{name: "Text Continued By Binary", formats: []WALFormat{TextWAL, TextWAL, BinaryWAL}, wantTxs: 3},
+		{name: "Truncated Binary Payload", formats: []WALFormat{BinaryWAL, BinaryWAL, BinaryWAL}, cut: func(int) int { return 5 }, wantTxs: 2},
+		{name: "Truncated Binary Length", formats: []WALFormat{BinaryWAL, BinaryWAL, BinaryWAL}, cut: func(size int) int { return size - 2 }, wantTxs: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wal []byte
+			var lastSize int
+			for i, format := range tt.formats {
+				record, err := encodeWALRecord(format, txs[i])
+				if err != nil {
+					t.Fatal(err)
+				}
+				wal = append(wal, record...)
+				lastSize = len(record)
+			}
+			if tt.cut != nil {
+				wal = wal[:len(wal)-tt.cut(lastSize)]
+			}
+
+			got, err := readWALRecords(bytes.NewReader(wal))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.wantTxs {
+				t.Fatalf("read %d transactions, want %d", len(got), tt.wantTxs)
+			}
+			for i, tx := range got {
+				if tx.Lsn != txs[i].Lsn || tx.Feature.Properties["note"] != "line\nbreak" {
+					t.Errorf("transaction %d is read wrong: %+v", i, tx)
+				}
+			}
+		})
+	}
+}
+
+func TestWALSyncPolicy(t *testing.T) {
+	tests := []struct {
+		policy    WALSyncPolicy
+		wantSyncs func(syncs uint64) bool
+	}{
+		{policy: SyncNever, wantSyncs: func(syncs uint64) bool { return syncs == 0 }},
+		{policy: SyncEveryWrite, wantSyncs: func(syncs uint64) bool { return syncs == 3 }},
+		{policy: SyncInterval(50 * time.Millisecond), wantSyncs: func(syncs uint64) bool { return syncs >= 1 && syncs < 3 }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			t.Cleanup(func() {
+				_ = os.Remove("test.json")
+				_ = os.Remove("wal.txt")
+			})
+
+			metrics := NewMetrics()
+			engine := NewEngine("test", nil, ctx, EngineConfig{Durable: true, SnapshotFile: "test.json", WALFile: "wal.txt", WALSync: tt.policy, Metrics: metrics, CommandBuffer: DefaultCommandBuffer})
+			go engine.Start()
+
+			for i := 0; i < 3; i++ {
+				feature := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i))
+				if _, err := engine.ApplyTransaction(ctx, Upsert, feature, ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(150 * time.Millisecond) // a few group commits
+
+			if syncs := metrics.WALSyncs.Load(); !tt.wantSyncs(syncs) {
+				t.Errorf("WAL is synced %d times", syncs)
+			}
+			stats, err := engine.Stats(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.WALSync != tt.policy.String() {
+				t.Errorf("stats have WAL sync %q, want %q", stats.WALSync, tt.policy.String())
+			}
+		})
+	}
+}
+
+func TestSnapshotFormats(t *testing.T) {
+	feature := newFeatureWithID(orb.Point{1, 2}, "id")
+	feature.Properties["note"] = "kept"
+	features := map[string]*Feature{
+		"id":         {Name: "test-1", LSN: 5, Feature: feature, CreatedBy: "test-2", CreatedLSN: 3, IdempotencyKey: "key"},
+		"deleted-id": {Name: "test-1", LSN: 6, Feature: newFeatureWithID(orb.Point{3, 4}, "deleted-id"), Deleted: true},
+	}
+
+	vclock := map[string]uint64{"test-1": 7, "1/test-2": 3}
+
+	for _, format := range []SnapshotFormat{MapSnapshot, GeoJSONSnapshot} {
+		t.Run(format.String(), func(t *testing.T) {
+			data, err := encodeSnapshot(format, features, vclock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := geojson.UnmarshalFeatureCollection(data); (err == nil) != (format == GeoJSONSnapshot) {
+				t.Errorf("snapshot is readable as FeatureCollection: got %v want %v", err == nil, format == GeoJSONSnapshot)
+			}
+
+			got, gotVclock, err := decodeSnapshot(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(gotVclock, vclock) {
+				t.Errorf("decoded vclock %v, want %v", gotVclock, vclock)
+			}
+			if len(got) != len(features) {
+				t.Fatalf("decoded %d features, want %d", len(got), len(features))
+			}
+			for ID, want := range features {
+				f := got[ID]
+				if f.Name != want.Name || f.LSN != want.LSN || f.CreatedBy != want.CreatedBy || f.CreatedLSN != want.CreatedLSN ||
+					f.Deleted != want.Deleted || f.IdempotencyKey != want.IdempotencyKey || f.Feature.ID != ID {
+					t.Errorf("feature %s is decoded wrong: got %+v want %+v", ID, f, want)
+				}
+				if !maps.Equal(f.Feature.Properties, want.Feature.Properties) {
+					t.Errorf("feature %s has wrong properties: got %v want %v", ID, f.Feature.Properties, want.Feature.Properties)
+				}
+			}
+		})
+	}
+	if _, ok := feature.Properties["_lsn"]; ok {
+		t.Errorf("encoding modified the stored feature: %v", feature.Properties)
+	}
+
+	// the snapshots without the vclock are the bare features
+	legacy, err := json.Marshal(features)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, gotVclock, err := decodeSnapshot(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]uint64{"test-1": 6}; len(got) != len(features) || !maps.Equal(gotVclock, want) {
+		t.Errorf("decoded %d features with vclock %v, want %d with %v", len(got), gotVclock, len(features), want)
+	}
+}
+
+func TestSnapshotVclock(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile, walFile := filepath.Join(dir, SnapshotFileName), filepath.Join(dir, WALFileName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	engine := NewEngine("test", nil, ctx, EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, CommandBuffer: DefaultCommandBuffer})
+	go engine.Start()
+
+	for lsn := uint64(1); lsn <= 3; lsn++ {
+		tx := &Transaction{Action: Upsert, Name: "leader", Lsn: lsn, Feature: newFeatureWithID(orb.Point{1, 1}, "id")}
+		if err := engine.ApplyReplicated(context.Background(), "leader", tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lsn, err := engine.ApplyTransaction(context.Background(), Upsert, newFeatureWithID(orb.Point{2, 2}, "own"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the snapshot keeps a single feature of the leader and removes the WAL
+	if written, err := engine.MakeSnapshot(context.Background()); err != nil || !written {
+		t.Fatalf("snapshot is not written: %v", err)
+	}
+	cancel()
+
+	restarted := NewEngine("test", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, CommandBuffer: DefaultCommandBuffer})
+	go restarted.Start()
+
+	// the replica resends an old transaction
+	old := &Transaction{Action: Upsert, Name: "leader", Lsn: 2, Feature: newFeatureWithID(orb.Point{3, 3}, "old")}
+	if err := restarted.ApplyReplicated(context.Background(), "leader", old); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := restarted.Exists(context.Background(), "old"); err != nil || exists {
+		t.Errorf("already applied transaction is applied again after restart: %v", err)
+	}
+	if want := (map[string]uint64{"leader": 3, "test": lsn}); !maps.Equal(restarted.State().Vclock, want) {
+		t.Errorf("restored vclock %v, want %v", restarted.State().Vclock, want)
+	}
+
+	next, err := restarted.ApplyTransaction(context.Background(), Upsert, newFeatureWithID(orb.Point{4, 4}, "next"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != lsn+1 {
+		t.Errorf("got LSN %d after restart, want %d", next, lsn+1)
+	}
+}
+
+func TestSnapshotByWALSize(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile, walFile := filepath.Join(dir, SnapshotFileName), filepath.Join(dir, WALFileName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	metrics := NewMetrics()
+	engine := NewEngine("test", nil, ctx, EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, SnapshotWALBytes: 1000, Metrics: metrics, CommandBuffer: DefaultCommandBuffer})
+	go engine.Start()
+
+	upsert := func(i int) {
+		t.Helper()
+		feature := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i))
+		if _, err := engine.ApplyTransaction(ctx, Upsert, feature, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upsert(0)
+	if _, err := engine.Stats(ctx); err != nil { // the requested snapshot would be started by now
+		t.Fatal(err)
+	}
+	if snapshots := metrics.Snapshots.Load(); snapshots != 0 {
+		t.Fatalf("made %d snapshots of the small WAL", snapshots)
+	}
+
+	for i := 1; i < 50; i++ {
+		upsert(i)
+	}
+	deadline := time.Now().Add(time.Second)
+	for metrics.Snapshots.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if metrics.Snapshots.Load() == 0 {
+		t.Fatal("snapshot is not made by the WAL size")
+	}
+	if size := metrics.WALBytes.Load(); size >= 1000 {
+		t.Errorf("WAL has %d bytes after the snapshot", size)
+	}
+	cancel()
+
+	restarted := NewEngine("test", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, CommandBuffer: DefaultCommandBuffer})
+	go restarted.Start()
+	if data, err := restarted.GetAllData(context.Background()); err != nil || len(data) != 50 {
+		t.Errorf("restored %d features, want %d: %v", len(data), 50, err)
+	}
+}
+
+func TestSnapshotByWALSizeBackoff(t *testing.T) {
+	dir := t.TempDir()
+	// the snapshot can not be written under the regular file, the WAL can
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshotFile, walFile := filepath.Join(dir, "file", SnapshotFileName), filepath.Join(dir, WALFileName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	metrics := NewMetrics()
+	engine := NewEngine("test", nil, ctx, EngineConfig{Durable: true, SnapshotFile: snapshotFile, WALFile: walFile, SnapshotWALBytes: 1, Metrics: metrics, CommandBuffer: DefaultCommandBuffer})
+	go engine.Start()
+
+	upsert := func(i int) {
+		t.Helper()
+		feature := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i))
+		if _, err := engine.ApplyTransaction(ctx, Upsert, feature, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	upsert(0)
+	time.Sleep(100 * time.Millisecond) // the first snapshot fails
+
+	// every snapshot rotates the WAL, so the records are kept only while the snapshots wait
+	for i := 1; i <= 10; i++ {
+		upsert(i)
+	}
+	stats, err := engine.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.WALRecords != 10 || metrics.Snapshots.Load() != 0 {
+		t.Errorf("snapshot is retried after the failure: %d WAL records, %d snapshots", stats.WALRecords, metrics.Snapshots.Load())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	mux := http.NewServeMux()
+
+	config := DefaultStorageConfig()
+	config.Limits = RateLimitConfig{WriteRate: 0.1, WriteBurst: 5}
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", config)
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	insertFrom := func(client string, i int) *httptest.ResponseRecorder {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body))
+		req.RemoteAddr = client
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+
+	limited := 0
+	for i := 0; i < 20; i++ {
+		rr := insertFrom("192.0.2.1:1234", i)
+		switch {
+		case i < config.Limits.WriteBurst && rr.Code != http.StatusCreated:
+			t.Errorf("request %d within the burst returned %v, want %v", i, rr.Code, http.StatusCreated)
+		case i >= config.Limits.WriteBurst && rr.Code != http.StatusTooManyRequests:
+			t.Errorf("request %d over the burst returned %v, want %v", i, rr.Code, http.StatusTooManyRequests)
+		case rr.Code == http.StatusTooManyRequests:
+			limited++
+			if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "10" {
+				t.Errorf("Retry-After is %q, want %q", retryAfter, "10")
+			}
+		}
+	}
+	if limited != 15 {
+		t.Errorf("%d requests were limited, want %d", limited, 15)
+	}
+
+	// the other client and the reads are not limited
+	if rr := insertFrom("192.0.2.2:1234", 100); rr.Code != http.StatusCreated {
+		t.Errorf("other client got %v, want %v", rr.Code, http.StatusCreated)
+	}
+	for i := 0; i < 20; i++ {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", "/test/select", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("select returned %v, want %v", rr.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestInFlightLimit(t *testing.T) {
+	mux := http.NewServeMux()
+
+	config := DefaultStorageConfig()
+	config.Limits = RateLimitConfig{MaxInFlight: BulkWeight}
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", config)
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	insertID := func(i int) *httptest.ResponseRecorder {
+		body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)).MarshalJSON()
+		if err != nil {
+			t.Error(err)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+		return rr
+	}
+
+	// the single operation fits while the bulk one does not
+	if !storage.inFlight.TryAcquire(1) {
+		t.Fatal("failed to acquire the empty semaphore")
+	}
+	if rr := insertID(0); rr.Code != http.StatusCreated {
+		t.Errorf("insert returned %v, want %v", rr.Code, http.StatusCreated)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/import", strings.NewReader(`{"type":"FeatureCollection","features":[]}`)))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("import returned %v with Retry-After %q, want %v with %q", rr.Code, rr.Header().Get("Retry-After"), http.StatusServiceUnavailable, "1")
+	}
+
+	// the saturated node rejects the reads as well as the writes
+	if !storage.inFlight.TryAcquire(config.Limits.MaxInFlight - 1) {
+		t.Fatal("failed to acquire the rest of the semaphore")
+	}
+	if rr := insertID(1); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("insert returned %v, want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	for _, target := range []string{"/test/select", "/test/extent", "/test/history?id=id-0", "/test/export"} {
+		rr = httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s returned %v, want %v", target, rr.Code, http.StatusServiceUnavailable)
+		}
+	}
+	storage.inFlight.Release(config.Limits.MaxInFlight)
+
+	// under the flood the requests are either served or rejected at once, none waits for the engine timeout
+	const clients, requests = 64, 20
+	var mu sync.Mutex
+	var latencies []time.Duration
+	codes := make(map[int]int)
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				start := time.Now()
+				rr := insertID(1 + c*requests + i) // id-0 is inserted above
+				latency := time.Since(start)
+
+				mu.Lock()
+				latencies = append(latencies, latency)
+				codes[rr.Code]++
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if codes[http.StatusCreated]+codes[http.StatusServiceUnavailable] != clients*requests {
+		t.Errorf("got the status codes %v, want only %v and %v", codes, http.StatusCreated, http.StatusServiceUnavailable)
+	}
+	slices.Sort(latencies)
+	p99, worst := latencies[len(latencies)*99/100], latencies[len(latencies)-1]
+	t.Logf("served %d, rejected %d, p99 %v, max %v", codes[http.StatusCreated], codes[http.StatusServiceUnavailable], p99, worst)
+	if worst >= EngineTimeout {
+		t.Errorf("the slowest request took %v, want less than %v", worst, EngineTimeout)
+	}
+	if held := storage.inFlight.InFlight(); held != 0 {
+		t.Errorf("%d is held after the flood, want 0", held)
+	}
+}
+
+func TestEngineTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+
+	// the engine is not started, so it never takes the commands
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	storage.initHandlers()
+	t.Cleanup(storage.Stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := storage.engine.GetAllData(ctx); err != context.DeadlineExceeded {
+		t.Errorf("engine returned wrong error: got %v want %v", err, context.DeadlineExceeded)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{name: "Select", method: "GET", target: "/test/select"},
+		{name: "Extent", method: "GET", target: "/test/extent"},
+		{name: "Insert", method: "POST", target: "/test/insert", body: `{"type":"Feature","id":"new-id","geometry":{"type":"Point","coordinates":[0,0]},"properties":{}}`},
+		{name: "Snapshot", method: "POST", target: "/test/snapshot"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)).WithContext(ctx)
+			rr := httptest.NewRecorder()
+
+			mux.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusServiceUnavailable {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+func TestInsertDuringShutdown(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+
+	codes := make(chan int, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.Itoa(i)).MarshalJSON()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/insert", bytes.NewReader(body)))
+			codes <- rr.Code
+		}()
+		if i == cap(codes)/2 {
+			storage.Stop()
+		}
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusCreated && code != http.StatusServiceUnavailable {
+			t.Errorf("handler returned wrong status code: got %v want %v or %v", code, http.StatusCreated, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func TestMaxBody(t *testing.T) {
+	mux := http.NewServeMux()
+
+	config := DefaultStorageConfig()
+	config.Bodies = BodyLimits{MaxBody: 1024, MaxBulkBody: 64 * 1024}
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", config)
+
+	go storage.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+	t.Cleanup(storage.Stop)
+
+	feature := newFeatureWithID(orb.Point{0, 0}, "id")
+	feature.Properties["padding"] = strings.Repeat("x", 2048)
+	body, err := feature.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/test/insert", "/test/replace", "/test/delete", "/test/patch"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", target, bytes.NewReader(body)))
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s returned wrong status code: got %v want %v", target, rr.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	// the bulk endpoints take the larger bodies
+	fc := geojson.NewFeatureCollection().Append(feature)
+	body, err = fc.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/import", bytes.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Errorf("import returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// a huge body is not read to the end
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("POST", "/test/import", io.LimitReader(rand.New(rand.NewSource(1)), 1<<30)))
+	runtime.ReadMemStats(&after)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("import returned wrong status code: got %v want %v", rr.Code, http.StatusRequestEntityTooLarge)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("import of a huge body allocated %d bytes", allocated)
+	}
+}
+
+func TestRouterMaxBody(t *testing.T) {
+	mux := http.NewServeMux()
+
+	// the router reads the bodies to split them by the shards before any node is asked
+	router := NewRouter(mux, [][]string{{"test-1"}, {"test-2"}}, [][]string{{"test-1"}, {"test-2"}}, http.Dir("../front/dist"), RandomBalance)
+	router.SetBodyLimits(BodyLimits{MaxBody: 1024, MaxBulkBody: 64 * 1024})
+	go router.Run()
+	t.Cleanup(router.Stop)
+	time.Sleep(100 * time.Millisecond)
+
+	feature := newFeatureWithID(orb.Point{0, 0}, "id")
+	feature.Properties["padding"] = strings.Repeat("x", 2048)
+	body, err := feature.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/insert", "/replace", "/patch", "/move", "/select_polygon"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", target, bytes.NewReader(body)))
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s returned wrong status code: got %v want %v", target, rr.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+
+	for _, target := range []string{"/import", "/batch"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest("POST", target, io.LimitReader(rand.New(rand.NewSource(1)), 1<<20)))
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s returned wrong status code: got %v want %v", target, rr.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	checkOrigin := AllowOrigins("https://peer.example.com/")
+	tests := []struct {
+		origin string
+		local  bool
+		allow  bool
+	}{
+		{"", true, true},
+		{"http://localhost:8080", true, true},
+		{"http://127.0.0.1:3000", true, true},
+		{"http://[::1]", true, true},
+		{"http://storage.example.com", true, true}, // the same host
+		{"https://peer.example.com", false, true},
+		{"https://PEER.example.com", false, true},
+		{"http://peer.example.com", false, false},
+		{"https://evil.example.com", false, false},
+		{"://", false, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://storage.example.com/test/replication", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if got := LocalOrigin(r); got != test.local {
+			t.Errorf("LocalOrigin(%q) = %v, want %v", test.origin, got, test.local)
+		}
+		if got := checkOrigin(r); got != test.allow {
+			t.Errorf("AllowOrigins(%q) = %v, want %v", test.origin, got, test.allow)
+		}
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	go storage.Run()
+	t.Cleanup(func() {
+		storage.Stop()
+		_ = os.RemoveAll("test-data")
+	})
+
+	watchURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/test/watch"
+	_, resp, err := websocket.DefaultDialer.Dial(watchURL, http.Header{"Origin": {"https://evil.example.com"}})
+	if err != websocket.ErrBadHandshake || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("got %v for a foreign origin, want 403", err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(watchURL, http.Header{"Origin": {server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+func TestShutdownUnderLoad(t *testing.T) {
+	mux := http.NewServeMux()
+
+	storage := mustNewStorage(t, mux, "test", ReplicasAt(DefaultAddress), true, "test-data", DefaultStorageConfig())
+	router := NewRouter(mux, [][]string{{"test"}}, [][]string{{"test"}}, http.Dir("../front/dist"), RandomBalance)
+
+	go storage.Run()
+	go router.Run()
+	time.Sleep(100 * time.Millisecond)
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll("test-data")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	go func() { _ = server.Serve(listener) }()
+
+	var created atomic.Int64
+	var next atomic.Int64
+	codes := make(chan int, 10000)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				body, err := newFeatureWithID(orb.Point{rand.Float64(), rand.Float64()}, "id-"+strconv.FormatInt(next.Add(1), 10)).MarshalJSON()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp, err := http.Post("http://"+listener.Addr().String()+"/test/insert", "application/json", bytes.NewReader(body))
+				if err != nil {
+					return // the server does not accept the requests anymore
+				}
+				_ = resp.Body.Close()
+				if resp.StatusCode == http.StatusCreated {
+					created.Add(1)
+				}
+				codes <- resp.StatusCode
+			}
+		}()
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	shutdown([]*Storage{storage}, router, server, time.Second)
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusCreated {
+			t.Errorf("in-flight request got %v, want %v", code, http.StatusCreated)
+		}
+	}
+	if created.Load() == 0 {
+		t.Fatalf("no request succeeded before shutdown")
+	}
+
+	// every acknowledged write is in the WAL
+	file, err := os.Open(storage.engine.walFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	wal, err := readWALRecords(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(wal)) < created.Load() {
+		t.Errorf("WAL has %d records, %d writes were acknowledged", len(wal), created.Load())
+	}
+}
+
+func TestQueueDepth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	engine := NewEngine("test", nil, ctx, EngineConfig{Durable: true, SnapshotFile: "test.json", WALFile: "wal.txt", CommandBuffer: 4})
+
+	// the commands wait in the buffer while the engine is not started
+	for i := 0; i < 3; i++ {
+		go func() { _, _ = engine.Exists(ctx, "id") }()
+	}
+	deadline := time.Now().Add(time.Second)
+	for engine.QueueDepth() != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := engine.QueueDepth(); depth != 3 {
+		t.Fatalf("queue depth is %d, want %d", depth, 3)
+	}
+
+	go engine.Start()
+	deadline = time.Now().Add(time.Second)
+	for engine.QueueDepth() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth := engine.QueueDepth(); depth != 0 {
+		t.Errorf("queue depth is %d after the engine is started, want %d", depth, 0)
+	}
+}
+
+func BenchmarkCommandBuffer(b *testing.B) {
+	for _, buffer := range []int{0, 16, DefaultCommandBuffer, 1024} {
+		b.Run("buffer="+strconv.Itoa(buffer), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			engine := NewEngine("bench", nil, ctx, EngineConfig{Durable: true, SnapshotFile: "bench.json", WALFile: "bench-wal.txt", CommandBuffer: buffer})
+			go engine.Start()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := engine.Exists(ctx, "id"); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkScanThreshold finds the number of features the R-tree search overtakes the scan at,
+// DefaultScanThreshold is set from it
+func BenchmarkScanThreshold(b *testing.B) {
+	for _, features := range []int{1, 2, 4, 8, 16, 32, 64, 128, 256} {
+		for _, threshold := range []int{0, math.MaxInt} {
+			name := "rtree"
+			if threshold != 0 {
+				name = "scan"
+			}
+			b.Run(fmt.Sprintf("features=%d/%s", features, name), func(b *testing.B) {
+				engine := NewEngine("bench", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: "bench.json", WALFile: "bench-wal.txt", ScanThreshold: threshold, CommandBuffer: DefaultCommandBuffer})
+				for i := 0; i < features; i++ {
+					feature := newFeatureWithID(orb.Point{rand.Float64() * 10, rand.Float64() * 10}, "id-"+strconv.Itoa(i))
+					if _, err := engine.applyTransaction(&Transaction{Action: Upsert, Name: "bench", Lsn: uint64(i + 1), Feature: feature}); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					engine.searchRect([4]float64{2, 2, 4, 4})
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkFilteredSelect(b *testing.B) {
+	for _, keys := range [][]string{nil, {"category"}} {
+		b.Run("index="+strings.Join(keys, ","), func(b *testing.B) {
+			engine := NewEngine("bench", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: "bench.json", WALFile: "bench-wal.txt", CommandBuffer: DefaultCommandBuffer, IndexedProperties: keys})
+			for i := 0; i < 10000; i++ {
+				feature := newFeatureWithID(orb.Point{rand.Float64()*360 - 180, rand.Float64()*180 - 90}, "id-"+strconv.Itoa(i))
+				feature.Properties["category"] = "category-" + strconv.Itoa(i%100)
+				if _, err := engine.applyTransaction(&Transaction{Action: Upsert, Name: "bench", Lsn: uint64(i + 1), Feature: feature}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			where := map[string]string{"category": "category-42"}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if len(engine.getDataFiltered(nil, where)) != 100 {
+					b.Fatal("wrong number of features")
+				}
+			}
+		})
+	}
+}
+
+// vclockLag returns how many transactions of every origin the replica has not applied
+// compared to the reference clock, the origins the replica is up to date with are omitted
+func vclockLag(reference map[string]uint64, replica map[string]uint64) map[string]uint64 {
+	lag := make(map[string]uint64)
+	for origin, lsn := range reference {
+		if applied := replica[origin]; applied < lsn {
+			lag[origin] = lsn - applied
+		}
+	}
+	return lag
+}
+
+// fetchVclock reads the vclock of the node, the clocks of two nodes are compared by vclockLag
+func fetchVclock(t *testing.T, mux *http.ServeMux, name string) map[string]uint64 {
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/"+name+"/vclock", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var vclock map[string]uint64
+	if err := json.Unmarshal(rr.Body.Bytes(), &vclock); err != nil {
+		t.Fatal(err)
+	}
+	return vclock
+}
+
+func newFeatureWithID(geometry orb.Geometry, id string) *geojson.Feature {
+	feature := geojson.NewFeature(geometry)
+	feature.ID = id
+	return feature
+}
+
+func insert(t *testing.T, feature *geojson.Feature, mux *http.ServeMux, rr *httptest.ResponseRecorder) {
+	body, err := feature.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/insert", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code == http.StatusTemporaryRedirect {
+		req, err := http.NewRequest("POST", rr.Header().Get("location"), bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+			t.Errorf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+		}
+	} else if rr.Code != http.StatusOK && rr.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v or %v", rr.Code, http.StatusOK, http.StatusCreated)
+	}
+}
+
+// recordingHandler keeps the logged records for the assertions
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(_ context.Context, record slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, record.Clone())
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordingHandler) WithGroup(string) slog.Handler { return h }
+
+func TestAccessLog(t *testing.T) {
+	handler := &recordingHandler{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/created", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, "body")
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "chunk")
+		w.(http.Flusher).Flush()
+	})
+
+	logged := AccessLog(slog.New(handler), slog.LevelInfo, mux)
+	for _, path := range []string{"/created", "/stream", "/missing"} {
+		logged.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	want := []struct {
+		path   string
+		status int64
+		bytes  int64
+	}{
+		{"/created", http.StatusCreated, 4},
+		{"/stream", http.StatusOK, 5},
+		{"/missing", http.StatusNotFound, 19},
+	}
+	if len(handler.records) != len(want) {
+		t.Fatalf("got %d records, want %d", len(handler.records), len(want))
+	}
+	for i, record := range handler.records {
+		attrs := make(map[string]slog.Value)
+		record.Attrs(func(attr slog.Attr) bool {
+			attrs[attr.Key] = attr.Value
+			return true
+		})
+		if attrs["method"].String() != "GET" || attrs["path"].String() != want[i].path ||
+			attrs["status"].Int64() != want[i].status || attrs["bytes"].Int64() != want[i].bytes {
+			t.Errorf("got record %v, want %+v", attrs, want[i])
+		}
+		if _, ok := attrs["duration"]; !ok {
+			t.Errorf("record %v has no duration", attrs)
+		}
+	}
+
+	// the websocket upgrade hijacks the connection through the recorder
+	upgrader := newReplicationUpgrader(LocalOrigin)
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+			_ = conn.Close()
+		}
+	})
+	server := httptest.NewServer(logged)
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	server.Close()
+	handler.mu.Lock()
+	last := handler.records[len(handler.records)-1]
+	handler.mu.Unlock()
+	last.Attrs(func(attr slog.Attr) bool {
+		if attr.Key == "status" && attr.Value.Int64() != http.StatusSwitchingProtocols {
+			t.Errorf("upgrade is logged with status %v", attr.Value)
+		}
+		return true
+	})
+
+	// the requests below the level of the logger are not logged
+	quiet := AccessLog(slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelWarn})), slog.LevelInfo, mux)
+	rr := httptest.NewRecorder()
+	quiet.ServeHTTP(rr, httptest.NewRequest("GET", "/created", nil))
+	if rr.Code != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
+
+func TestLogAttributes(t *testing.T) {
+	handler := &recordingHandler{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(handler))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+
+	// the WAL is a directory, so it cannot be opened for writing
+	engine := NewEngine("test", nil, context.Background(), EngineConfig{Durable: true, SnapshotFile: "test.json", WALFile: t.TempDir(), CommandBuffer: DefaultCommandBuffer})
+	tx := Transaction{Action: Upsert, Name: "test", Lsn: 1, Feature: newFeatureWithID(orb.Point{0, 0}, "id")}
+	walErr := engine.saveTransactionsToWAL(&tx)
+	if !errors.Is(walErr, ErrWALWrite) {
+		t.Fatalf("WAL write to a directory: got %v want %v", walErr, ErrWALWrite)
+	}
+
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if len(handler.records) != 1 {
+		t.Fatalf("got %d log records, want 1", len(handler.records))
+	}
+
+	attrs := make(map[string]slog.Value)
+	handler.records[0].Attrs(func(attr slog.Attr) bool {
+		attrs[attr.Key] = attr.Value
+		return true
+	})
+	if _, ok := attrs["!BADKEY"]; ok {
+		t.Errorf("log record has a value without a key")
+	}
+	if got, ok := attrs["error"].Any().(error); !ok || !errors.Is(walErr, got) {
+		t.Errorf("log record has wrong error: got %v want the cause of %v", got, walErr)
+	}
+	if got := attrs["node"].String(); got != "test" {
+		t.Errorf("log record has wrong node: got %v want %v", got, "test")
+	}
+}
+
+func mustParseRect(t *testing.T, rect string) [4]float64 {
+	coordinates, err := parseRectParam(rect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return coordinates
+}
+
+func mustParseBound(t *testing.T, rect string) orb.Bound {
+	coordinates := mustParseRect(t, rect)
+	return orb.Bound{Min: orb.Point{coordinates[0], coordinates[1]}, Max: orb.Point{coordinates[2], coordinates[3]}}
+}
+
+func mustNewStorage(t testing.TB, mux *http.ServeMux, name string, replicas map[string]string, leader bool, dataDir string, config StorageConfig) *Storage {
+	storage, err := NewStorage(mux, name, replicas, leader, dataDir, config)
+	if err != nil {
+		t.Fatal(err)
 	}
+	return storage
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Metrics are the counters of a single storage node
+type Metrics struct {
+	Inserts   atomic.Uint64
+	Replaces  atomic.Uint64
+	Deletes   atomic.Uint64
+	Selects   atomic.Uint64
+	Snapshots atomic.Uint64
+	WALBytes  atomic.Int64
+	WALSyncs  atomic.Uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// writeMetric writes a single sample in the Prometheus text exposition format
+func writeMetric(w io.Writer, name string, kind string, help string, node string, value any) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{node=%q} %v\n", name, help, name, kind, name, node, value)
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/planar"
+)
+
+// intersectsPolygon reports whether the geometry shares at least one point with the polygon.
+//
+// Points must lie inside the polygon (or on its border). Lines and polygons match if
+// they intersect the polygon, so a polygon feature is returned both when it is
+// contained by the query polygon and when it only overlaps or contains it.
+func intersectsPolygon(geometry orb.Geometry, polygon orb.Polygon) bool {
+	switch g := geometry.(type) {
+	case orb.Point:
+		return planar.PolygonContains(polygon, g)
+	case orb.MultiPoint:
+		for _, point := range g {
+			if planar.PolygonContains(polygon, point) {
+				return true
+			}
+		}
+		return false
+	case orb.LineString:
+		return pathIntersectsPolygon(g, polygon)
+	case orb.MultiLineString:
+		for _, line := range g {
+			if pathIntersectsPolygon(line, polygon) {
+				return true
+			}
+		}
+		return false
+	case orb.Ring:
+		return polygonsIntersect(orb.Polygon{g}, polygon)
+	case orb.Polygon:
+		return polygonsIntersect(g, polygon)
+	case orb.MultiPolygon:
+		for _, p := range g {
+			if polygonsIntersect(p, polygon) {
+				return true
+			}
+		}
+		return false
+	case orb.Bound:
+		return polygonsIntersect(g.ToPolygon(), polygon)
+	case orb.Collection:
+		for _, child := range g {
+			if intersectsPolygon(child, polygon) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+func polygonsIntersect(a orb.Polygon, b orb.Polygon) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	for _, ring := range a {
+		if pathIntersectsPolygon(orb.LineString(ring), b) {
+			return true
+		}
+	}
+	// b may lie completely inside a without crossing its rings
+	return len(b[0]) > 0 && planar.PolygonContains(a, b[0][0])
+}
+
+func pathIntersectsPolygon(path orb.LineString, polygon orb.Polygon) bool {
+	for _, point := range path {
+		if planar.PolygonContains(polygon, point) {
+			return true
+		}
+	}
+	for i := 1; i < len(path); i++ {
+		for _, ring := range polygon {
+			for j := 1; j < len(ring); j++ {
+				if segmentsIntersect(path[i-1], path[i], ring[j-1], ring[j]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func segmentsIntersect(a1, a2, b1, b2 orb.Point) bool {
+	d1 := orientation(b1, b2, a1)
+	d2 := orientation(b1, b2, a2)
+	d3 := orientation(a1, a2, b1)
+	d4 := orientation(a1, a2, b2)
+
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && onSegment(b1, b2, a1)) || (d2 == 0 && onSegment(b1, b2, a2)) ||
+		(d3 == 0 && onSegment(a1, a2, b1)) || (d4 == 0 && onSegment(a1, a2, b2))
+}
+
+func orientation(a, b, c orb.Point) float64 {
+	return (b.X()-a.X())*(c.Y()-a.Y()) - (b.Y()-a.Y())*(c.X()-a.X())
+}
+
+// onSegment checks the collinear point p lies between a and b
+func onSegment(a, b, p orb.Point) bool {
+	return min(a.X(), b.X()) <= p.X() && p.X() <= max(a.X(), b.X()) &&
+		min(a.Y(), b.Y()) <= p.Y() && p.Y() <= max(a.Y(), b.Y())
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxRateLimitClients bounds the number of tracked clients, the idle ones are forgotten beyond it
+	MaxRateLimitClients = 10000
+
+	// DefaultMaxInFlight is the weight of the engine operations a node serves at once
+	DefaultMaxInFlight int64 = 256
+
+	// BulkWeight is the share of the in-flight limit taken by the import, the batch, the restore,
+	// the truncate and the export, they hold the engine much longer than a single feature
+	BulkWeight int64 = 8
+)
+
+// RateLimitConfig is the token bucket of every client, the zero rate disables the limit,
+// and the limit of the engine operations of all the clients, the zero MaxInFlight disables it
+type RateLimitConfig struct {
+	WriteRate   float64 // requests per second
+	WriteBurst  int
+	ReadRate    float64
+	ReadBurst   int
+	MaxInFlight int64 // total weight of the reads and the writes in flight, the next ones are rejected with 503
+}
+
+// RateLimiter is a token bucket per client
+type RateLimiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter returns nil for the zero rate, the nil limiter allows everything
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token of the client, it returns the time until the next token if there are none
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	bucket, ok := l.buckets[client]
+	if !ok {
+		l.forgetIdle(now)
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[client] = bucket
+	}
+
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// forgetIdle drops the buckets which have been refilled, they are recreated full anyway
+func (l *RateLimiter) forgetIdle(now time.Time) {
+	if len(l.buckets) < MaxRateLimitClients {
+		return
+	}
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// withRateLimit responds with 429 and Retry-After to the client which has run out of tokens
+func withRateLimit(limiter *RateLimiter, handler http.HandlerFunc) http.HandlerFunc {
+	if limiter == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := limiter.Allow(clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Semaphore bounds the total weight of the in-flight operations without queueing them,
+// the engine would otherwise take an unbounded backlog through its command channel
+type Semaphore struct {
+	size int64
+	mu   sync.Mutex
+	cur  int64
+}
+
+// NewSemaphore returns nil for the zero size, the nil semaphore acquires everything
+func NewSemaphore(size int64) *Semaphore {
+	if size <= 0 {
+		return nil
+	}
+	return &Semaphore{size: size}
+}
+
+// TryAcquire takes the weight if it fits, the weight over the size is taken as the whole semaphore
+func (s *Semaphore) TryAcquire(weight int64) bool {
+	if s == nil {
+		return true
+	}
+	weight = min(weight, s.size)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur+weight > s.size {
+		return false
+	}
+	s.cur += weight
+	return true
+}
+
+func (s *Semaphore) Release(weight int64) {
+	if s == nil {
+		return
+	}
+	weight = min(weight, s.size)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur < weight {
+		panic("semaphore: released more than held")
+	}
+	s.cur -= weight
+}
+
+// InFlight is the weight held now
+func (s *Semaphore) InFlight() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cur
+}
+
+// withInFlightLimit responds with 503 and Retry-After while the node is saturated
+// instead of letting the request wait for the engine behind the others
+func withInFlightLimit(semaphore *Semaphore, weight int64, handler http.HandlerFunc) http.HandlerFunc {
+	if semaphore == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !semaphore.TryAcquire(weight) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "Too many requests in flight")
+			return
+		}
+		defer semaphore.Release(weight)
+		handler(w, r)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
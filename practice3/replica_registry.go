@@ -1,46 +1,321 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
 	"github.com/gorilla/websocket"
 	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
+)
+
+// DefaultReplicationCompressionLevel is the flate level of the replication messages,
+// the compression is used only if both nodes negotiate it
+const DefaultReplicationCompressionLevel = flate.BestSpeed
+
+// ReplicaQueueSize is the number of batches buffered for a replica,
+// the replica is dropped when it falls further behind
+const ReplicaQueueSize = 1024
+
+// the transactions accumulated within ReplicationBatchDelay are sent as a single message
+const (
+	ReplicationBatchSize  = 256
+	ReplicationBatchDelay = 5 * time.Millisecond
 )
 
 type ReplicaRegistry struct {
 	name        string
 	mu          sync.Mutex
-	connections map[string]*websocket.Conn
+	connections map[string]*replicaConn
+}
+
+// replicaConn is the connection to a replica written by its own goroutine,
+// so a slow replica does not block the others
+type replicaConn struct {
+	conn  *websocket.Conn
+	queue chan []*Transaction
+	done  chan struct{}
+}
+
+// LocalOrigin accepts the websocket connections from the same host and localhost only,
+// the nodes dial each other without the Origin header, the replication handler checks them by checkPeer
+func LocalOrigin(r *http.Request) bool {
+	header := r.Header.Get("Origin")
+	if header == "" {
+		return true
+	}
+	origin, err := url.Parse(header)
+	if err != nil {
+		return false
+	}
+	host := origin.Hostname()
+	return strings.EqualFold(origin.Host, r.Host) || host == "localhost" || net.ParseIP(host).IsLoopback()
+}
+
+// AllowOrigins accepts the websocket connections from the given origins,
+// e.g. https://example.com, in addition to the ones accepted by LocalOrigin
+func AllowOrigins(origins ...string) func(r *http.Request) bool {
+	allowed := make(map[string]bool, len(origins))
+	for _, origin := range origins {
+		allowed[strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))] = true
+	}
+	return func(r *http.Request) bool {
+		return allowed[strings.ToLower(r.Header.Get("Origin"))] || LocalOrigin(r)
+	}
+}
+
+func newReplicationUpgrader(checkOrigin func(r *http.Request) bool) websocket.Upgrader {
+	return websocket.Upgrader{
+		CheckOrigin:       checkOrigin,
+		EnableCompression: true,
+	}
+}
+
+func newReplicationDialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	return &dialer
+}
+
+// setCompressionLevel is a noop if the compression was not negotiated
+func setCompressionLevel(conn *websocket.Conn, level int) {
+	if err := conn.SetCompressionLevel(level); err != nil {
+		slog.Error("Failed to set replication compression level", "level", level, "error", err)
+	}
 }
 
 func NewReplicaRegistry(name string) *ReplicaRegistry {
 	return &ReplicaRegistry{
 		name:        name,
-		connections: make(map[string]*websocket.Conn),
+		connections: make(map[string]*replicaConn),
 	}
 }
 
-func (r *ReplicaRegistry) Add(name string, conn *websocket.Conn) {
+// Add registers the connection replacing the previous one of the replica, the returned replicaConn
+// is passed to removeConn when the connection is done
+func (r *ReplicaRegistry) Add(name string, conn *websocket.Conn) *replicaConn {
+	replica := &replicaConn{
+		conn:  conn,
+		queue: make(chan []*Transaction, ReplicaQueueSize),
+		done:  make(chan struct{}),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.connections[name]; ok {
+		old.close()
+	}
+	r.connections[name] = replica
+	go r.writeLoop(name, replica)
+	return replica
+}
+
+func (r *ReplicaRegistry) Has(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.connections[name]
+	return ok
+}
+
+func (r *ReplicaRegistry) Len() int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.connections[name] = conn
+	return len(r.connections)
 }
 
 func (r *ReplicaRegistry) Remove(name string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	delete(r.connections, name)
+	if replica, ok := r.connections[name]; ok {
+		replica.close()
+		delete(r.connections, name)
+	}
+}
+
+// removeConn removes the replica only if it has not been replaced by a new connection
+func (r *ReplicaRegistry) removeConn(name string, replica *replicaConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.connections[name] == replica {
+		replica.close()
+		delete(r.connections, name)
+	}
+}
+
+func (r *ReplicaRegistry) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, replica := range r.connections {
+		replica.close()
+		delete(r.connections, name)
+	}
 }
 
-func (r *ReplicaRegistry) Broadcast(tx *Transaction) {
-	if tx.Name != r.name {
+// Broadcast enqueues the transaction made on this node to every replica without blocking
+func (r *ReplicaRegistry) Broadcast(txs ...*Transaction) {
+	own := r.own(txs)
+	if len(own) == 0 {
 		return
 	}
+
+	for name, replica := range r.snapshot() {
+		r.enqueue(name, replica, own)
+	}
+}
+
+// Send enqueues the transactions made on this node to a single replica,
+// it is used to re-sync the whole state to a reconnected replica.
+// It returns the number of the enqueued transactions, 0 if the replica is not connected
+func (r *ReplicaRegistry) Send(name string, txs []*Transaction) int {
+	return r.sendTo(name, r.own(txs))
+}
+
+// SendAll enqueues the transactions of every node to a single replica,
+// it is used to re-sync the state in the gossip mode
+func (r *ReplicaRegistry) SendAll(name string, txs []*Transaction) int {
+	return r.sendTo(name, txs)
+}
+
+// Forward enqueues the transactions received from a replica to every other replica
+// except their origins, the replicas drop the transactions they have already applied
+func (r *ReplicaRegistry) Forward(from string, txs ...*Transaction) {
+	for name, replica := range r.snapshot() {
+		if name == from {
+			continue
+		}
+		forwarded := make([]*Transaction, 0, len(txs))
+		for _, tx := range txs {
+			if tx.Name != name {
+				forwarded = append(forwarded, tx)
+			}
+		}
+		if len(forwarded) > 0 {
+			r.enqueue(name, replica, forwarded)
+		}
+	}
+}
+
+func (r *ReplicaRegistry) sendTo(name string, txs []*Transaction) int {
+	if len(txs) == 0 {
+		return 0
+	}
+
+	r.mu.Lock()
+	replica, ok := r.connections[name]
+	r.mu.Unlock()
+	if !ok {
+		return 0
+	}
+	r.enqueue(name, replica, txs)
+	return len(txs)
+}
+
+func (r *ReplicaRegistry) own(txs []*Transaction) []*Transaction {
+	own := make([]*Transaction, 0, len(txs))
+	for _, tx := range txs {
+		if tx.Name == r.name {
+			own = append(own, tx)
+		}
+	}
+	return own
+}
+
+// snapshot returns the current connections, so the registry is not locked while they are written
+func (r *ReplicaRegistry) snapshot() map[string]*replicaConn {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	for replica, conn := range r.connections {
-		if err := conn.WriteJSON(tx); err != nil {
-			slog.Error("Error broadcasting to "+replica, err)
-			go r.Remove(replica)
+	return maps.Clone(r.connections)
+}
+
+// enqueue drops the replica whose queue is full, it gets the whole state after reconnection,
+// the batch enqueued to a concurrently removed replica is never written
+func (r *ReplicaRegistry) enqueue(name string, replica *replicaConn, txs []*Transaction) {
+	select {
+	case replica.queue <- txs:
+	default:
+		slog.Warn("Replication queue overflow, dropping replica", "node", r.name, "replica", name)
+		r.removeConn(name, replica)
+	}
+}
+
+func (r *ReplicaRegistry) writeLoop(name string, replica *replicaConn) {
+	for {
+		select {
+		case <-replica.done:
+			return
+		case txs := <-replica.queue:
+			batch, ok := coalesce(replica, txs)
+			if !ok {
+				return
+			}
+			for len(batch) > 0 {
+				size := min(len(batch), ReplicationBatchSize)
+				for size < len(batch) && sameBatch(batch[size-1], batch[size]) {
+					size++ // the replica applies every message at once, so it never sees a part of a batch
+				}
+				if err := replica.conn.WriteJSON(batch[:size]); err != nil {
+					slog.Error("Error broadcasting to "+name, "error", err)
+					r.removeConn(name, replica)
+					return
+				}
+				batch = batch[size:]
+			}
+		}
+	}
+}
+
+// coalesce appends the transactions enqueued within ReplicationBatchDelay until the batch is full,
+// it returns false if the replica is closed meanwhile
+func coalesce(replica *replicaConn, batch []*Transaction) ([]*Transaction, bool) {
+	timer := time.NewTimer(ReplicationBatchDelay)
+	defer timer.Stop()
+	for len(batch) < ReplicationBatchSize {
+		select {
+		case <-replica.done:
+			return nil, false
+		case txs := <-replica.queue:
+			batch = append(batch, txs...)
+		case <-timer.C:
+			return batch, true
 		}
 	}
+	return batch, true
+}
+
+// decodeReplicationMessage accepts both a batch and a single transaction
+func decodeReplicationMessage(message []byte) ([]Transaction, error) {
+	message = bytes.TrimSpace(message)
+	if len(message) > 0 && message[0] == '[' {
+		var txs []Transaction
+		err := json.Unmarshal(message, &txs)
+		return txs, err
+	}
+	var tx Transaction
+	if err := json.Unmarshal(message, &tx); err != nil {
+		return nil, err
+	}
+	return []Transaction{tx}, nil
+}
+
+// Heartbeat pings every replica, WriteControl may be called concurrently with the writer goroutine
+func (r *ReplicaRegistry) Heartbeat(payload string) {
+	deadline := time.Now().Add(HeartbeatInterval)
+	for name, replica := range r.snapshot() {
+		if err := replica.conn.WriteControl(websocket.PingMessage, []byte(payload), deadline); err != nil {
+			slog.Error("Error sending heartbeat to "+name, "error", err)
+			r.removeConn(name, replica)
+		}
+	}
+}
+
+// close must be called once under r.mu
+func (c *replicaConn) close() {
+	close(c.done)
+	_ = c.conn.Close()
 }
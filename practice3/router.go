@@ -1,69 +1,861 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/paulmach/orb/geojson"
+	"io"
 	"log/slog"
+	"maps"
 	"math/rand/v2"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	HealthCheckInterval = 200 * time.Millisecond
+	ShardQueryTimeout   = 2 * time.Second
+	MaxShardQueries     = 4
+
+	// ServedByHeader names the nodes which handled the request, a node per shard for scatter-gather
+	ServedByHeader = "X-Served-By"
+	// ShardHeader is the shard the router has chosen or the shards which contributed to the result
+	ShardHeader = "X-Shard"
+	// LeaderHeader is the leader of the shard as the node knows it, the clients may write to it directly
+	LeaderHeader = "X-Leader"
+)
+
+// RouteMode is how the router passes a request to the chosen node
+type RouteMode int
+
+const (
+	// RedirectMode responds with 307 to the path of the node, the client repeats the request there
+	RedirectMode RouteMode = iota
+	// ProxyMode forwards the request to the node and streams its response back to the client
+	ProxyMode
 )
 
 type Router struct {
-	mux      *http.ServeMux
-	nodes    [][]string
-	leaders  [][]string
-	frontDir string
+	mux          *http.ServeMux
+	front        http.FileSystem
+	ctx          context.Context
+	cancel       context.CancelFunc
+	shardTimeout time.Duration
+	mu           sync.RWMutex
+	topology     *Topology
+	healthy      map[string]bool
+	leading      map[string]bool // the nodes which reported themselves as the leaders by the last check
+	balancer     balancer
+
+	// configFile is the topology reloaded on SIGHUP, empty if the topology is fixed
+	configFile string
+
+	// modes are the routes which are not redirected, they are set before Run
+	modes map[string]RouteMode
+	// bodies limit the request bodies the router reads to find the shards, they are set before Run
+	bodies BodyLimits
+}
+
+// NewRouter serves the front-end from the file system, see FrontFS
+func NewRouter(mux *http.ServeMux, nodes [][]string, leaders [][]string, front http.FileSystem, strategy BalanceStrategy) *Router {
+	ctx, cancel := context.WithCancel(context.Background())
+	topology := NewTopology(nodes, leaders)
+	healthy := make(map[string]bool)
+	for _, node := range topology.allNodes() {
+		healthy[node] = true // every node is considered healthy until the first check
+	}
+	return &Router{
+		mux:          mux,
+		front:        front,
+		ctx:          ctx,
+		cancel:       cancel,
+		shardTimeout: ShardQueryTimeout,
+		topology:     topology,
+		healthy:      healthy,
+		leading:      make(map[string]bool),
+		balancer:     newBalancer(strategy),
+		modes:        make(map[string]RouteMode),
+		bodies:       DefaultBodyLimits(),
+	}
+}
+
+// NewRouterFromConfig loads the topology from the config file and reloads it on SIGHUP
+func NewRouterFromConfig(mux *http.ServeMux, configFile string, front http.FileSystem, strategy BalanceStrategy) (*Router, error) {
+	topology, err := LoadTopology(configFile)
+	if err != nil {
+		return nil, err
+	}
+	router := NewRouter(mux, topology.Nodes, topology.Leaders, front, strategy)
+	router.configFile = configFile
+	return router, nil
+}
+
+// SetMode makes the routes, e.g. /insert, pass the requests to the nodes in the mode,
+// every route is redirected by default. It must be called before Run
+func (r *Router) SetMode(mode RouteMode, routes ...string) {
+	for _, route := range routes {
+		r.modes[route] = mode
+	}
 }
 
-func NewRouter(mux *http.ServeMux, nodes [][]string, leaders [][]string, frontDir string) *Router {
-	return &Router{mux, nodes, leaders, frontDir}
+// SetBodyLimits makes the router reject the larger bodies with 413 like the nodes do, the bodies
+// read to split the request by the shards are buffered. It must be called before Run
+func (r *Router) SetBodyLimits(limits BodyLimits) {
+	r.bodies = limits
 }
 
 func (r *Router) Run() {
 	r.initHandlers()
+	go r.healthCheckLoop()
+	if r.configFile != "" {
+		go r.reloadLoop()
+	}
 }
 
-func (r *Router) Stop() {}
+func (r *Router) Stop() {
+	r.cancel()
+}
 
 func (r *Router) initHandlers() {
-	r.mux.Handle("/", http.FileServer(http.Dir(r.frontDir)))
+	r.mux.Handle("/", http.FileServer(r.front))
+
+	// any replica of every shard can return the data
+	r.mux.HandleFunc("/select", withMaxBody(r.bodies.MaxBody, r.selectHandler("/select")))
+	r.mux.HandleFunc("/select_polygon", withMaxBody(r.bodies.MaxBody, r.selectHandler("/select_polygon")))
+	r.mux.HandleFunc("/within", withMaxBody(r.bodies.MaxBody, r.selectHandler("/within")))
+	r.mux.HandleFunc("/extent", r.extentHandler)
+	r.mux.HandleFunc("/export", withMaxBody(r.bodies.MaxBody, r.selectHandler("/export")))
 
-	// any replica can return the data
-	r.mux.HandleFunc("/select", func(w http.ResponseWriter, req *http.Request) {
-		r.redirectWithQuery(w, req, "/"+r.chooseReplica()+"/select")
-	})
+	// the changes are streamed by any replica of the single shard
+	r.mux.HandleFunc("/subscribe", r.subscribeHandler)
 
-	// only leader can modify the data
-	r.mux.Handle("/insert", http.RedirectHandler("/"+r.chooseLeader()+"/insert", http.StatusTemporaryRedirect))
-	r.mux.Handle("/replace", http.RedirectHandler("/"+r.chooseLeader()+"/replace", http.StatusTemporaryRedirect))
-	r.mux.Handle("/delete", http.RedirectHandler("/"+r.chooseLeader()+"/delete", http.StatusTemporaryRedirect))
+	// the leader of the shard owning the feature has its latest versions
+	r.mux.HandleFunc("/history", withMaxBody(r.bodies.MaxBody, r.leaderHandler("/history")))
+	r.mux.HandleFunc("/feature", withMaxBody(r.bodies.MaxBody, r.leaderHandler("/feature")))
+
+	// only leader of the shard owning the feature can modify the data
+	r.mux.HandleFunc("/insert", withMaxBody(r.bodies.MaxBody, r.leaderHandler("/insert")))
+	r.mux.HandleFunc("/replace", withMaxBody(r.bodies.MaxBody, r.leaderHandler("/replace")))
+	r.mux.HandleFunc("/delete", withMaxBody(r.bodies.MaxBody, r.leaderHandler("/delete")))
+	r.mux.HandleFunc("/patch", withMaxBody(r.bodies.MaxBody, r.leaderHandler("/patch")))
+	r.mux.HandleFunc("/move", withMaxBody(r.bodies.MaxBody, r.leaderHandler("/move")))
+	r.mux.HandleFunc("/import", withMaxBody(r.bodies.MaxBulkBody, r.importHandler))
+	r.mux.HandleFunc("/batch", withMaxBody(r.bodies.MaxBulkBody, r.batchHandler))
+	r.mux.HandleFunc("/truncate", r.truncateHandler)
+
+	// any node validates the features without touching the data
+	r.mux.HandleFunc("/validate", r.validateHandler)
 
 	// all replicas should make a snapshot
 	r.mux.HandleFunc("/snapshot", r.snapshotHandler)
 }
 
-func (r *Router) redirectWithQuery(w http.ResponseWriter, req *http.Request, target string) {
+// leaderHandler chooses a healthy leader of the shard owning the feature on every request,
+// so the writes follow the leader changes. The redirect is 307, the client repeats the same
+// method with the same body at the leader, the body read to find the shard is not consumed
+func (r *Router) leaderHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		t := r.current()
+		shard := 0
+		if len(t.Nodes) > 1 {
+			ID, err := readFeatureID(req, idParamRoutes[path])
+			if err != nil {
+				writeError(w, bodyErrorStatus(err), err.Error())
+				return
+			}
+			shard = t.ring.Owner(ID)
+		}
+
+		leader, ok := r.chooseLeader(t, shard)
+		if !ok {
+			writeError(w, http.StatusServiceUnavailable, "No healthy leaders")
+			return
+		}
+		r.forward(w, req, shard, leader, path)
+	}
+}
+
+func (r *Router) selectHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		t := r.current()
+		if len(t.Nodes) == 1 {
+			replica, ok := r.chooseReplica(t, 0)
+			if !ok {
+				writeError(w, http.StatusServiceUnavailable, "No healthy replicas")
+				return
+			}
+			r.forward(w, req, 0, replica, path)
+			return
+		}
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, bodyErrorStatus(err), err.Error())
+			return
+		}
+
+		query := req.URL.Query()
+		query.Del("format") // the shards always respond with a FeatureCollection to be merged
+		fc, failed, served := r.gatherShards(t, req, path, query.Encode(), body)
+		if len(failed) == len(t.Nodes) {
+			writeError(w, http.StatusBadGateway, "Failed to select from all shards: "+strings.Join(failed, "; "))
+			return
+		}
+		served.setHeaders(w)
+		if len(failed) > 0 {
+			w.Header().Set("Warning", fmt.Sprintf("199 - %q", "partial results: "+strings.Join(failed, "; ")))
+		}
+		if path == "/within" {
+			sortByDistance(fc.Features) // every shard is sorted on its own
+		} else if path == "/select" && wantsSorted(req) {
+			sortByID(fc.Features)
+		}
+
+		writeFeatures(w, req, fc.Features)
+	}
+}
+
+// importHandler splits the collection by the shards owning the features
+// and sums the results of their leaders
+func (r *Router) importHandler(w http.ResponseWriter, req *http.Request) {
+	t := r.current()
+	if len(t.Nodes) == 1 {
+		leader, ok := r.chooseLeader(t, 0)
+		if !ok {
+			writeError(w, http.StatusServiceUnavailable, "No healthy leaders")
+			return
+		}
+		r.forward(w, req, 0, leader, "/import")
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var total ImportResult
+	served := make(servedBy)
+	shards := make([]*geojson.FeatureCollection, len(t.Nodes))
+	for shard := range shards {
+		shards[shard] = geojson.NewFeatureCollection()
+	}
+	for _, feature := range fc.Features {
+		ID, ok := feature.ID.(string)
+		if !ok || ID == "" {
+			total.Skipped++
+			continue
+		}
+		shard := t.ring.Owner(ID)
+		shards[shard].Append(feature)
+	}
+
+	for shard, shardFC := range shards {
+		leader, ok := r.chooseLeader(t, shard)
+		if !ok {
+			writeError(w, http.StatusServiceUnavailable, "No healthy leaders in shard "+strconv.Itoa(shard))
+			return
+		}
+		data, err := json.Marshal(shardFC)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		target := &url.URL{Path: "/" + leader + "/import", RawQuery: req.URL.RawQuery}
+		rr, err := r.serve(req, http.MethodPost, target.String(), data)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("Failed to import to %s: %v", leader, err))
+			return
+		}
+		var result ImportResult
+		if rr.code != http.StatusOK || json.Unmarshal(rr.body.Bytes(), &result) != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("Failed to import to %s: %s", leader, strings.TrimSpace(rr.body.String())))
+			return
+		}
+		served[shard] = rr.Header().Get(ServedByHeader)
+		total.Imported += result.Imported
+		total.Skipped += result.Skipped
+		total.Deleted += result.Deleted
+	}
+
+	data, err := json.Marshal(total)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	served.setHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(data); err != nil {
+		slog.Error("Failed to respond with import result", "error", err)
+	}
+}
+
+// batchHandler redirects the batch to the leader of the shard owning all of its features,
+// the batch spanning the shards is rejected since it could not be applied as a single group
+func (r *Router) batchHandler(w http.ResponseWriter, req *http.Request) {
+	t := r.current()
+	shard := 0
+	if len(t.Nodes) > 1 {
+		body, err := readBody(req)
+		if err != nil {
+			writeError(w, bodyErrorStatus(err), err.Error())
+			return
+		}
+		var ops []struct {
+			Feature struct {
+				ID any `json:"id"`
+			} `json:"feature"`
+		}
+		if err := json.Unmarshal(body, &ops); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		shards := make(map[int]bool)
+		for _, op := range ops {
+			ID, ok := op.Feature.ID.(string)
+			if !ok {
+				writeError(w, http.StatusBadRequest, "Field ID must be a string")
+				return
+			}
+			shard = t.ring.Owner(ID)
+			shards[shard] = true
+		}
+		if len(shards) > 1 {
+			writeError(w, http.StatusBadRequest, "Batch must not span the shards")
+			return
+		}
+	}
+
+	leader, ok := r.chooseLeader(t, shard)
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "No healthy leaders")
+		return
+	}
+	r.forward(w, req, shard, leader, "/batch")
+}
+
+func (r *Router) validateHandler(w http.ResponseWriter, req *http.Request) {
+	t := r.current()
+	shard := rand.IntN(len(t.Nodes))
+	replica, ok := r.chooseReplica(t, shard)
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "No healthy replicas")
+		return
+	}
+	r.forward(w, req, shard, replica, "/validate")
+}
+
+func (r *Router) subscribeHandler(w http.ResponseWriter, req *http.Request) {
+	t := r.current()
+	if len(t.Nodes) > 1 {
+		writeError(w, http.StatusNotImplemented, "Subscribe to a replica of every shard")
+		return
+	}
+	replica, ok := r.chooseReplica(t, 0)
+	if !ok {
+		writeError(w, http.StatusServiceUnavailable, "No healthy replicas")
+		return
+	}
+	r.forward(w, req, 0, replica, "/subscribe")
+}
+
+// truncateHandler truncates every shard at its leader, the shards truncated before a failed one stay empty
+func (r *Router) truncateHandler(w http.ResponseWriter, req *http.Request) {
+	t := r.current()
+	if len(t.Nodes) == 1 {
+		leader, ok := r.chooseLeader(t, 0)
+		if !ok {
+			writeError(w, http.StatusServiceUnavailable, "No healthy leaders")
+			return
+		}
+		r.forward(w, req, 0, leader, "/truncate")
+		return
+	}
+
+	served := make(servedBy)
+	for shard := range t.Nodes {
+		leader, ok := r.chooseLeader(t, shard)
+		if !ok {
+			writeError(w, http.StatusServiceUnavailable, "No healthy leaders in shard "+strconv.Itoa(shard))
+			return
+		}
+		rr, err := r.serve(req, req.Method, "/"+leader+"/truncate", nil)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("Failed to truncate %s: %v", leader, err))
+			return
+		}
+		if rr.code != http.StatusOK {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("Failed to truncate %s: %s", leader, strings.TrimSpace(rr.body.String())))
+			return
+		}
+		served[shard] = rr.Header().Get(ServedByHeader)
+	}
+
+	served.setHeaders(w)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *Router) extentHandler(w http.ResponseWriter, req *http.Request) {
+	t := r.current()
+	if len(t.Nodes) == 1 {
+		replica, ok := r.chooseReplica(t, 0)
+		if !ok {
+			writeError(w, http.StatusServiceUnavailable, "No healthy replicas")
+			return
+		}
+		r.forward(w, req, 0, replica, "/extent")
+		return
+	}
+
+	var merged *Extent
+	served := make(servedBy)
+	for shard := range t.Nodes {
+		replica, ok := r.chooseReplica(t, shard)
+		if !ok {
+			writeError(w, http.StatusServiceUnavailable, "No healthy replicas in shard "+strconv.Itoa(shard))
+			return
+		}
+
+		done := r.balancer.track(replica)
+		rr, err := r.serve(req, http.MethodGet, "/"+replica+"/extent", nil)
+		done()
+		if err != nil {
+			writeError(w, http.StatusBadGateway, "Failed to get extent from "+replica+": "+err.Error())
+			return
+		}
+		served[shard] = rr.Header().Get(ServedByHeader)
+		if rr.code == http.StatusNoContent {
+			continue // the shard is empty
+		}
+		var extent Extent
+		if rr.code != http.StatusOK || json.Unmarshal(rr.body.Bytes(), &extent) != nil {
+			writeError(w, http.StatusBadGateway, "Failed to get extent from "+replica)
+			return
+		}
+
+		if merged == nil {
+			merged = &extent
+			continue
+		}
+		merged.MinX, merged.MinY = min(merged.MinX, extent.MinX), min(merged.MinY, extent.MinY)
+		merged.MaxX, merged.MaxY = max(merged.MaxX, extent.MaxX), max(merged.MaxY, extent.MaxY)
+	}
+
+	served.setHeaders(w)
+	if merged == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(data); err != nil {
+		slog.Error("Failed to respond with merged extent", "error", err)
+	}
+}
+
+type shardResult struct {
+	shard    int
+	features []*geojson.Feature
+	servedBy string
+	err      error
+}
+
+// servedBy is the node which handled the request in every contributed shard
+type servedBy map[int]string
+
+// setHeaders lists the shards and their nodes in the same order
+func (s servedBy) setHeaders(w http.ResponseWriter) {
+	shards := make([]int, 0, len(s))
+	for shard := range s {
+		shards = append(shards, shard)
+	}
+	slices.Sort(shards)
+	names := make([]string, 0, len(shards))
+	numbers := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		names = append(names, s[shard])
+		numbers = append(numbers, strconv.Itoa(shard))
+	}
+	w.Header().Set(ServedByHeader, strings.Join(names, ", "))
+	w.Header().Set(ShardHeader, strings.Join(numbers, ", "))
+}
+
+// gatherShards queries the select path of every shard concurrently by at most MaxShardQueries workers
+// and merges the features deduplicated by ID, it returns the reasons of failed shards if any
+// and the nodes which responded
+func (r *Router) gatherShards(t *Topology, req *http.Request, path string, query string, body []byte) (*geojson.FeatureCollection, []string, servedBy) {
+	shards := make(chan int, len(t.Nodes))
+	for shard := range t.Nodes {
+		shards <- shard
+	}
+	close(shards)
+
+	results := make(chan shardResult, len(t.Nodes))
+	for i := 0; i < min(MaxShardQueries, len(t.Nodes)); i++ {
+		go func() {
+			for shard := range shards {
+				features, node, err := r.selectFromShard(t, shard, req, path, query, body)
+				results <- shardResult{shard, features, node, err}
+			}
+		}()
+	}
+
+	fc := geojson.NewFeatureCollection()
+	seen := make(map[any]bool)
+	failed := make([]string, 0)
+	served := make(servedBy)
+	for range t.Nodes {
+		result := <-results
+		if result.err != nil {
+			slog.Warn("Failed to select from shard "+strconv.Itoa(result.shard), "error", result.err)
+			failed = append(failed, "shard "+strconv.Itoa(result.shard)+": "+result.err.Error())
+			continue
+		}
+		served[result.shard] = result.servedBy
+		for _, feature := range result.features {
+			if seen[feature.ID] {
+				continue // the feature may be on both shards during rebalancing
+			}
+			seen[feature.ID] = true
+			fc.Features = append(fc.Features, feature)
+		}
+	}
+
+	return fc, failed, served
+}
+
+// selectFromShard returns the features from a replica of the shard and the name of the node which responded,
+// the request to the replica is canceled when the shard times out
+func (r *Router) selectFromShard(t *Topology, shard int, req *http.Request, path string, query string, body []byte) ([]*geojson.Feature, string, error) {
+	replica, ok := r.chooseReplica(t, shard)
+	if !ok {
+		return nil, "", fmt.Errorf("no healthy replicas")
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, "", err
+	}
+	if param := values.Get("min_lsn"); param != "" {
+		minLSN, err := parseMinLSN(param)
+		if err != nil {
+			return nil, "", err
+		}
+		values.Set("min_lsn", formatMinLSN(filterMinLSN(minLSN, t.Nodes[shard])))
+		if values.Get("min_lsn") == "" {
+			values.Del("min_lsn")
+		}
+	}
+
+	targetURL := &url.URL{Path: "/" + replica + path, RawQuery: values.Encode()}
+	ctx, cancel := context.WithTimeout(req.Context(), r.shardTimeout)
+	defer cancel() // the replica stops working for the timed out shard
+	type response struct {
+		rr  *responseBuffer
+		err error
+	}
+	responses := make(chan response, 1)
+	done := r.balancer.track(replica)
+	go func() {
+		defer done() // the replica is busy until it responds even if the shard has timed out
+		rr, err := r.serve(req.WithContext(ctx), req.Method, targetURL.String(), body)
+		responses <- response{rr, err}
+	}()
+
+	var rr *responseBuffer
+	select {
+	case result := <-responses:
+		if result.err != nil {
+			return nil, "", result.err
+		}
+		rr = result.rr
+	case <-ctx.Done():
+		return nil, "", fmt.Errorf("%s timed out after %v", replica, r.shardTimeout)
+	}
+
+	if rr.code != http.StatusOK {
+		return nil, "", fmt.Errorf("%s responded with %d: %s", replica, rr.code, strings.TrimSpace(rr.body.String()))
+	}
+
+	fc, err := geojson.UnmarshalFeatureCollection(rr.body.Bytes())
+	if err != nil {
+		return nil, "", err
+	}
+	return fc.Features, rr.Header().Get(ServedByHeader), nil
+}
+
+// serve makes a request to a node through the mux following its redirects,
+// it has the context and the client address of the request of the client
+func (r *Router) serve(client *http.Request, method string, target string, body []byte) (*responseBuffer, error) {
+	for i := int32(0); ; i++ {
+		req, err := http.NewRequestWithContext(client.Context(), method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.RemoteAddr = client.RemoteAddr
+		req.RequestURI = req.URL.RequestURI()
+		rr := newResponseBuffer()
+		r.mux.ServeHTTP(rr, req)
+		rr.WriteHeader(http.StatusOK) // nothing is written by the handler
+		if rr.code != http.StatusTemporaryRedirect || i >= DefaultMaxRedirects {
+			return rr, nil
+		}
+		target = rr.Header().Get("Location")
+	}
+}
+
+// forward passes the request to the path of the node in the mode of the route
+func (r *Router) forward(w http.ResponseWriter, req *http.Request, shard int, node string, path string) {
+	if r.modes[req.URL.Path] == ProxyMode {
+		r.proxy(w, req, shard, node, path)
+		return
+	}
+	r.redirectWithQuery(w, req, shard, "/"+node+path)
+}
+
+// proxy serves the request by the path of the node on the same mux, so the client gets the response
+// of the node without the second hop. The request keeps the address of the client for the rate limits
+// and never leaves the process, whatever host the client has put into it
+func (r *Router) proxy(w http.ResponseWriter, req *http.Request, shard int, node string, path string) {
+	defer r.balancer.track(node)()
+	w.Header().Set(ShardHeader, strconv.Itoa(shard))
+	out := req.Clone(req.Context())
+	out.URL.Path, out.URL.RawPath = "/"+node+path, ""
+	out.RequestURI = out.URL.RequestURI()
+	r.mux.ServeHTTP(w, out)
+}
+
+func (r *Router) redirectWithQuery(w http.ResponseWriter, req *http.Request, shard int, target string) {
+	w.Header().Set(ShardHeader, strconv.Itoa(shard))
 	query := req.URL.RawQuery
 	targetURL := &url.URL{Path: target, RawQuery: query}
 	http.Redirect(w, req, targetURL.String(), http.StatusTemporaryRedirect)
 }
 
-func (r *Router) chooseLeader() string {
-	return r.leaders[0][rand.IntN(len(r.leaders[0]))]
+// chooseLeader prefers the healthy nodes of the shard which have reported themselves as the leaders,
+// so the writes follow the elections. The configured leaders are chosen until a node reports it
+func (r *Router) chooseLeader(t *Topology, shard int) (string, bool) {
+	r.mu.RLock()
+	elected := make([]string, 0, 1)
+	for _, node := range t.Nodes[shard] {
+		if r.healthy[node] && r.leading[node] {
+			elected = append(elected, node)
+		}
+	}
+	r.mu.RUnlock()
+	if len(elected) > 0 {
+		return r.balancer.choose(elected), true
+	}
+	return r.chooseHealthy(t.Leaders[shard])
+}
+
+func (r *Router) chooseReplica(t *Topology, shard int) (string, bool) {
+	return r.chooseHealthy(t.Nodes[shard])
+}
+
+func (r *Router) chooseHealthy(nodes []string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	healthy := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if r.healthy[node] {
+			healthy = append(healthy, node)
+		}
+	}
+	if len(healthy) == 0 {
+		return "", false
+	}
+	return r.balancer.choose(healthy), true
+}
+
+// current returns the topology which is used by a request until it is finished
+func (r *Router) current() *Topology {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.topology
+}
+
+// Reload replaces the topology with the one from the config file,
+// the current topology is kept if the new one is invalid
+func (r *Router) Reload() error {
+	topology, err := LoadTopology(r.configFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.topology = topology
+	healthy := maps.Clone(r.healthy)
+	for _, node := range topology.allNodes() {
+		if _, ok := healthy[node]; !ok {
+			healthy[node] = true // the added nodes are considered healthy until the next check
+		}
+	}
+	r.healthy = healthy
+	return nil
+}
+
+func (r *Router) reloadLoop() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-signals:
+			if err := r.Reload(); err != nil {
+				slog.Error("Failed to reload the topology", "error", err)
+				continue
+			}
+			slog.Info("Reloaded the topology", "shards", len(r.current().Nodes))
+		}
+	}
+}
+
+// health checks
+
+func (r *Router) healthCheckLoop() {
+	ticker := time.NewTicker(HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			r.checkHealth()
+		}
+	}
 }
 
-func (r *Router) chooseReplica() string {
-	return r.nodes[0][rand.IntN(len(r.nodes[0]))]
+// checkHealth requests /ready of every node through the same mux
+// the router redirects clients to, only the ready nodes are chosen.
+// The node names itself by LeaderHeader while it is the leader
+func (r *Router) checkHealth() {
+	healthy := make(map[string]bool)
+	leading := make(map[string]bool)
+	for _, node := range r.current().allNodes() {
+		req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, "/"+node+"/ready", nil)
+		if err != nil {
+			slog.Error("Failed to check the node", "node", node, "error", err)
+			continue
+		}
+		resp := newResponseBuffer()
+		r.mux.ServeHTTP(resp, req)
+		resp.WriteHeader(http.StatusOK) // nothing is written by the handler
+		healthy[node] = resp.code == http.StatusOK
+		leading[node] = resp.Header().Get(LeaderHeader) == node
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.healthy = healthy
+	r.leading = leading
 }
 
 func (r *Router) snapshotHandler(w http.ResponseWriter, req *http.Request) {
-	for _, node := range r.nodes[0] {
+	for _, node := range r.current().allNodes() {
 		resp, err := http.Get(fmt.Sprintf("http://%s/%s/snapshot", req.Host, node))
 		if err != nil {
-			slog.Error("Failed to make snapshot on "+node, err)
+			slog.Error("Failed to make snapshot", "node", node, "error", err)
 			continue
 		}
 		_ = resp.Body.Close()
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// utils
+
+// responseBuffer keeps the response of a node served in-process through the mux
+type responseBuffer struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header)}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *responseBuffer) Write(data []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(data)
+}
+
+// idParamRoutes take the feature ID by the id query parameter, the other writes by the body only
+var idParamRoutes = map[string]bool{"/delete": true, "/feature": true, "/history": true}
+
+// readFeatureID takes the ID from the id query parameter if the route takes it, otherwise from
+// the feature in the body, the body is kept for the node the request is proxied to
+func readFeatureID(req *http.Request, idParam bool) (string, error) {
+	if ID := req.URL.Query().Get("id"); idParam && ID != "" {
+		return ID, nil
+	}
+
+	data, err := readBody(req)
+	if err != nil {
+		return "", err
+	}
+
+	// a feature, a patch and a move carry the ID on the top level
+	var body struct {
+		ID any `json:"id"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return "", err
+	}
+
+	ID, ok := body.ID.(string)
+	if !ok {
+		return "", fmt.Errorf("missing field ID")
+	}
+	return ID, nil
+}
+
+// readBody reads the whole body and puts it back, so the request can be proxied after it is inspected
+func readBody(req *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/paulmach/orb/geojson"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SnapshotFormat is the encoding of the snapshot file
+type SnapshotFormat int
+
+const (
+	// MapSnapshot writes the stored features keyed by their IDs
+	MapSnapshot SnapshotFormat = iota
+	// GeoJSONSnapshot writes a FeatureCollection readable by GIS tools,
+	// the storage fields are kept in the snapshotProperties
+	GeoJSONSnapshot
+)
+
+// DefaultSnapshotRetention is the number of the snapshots kept by the storages, the older ones
+// are removed after a new snapshot is written
+const DefaultSnapshotRetention = 3
+
+// DefaultSnapshotWALBytes is the size of the WAL the storages snapshot at to bound the replay on start
+const DefaultSnapshotWALBytes int64 = 64 << 20
+
+// SnapshotInfo is a retained snapshot, Name is the file name next to the base snapshot file
+type SnapshotInfo struct {
+	Name  string    `json:"name"`
+	Time  time.Time `json:"time"`
+	LSN   uint64    `json:"lsn"`
+	Bytes int64     `json:"bytes"`
+}
+
+// snapshotProperties keep the fields of the stored feature in the GeoJSON snapshot
+var snapshotProperties = []string{"_shard", "_name", "_lsn", "_created_by", "_created_lsn", "_deleted", "_idempotency_key"}
+
+func (f SnapshotFormat) String() string {
+	switch f {
+	case MapSnapshot:
+		return "map"
+	case GeoJSONSnapshot:
+		return "geojson"
+	default:
+		return fmt.Sprintf("SnapshotFormat(%d)", int(f))
+	}
+}
+
+func ParseSnapshotFormat(value string) (SnapshotFormat, error) {
+	for _, format := range []SnapshotFormat{MapSnapshot, GeoJSONSnapshot} {
+		if format.String() == value {
+			return format, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown snapshot format %q", value)
+}
+
+// mapSnapshot keeps the vclock next to the features, since the WAL it could be rebuilt from
+// is removed after the snapshot, the GeoJSON snapshot keeps it as a foreign member
+type mapSnapshot struct {
+	Vclock   map[string]uint64   `json:"vclock"`
+	Features map[string]*Feature `json:"features"`
+}
+
+func encodeSnapshot(format SnapshotFormat, features map[string]*Feature, vclock map[string]uint64) ([]byte, error) {
+	switch format {
+	case MapSnapshot:
+		return json.Marshal(mapSnapshot{Vclock: vclock, Features: features})
+	case GeoJSONSnapshot:
+		fc := geojson.NewFeatureCollection()
+		for _, feature := range features {
+			fc.Append(toSnapshotFeature(feature))
+		}
+		fc.ExtraMembers = geojson.Properties{"vclock": vclock}
+		return json.Marshal(fc)
+	default:
+		return nil, fmt.Errorf("unknown snapshot format %v", format)
+	}
+}
+
+// decodeSnapshot detects the format, the map has no FeatureCollection type on the top level.
+// The older snapshots have no vclock, it is rebuilt from the LSNs of the features then
+func decodeSnapshot(data []byte) (map[string]*Feature, map[string]uint64, error) {
+	var probe struct {
+		Type     string          `json:"type"`
+		Features json.RawMessage `json:"features"`
+	}
+	if json.Unmarshal(data, &probe) != nil || probe.Type != "FeatureCollection" {
+		if probe.Features == nil {
+			// the bare features written before the vclock was kept
+			features := make(map[string]*Feature)
+			err := json.Unmarshal(data, &features)
+			return features, vclockOf(features), err
+		}
+		var snapshot mapSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, nil, err
+		}
+		if snapshot.Features == nil {
+			snapshot.Features = make(map[string]*Feature)
+		}
+		if snapshot.Vclock == nil {
+			snapshot.Vclock = vclockOf(snapshot.Features)
+		}
+		return snapshot.Features, snapshot.Vclock, nil
+	}
+
+	fc, err := geojson.UnmarshalFeatureCollection(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	features := make(map[string]*Feature, len(fc.Features))
+	for _, f := range fc.Features {
+		feature, err := fromSnapshotFeature(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		features[f.ID.(string)] = feature
+	}
+	stored, ok := fc.ExtraMembers["vclock"].(map[string]any)
+	if !ok {
+		return features, vclockOf(features), nil
+	}
+	vclock := make(map[string]uint64, len(stored))
+	for key, lsn := range stored {
+		value, ok := lsn.(float64)
+		if !ok {
+			return nil, nil, fmt.Errorf("snapshot vclock has non-numeric LSN %v of %s", lsn, key)
+		}
+		vclock[key] = uint64(value)
+	}
+	return features, vclock, nil
+}
+
+// vclockOf is the latest LSN of every origin among the features, the LSNs of the overwritten
+// and the collected features are lost, so it may be behind the vclock the snapshot is made at
+func vclockOf(features map[string]*Feature) map[string]uint64 {
+	vclock := make(map[string]uint64)
+	for _, feature := range features {
+		vclock[feature.origin()] = max(vclock[feature.origin()], feature.LSN)
+	}
+	return vclock
+}
+
+func toSnapshotFeature(f *Feature) *geojson.Feature {
+	feature := *f.Feature
+	feature.Properties = f.Feature.Properties.Clone()
+	if feature.Properties == nil {
+		feature.Properties = make(geojson.Properties)
+	}
+	if f.Shard != "" {
+		feature.Properties["_shard"] = f.Shard
+	}
+	feature.Properties["_name"] = f.Name
+	feature.Properties["_lsn"] = f.LSN
+	feature.Properties["_created_by"] = f.CreatedBy
+	feature.Properties["_created_lsn"] = f.CreatedLSN
+	if f.Deleted {
+		feature.Properties["_deleted"] = true
+	}
+	if f.IdempotencyKey != "" {
+		feature.Properties["_idempotency_key"] = f.IdempotencyKey
+	}
+	return &feature
+}
+
+func fromSnapshotFeature(feature *geojson.Feature) (*Feature, error) {
+	if _, ok := feature.ID.(string); !ok {
+		return nil, fmt.Errorf("snapshot feature %v has no string ID", feature.ID)
+	}
+	properties := feature.Properties
+	f := &Feature{
+		Shard:          properties.MustString("_shard", ""),
+		Name:           properties.MustString("_name", ""),
+		LSN:            uint64(properties.MustFloat64("_lsn", 0)),
+		CreatedBy:      properties.MustString("_created_by", ""),
+		CreatedLSN:     uint64(properties.MustFloat64("_created_lsn", 0)),
+		Deleted:        properties.MustBool("_deleted", false),
+		IdempotencyKey: properties.MustString("_idempotency_key", ""),
+		Feature:        feature,
+	}
+	for _, key := range snapshotProperties {
+		delete(properties, key)
+	}
+	return f, nil
+}
+
+// snapshotPath names the snapshot by the time and the LSN of this node it is made at,
+// e.g. snapshot-1760000000000000000-42.json for the snapshot.json base file
+func (e *Engine) snapshotPath(at time.Time, lsn uint64) string {
+	ext := filepath.Ext(e.snapshotFile)
+	return fmt.Sprintf("%s-%d-%d%s", strings.TrimSuffix(e.snapshotFile, ext), at.UnixNano(), lsn, ext)
+}
+
+// listSnapshots returns the retained snapshots from the newest one, the base snapshot file
+// is written by the older versions which overwrite the single snapshot
+func (e *Engine) listSnapshots() ([]SnapshotInfo, error) {
+	if !e.durable {
+		return nil, nil
+	}
+	base := filepath.Base(e.snapshotFile)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+
+	entries, err := os.ReadDir(filepath.Dir(e.snapshotFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]SnapshotInfo, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || (name != base && (!strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext))) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed meanwhile
+		}
+		snapshot := SnapshotInfo{Name: name, Time: info.ModTime(), Bytes: info.Size()}
+		if name != base {
+			var nanos int64
+			if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), "%d-%d", &nanos, &snapshot.LSN); err != nil {
+				continue
+			}
+			snapshot.Time = time.Unix(0, nanos)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+	return snapshots, nil
+}
+
+// latestSnapshot returns the path and the time of the newest snapshot
+func (e *Engine) latestSnapshot() (string, time.Time, bool) {
+	snapshots, err := e.listSnapshots()
+	if err != nil || len(snapshots) == 0 {
+		return "", time.Time{}, false
+	}
+	return filepath.Join(filepath.Dir(e.snapshotFile), snapshots[0].Name), snapshots[0].Time, true
+}
+
+// pruneSnapshots removes the snapshots older than the retained ones
+func (e *Engine) pruneSnapshots() {
+	if e.snapshotRetention <= 0 {
+		return
+	}
+	snapshots, err := e.listSnapshots()
+	if err != nil {
+		slog.Error("Failed to list the snapshots", "node", e.name, "error", err)
+		return
+	}
+	for _, snapshot := range snapshots[min(e.snapshotRetention, len(snapshots)):] {
+		if err := os.Remove(filepath.Join(filepath.Dir(e.snapshotFile), snapshot.Name)); err != nil {
+			slog.Error("Failed to remove the old snapshot", "node", e.name, "snapshot", snapshot.Name, "error", err)
+		}
+	}
+}
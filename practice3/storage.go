@@ -3,116 +3,505 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
+	"hash/fnv"
 	"io"
 	"log/slog"
+	"math"
 	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 type Storage struct {
 	mux         *http.ServeMux
 	name        string
 	replicas    []string
-	leader      bool
+	leader      atomic.Bool // flipped by electLeader while the handlers read it, see IsLeader
 	engine      *Engine
 	ctx         context.Context
 	cancel      context.CancelFunc
 	upgrader    websocket.Upgrader
 	connections *ReplicaRegistry
+	heartbeats  *Heartbeats
+	metrics     *Metrics
+	startedAt   time.Time
 	curSelects  int32
+	redirects   RedirectConfig
+	wgs84       bool
+	reads       *RateLimiter
+	writes      *RateLimiter
+	inFlight    *Semaphore
+	layout      *DataLayout
+	bodies      BodyLimits
+	encoding    EncodingConfig
 }
 
-const MaxRedirects int32 = 3
+const (
+	DefaultMaxRedirects         int32 = 3
+	DefaultMaxConcurrentSelects int32 = 3
+	StreamChunkSize                   = 100
+	EngineTimeout                     = 5 * time.Second
+	DefaultMaxBodyBytes         int64 = 1 << 20
+	DefaultMaxBulkBodyBytes     int64 = 64 << 20
+)
+
+// BodyLimits are the sizes of the request bodies in bytes, the larger bodies are rejected with 413
+type BodyLimits struct {
+	// MaxBody limits the single feature requests: insert, replace, delete, patch and select_polygon
+	MaxBody int64
+	// MaxBulkBody limits the requests with many features: import and validate
+	MaxBulkBody int64
+}
+
+func DefaultBodyLimits() BodyLimits {
+	return BodyLimits{
+		MaxBody:     DefaultMaxBodyBytes,
+		MaxBulkBody: DefaultMaxBulkBodyBytes,
+	}
+}
+
+// RedirectConfig controls how a busy node sheds the select load onto its replicas
+type RedirectConfig struct {
+	// MaxConcurrentSelects is the number of selects served at once, the next ones are redirected
+	MaxConcurrentSelects int32
+	// MaxRedirects is the number of times a select may be redirected before it is rejected
+	MaxRedirects int32
+	// ChooseReplica picks the replica a select is redirected to
+	ChooseReplica func(replicas []string) string
+}
+
+func DefaultRedirectConfig() RedirectConfig {
+	return RedirectConfig{
+		MaxConcurrentSelects: DefaultMaxConcurrentSelects,
+		MaxRedirects:         DefaultMaxRedirects,
+		ChooseReplica:        RandomReplica,
+	}
+}
+
+func RandomReplica(replicas []string) string {
+	return replicas[rand.IntN(len(replicas))]
+}
+
+// StorageConfig are the knobs of a storage node
+type StorageConfig struct {
+	// Shard namespaces the LSNs of the node in the vclocks, it is empty for a single shard,
+	// so its vclocks are keyed by the node names like the ones written before the sharding
+	Shard string
+	// WGS84 rejects the features with coordinates out of the WGS84 ranges
+	WGS84 bool
+	// LockGeometryType rejects the upserts changing the geometry type of the stored features
+	LockGeometryType bool
+	Redirects        RedirectConfig
+	// Limits are the rates of the reads and writes of every client and Bodies limit the request sizes
+	Limits RateLimitConfig
+	Bodies BodyLimits
+	// Encoding shapes the selected features by default
+	Encoding EncodingConfig
+	// CheckOrigin accepts the replication and watch websockets, e.g. LocalOrigin or AllowOrigins
+	CheckOrigin func(r *http.Request) bool
+	// Engine is the config of the engine, the files and the metrics are set by the storage
+	Engine EngineConfig
+}
+
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		WGS84:       true,
+		Redirects:   DefaultRedirectConfig(),
+		Bodies:      DefaultBodyLimits(),
+		Encoding:    DefaultEncodingConfig(),
+		CheckOrigin: LocalOrigin,
+		Engine:      DefaultEngineConfig(),
+	}
+}
+
+type Extent struct {
+	MinX float64 `json:"minX"`
+	MinY float64 `json:"minY"`
+	MaxX float64 `json:"maxX"`
+	MaxY float64 `json:"maxY"`
+}
+
+type HealthResponse struct {
+	Name       string            `json:"name"`
+	Leader     bool              `json:"leader"`
+	LSN        uint64            `json:"lsn"`
+	Vclock     map[string]uint64 `json:"vclock"`
+	Features   int               `json:"features"`
+	Recovering bool              `json:"recovering"`
+}
+
+// NewStorage creates a storage node, replicas map the names of the other
+// replicas to the base URLs their handlers are served under,
+// the snapshot and the WAL are kept in dataDir which is created if needed, unless the engine
+// is not durable and keeps the data in memory only.
+// It fails with ErrDataDirLocked if dataDir is used by another running storage
+func NewStorage(mux *http.ServeMux, name string, replicas map[string]string, leader bool, dataDir string, config StorageConfig) (*Storage, error) {
+	layout := NewDataLayout(dataDir)
+	if config.Engine.Durable {
+		if err := layout.Claim(); err != nil {
+			return nil, err
+		}
+	}
 
-func NewStorage(mux *http.ServeMux, name string, replicas []string, leader bool, snapshotFile string, walFile string) *Storage {
 	ctx, cancel := context.WithCancel(context.Background())
-	engine := NewEngine(name, replicas, ctx, snapshotFile, walFile)
-	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
-	connections := NewReplicaRegistry(name)
-	return &Storage{mux, name, replicas, leader, engine, ctx, cancel, upgrader, connections, 0}
+	metrics := NewMetrics()
+	engineConfig := config.Engine
+	engineConfig.SnapshotFile, engineConfig.WALFile = layout.SnapshotFile(), layout.WALFile()
+	engineConfig.Metrics = metrics
+	engine := NewEngine(name, replicas, ctx, engineConfig)
+	upgrader := newReplicationUpgrader(config.CheckOrigin)
+	storage := &Storage{
+		mux:         mux,
+		name:        name,
+		replicas:    replicaNames(replicas),
+		engine:      engine,
+		ctx:         ctx,
+		cancel:      cancel,
+		upgrader:    upgrader,
+		connections: NewReplicaRegistry(name),
+		heartbeats:  NewHeartbeats(),
+		metrics:     metrics,
+		redirects:   config.Redirects,
+		wgs84:       config.WGS84,
+		reads:       NewRateLimiter(config.Limits.ReadRate, config.Limits.ReadBurst),
+		writes:      NewRateLimiter(config.Limits.WriteRate, config.Limits.WriteBurst),
+		inFlight:    NewSemaphore(config.Limits.MaxInFlight),
+		layout:      layout,
+		bodies:      config.Bodies,
+		encoding:    config.Encoding,
+	}
+	storage.leader.Store(leader)
+	engine.sweepExpired = storage.IsLeader // replicas get the deletions from the leader
+	engine.lockGeometryType = config.LockGeometryType
+	engine.shard = config.Shard
+	return storage, nil
 }
 
 func (s *Storage) Run() {
 	s.initHandlers()
+	s.startedAt = time.Now()
 	go s.engine.Start()
+	go s.heartbeatLoop()
 }
 
 func (s *Storage) Stop() {
 	s.cancel()
+	s.connections.Close()
+	s.engine.connections.Close()
+	s.layout.Release()
+}
+
+// IsLeader may be called from any goroutine, the writes made after it returns false are redirected
+func (s *Storage) IsLeader() bool {
+	return s.leader.Load()
+}
+
+// setLeader is called by the election, it is safe to call concurrently with the handlers
+func (s *Storage) setLeader(leader bool) {
+	s.leader.Store(leader)
 }
 
 func (s *Storage) initHandlers() {
-	s.mux.HandleFunc("/"+s.name+"/select", s.selectHandler)
-	s.mux.HandleFunc("/"+s.name+"/insert", s.insertHandler)
-	s.mux.HandleFunc("/"+s.name+"/replace", s.replaceHandler)
-	s.mux.HandleFunc("/"+s.name+"/delete", s.deleteHandler)
-	s.mux.HandleFunc("/"+s.name+"/snapshot", s.snapshotHandler)
-	s.mux.HandleFunc("/"+s.name+"/replication", s.replicationHandler)
+	s.handle("/select", withRateLimit(s.reads, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.selectHandler))))
+	s.handle("/select_polygon", withMaxBody(s.bodies.MaxBody, withRateLimit(s.reads, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.selectPolygonHandler)))))
+	s.handle("/within", withRateLimit(s.reads, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.withinHandler))))
+	s.handle("/extent", withRateLimit(s.reads, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.extentHandler))))
+	s.handle("/select_at", withRateLimit(s.reads, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.selectAtHandler))))
+	s.handle("/feature", withRateLimit(s.reads, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.featureHandler))))
+	s.handle("/history", withRateLimit(s.reads, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.historyHandler))))
+	s.handle("/subscribe", s.subscribeHandler)
+	s.handle("/watch", s.watchHandler)
+	s.handle("/insert", withMaxBody(s.bodies.MaxBody, withRateLimit(s.writes, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.insertHandler)))))
+	s.handle("/replace", withMaxBody(s.bodies.MaxBody, withRateLimit(s.writes, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.replaceHandler)))))
+	s.handle("/delete", withMaxBody(s.bodies.MaxBody, withRateLimit(s.writes, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.deleteHandler)))))
+	s.handle("/patch", withMaxBody(s.bodies.MaxBody, withRateLimit(s.writes, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.patchHandler)))))
+	s.handle("/move", withMaxBody(s.bodies.MaxBody, withRateLimit(s.writes, withInFlightLimit(s.inFlight, 1, withEngineTimeout(s.moveHandler)))))
+	s.handle("/export", withRateLimit(s.reads, withInFlightLimit(s.inFlight, BulkWeight, withEngineTimeout(s.exportHandler))))
+	s.handle("/validate", withMaxBody(s.bodies.MaxBulkBody, withRateLimit(s.reads, s.validateHandler)))
+	s.handle("/import", withMaxBody(s.bodies.MaxBulkBody, withRateLimit(s.writes, withInFlightLimit(s.inFlight, BulkWeight, withEngineTimeout(s.importHandler)))))
+	s.handle("/truncate", withRateLimit(s.writes, withInFlightLimit(s.inFlight, BulkWeight, withEngineTimeout(s.truncateHandler))))
+	s.handle("/batch", withMaxBody(s.bodies.MaxBulkBody, withRateLimit(s.writes, withInFlightLimit(s.inFlight, BulkWeight, withEngineTimeout(s.batchHandler)))))
+	s.handle("/snapshot", withEngineTimeout(s.snapshotHandler))
+	s.handle("/snapshots", s.snapshotsHandler)
+	s.handle("/restore", withRateLimit(s.writes, withInFlightLimit(s.inFlight, BulkWeight, withEngineTimeout(s.restoreHandler))))
+	s.handle("/resync", withEngineTimeout(s.resyncHandler))
+	s.handle("/compact", withEngineTimeout(s.compactHandler))
+	s.handle("/replication", s.replicationHandler)
+	s.handle("/health", s.healthHandler)
+	s.handle("/ready", s.readyHandler)
+	s.handle("/vclock", s.vclockHandler)
+	s.handle("/stats", withEngineTimeout(s.statsHandler))
+	s.handle("/metrics", s.metricsHandler)
+}
+
+// handle registers the handler of the node path, every response names the node by ServedByHeader
+// and the leader by LeaderHeader while there is an alive one
+func (s *Storage) handle(path string, handler http.HandlerFunc) {
+	s.mux.HandleFunc("/"+s.name+path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ServedByHeader, s.name)
+		if leader, ok := s.currentLeader(); ok {
+			w.Header().Set(LeaderHeader, leader)
+		}
+		handler(w, r)
+	})
+}
+
+// currentLeader is this node if it leads, otherwise the replica which has announced itself
+// as the leader and has been heard from within HeartbeatTimeout
+func (s *Storage) currentLeader() (string, bool) {
+	if s.IsLeader() {
+		return s.name, true
+	}
+	leader := s.heartbeats.Leader()
+	return leader, leader != "" && s.heartbeats.Alive(leader)
+}
+
+// redirectToLeader answers the write made on a follower: it is redirected by 307 to the same path
+// of the leader under its base URL, while there is no alive leader the client is asked to retry
+// after the election
+func (s *Storage) redirectToLeader(w http.ResponseWriter, r *http.Request) {
+	slog.Warn("Current node " + s.name + " is not a leader")
+	leader, ok := s.currentLeader()
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(HeartbeatTimeout.Seconds()))))
+		writeError(w, http.StatusServiceUnavailable, "Node "+s.name+" is not a leader and there is no leader now")
+		return
+	}
+	target, err := s.engine.replicaURL(leader, strings.TrimPrefix(r.URL.Path, "/"+s.name))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Invalid URL of the leader "+leader)
+		return
+	}
+	target.RawQuery = r.URL.RawQuery
+	http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+}
+
+// checkPeer accepts the replication connections of the configured replicas only,
+// the replica must connect from an address its base URL resolves to
+func (s *Storage) checkPeer(r *http.Request, replica string) error {
+	base, ok := s.engine.replicaURLs[replica]
+	if !ok {
+		return fmt.Errorf("%q is not a replica of %s", replica, s.name)
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return err
+	}
+
+	remote := net.ParseIP(clientIP(r))
+	host := u.Hostname()
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		// the replica listening on all the interfaces dials this host by the loopback
+		if remote.IsLoopback() {
+			return nil
+		}
+		return fmt.Errorf("replica %s must connect from the loopback, not %s", replica, remote)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(r.Context(), host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(remote) {
+			return nil
+		}
+	}
+	return fmt.Errorf("replica %s must connect from %s, not %s", replica, host, remote)
 }
 
 func (s *Storage) replicationHandler(w http.ResponseWriter, r *http.Request) {
+	if s.ctx.Err() != nil {
+		writeError(w, http.StatusServiceUnavailable, "Node "+s.name+" is stopped")
+		return
+	}
+	replica := r.URL.Query().Get("name")
+	if err := s.checkPeer(r, replica); err != nil {
+		slog.Warn("Rejected replication connection", "node", s.name, "error", err)
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		slog.Error("Upgrade error", err)
+		slog.Error("Upgrade error", "error", err)
 		return
 	}
 
-	replica := r.URL.Query().Get("name")
-	s.connections.Add(replica, conn)
+	setCompressionLevel(conn, s.engine.compressionLevel)
+
+	registered := s.connections.Add(replica, conn)
+
+	conn.SetPingHandler(func(payload string) error {
+		s.heartbeats.Touch(replica, payload == leaderHeartbeat)
+		_ = conn.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(HeartbeatInterval))
+		return nil
+	})
 
 	go func() {
+		// closing the connection unblocks ReadMessage, so the loop ends with the storage,
+		// even if the connection is accepted after Stop has closed the registered ones
+		stop := context.AfterFunc(s.ctx, func() { _ = conn.Close() })
+		defer stop()
 		defer conn.Close()
-		defer s.connections.Remove(replica)
+		defer s.connections.removeConn(replica, registered) // the reconnected replica is kept
 
 		for {
 			_, message, err := conn.ReadMessage()
+			if s.ctx.Err() != nil {
+				return
+			}
 			if err != nil {
-				slog.Error("Read from (another) leader "+replica+" error, me: "+s.name, err)
+				slog.Error("Failed to read from replica", "node", s.name, "replica", replica, "error", err)
 				return
 			}
 
-			var tx Transaction
-			if err := json.Unmarshal(message, &tx); err != nil {
-				slog.Error("Failed to unmarshal transaction from replica "+replica, err)
+			txs, err := decodeReplicationMessage(message)
+			if err != nil {
+				slog.Error("Failed to unmarshal transaction from replica", "node", s.name, "replica", replica, "error", err)
 				return
 			}
 
-			if err := s.engine.ApplyTransactionRaw(&tx); err != nil {
-				slog.Error(fmt.Sprintf("Failed to apply transaction %v from replica", tx), err)
+			// the message is applied at once, so the batches are never seen partially
+			applied := make([]*Transaction, len(txs))
+			for i := range txs {
+				applied[i] = &txs[i]
+			}
+			if err := s.engine.ApplyReplicated(s.ctx, replica, applied...); err != nil {
+				slog.Error("Failed to apply transactions from replica", "node", s.name, "replica", replica, "error", err)
 			}
 		}
 	}()
 }
 
+// leader election
+
+func (s *Storage) heartbeatLoop() {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			for replica, conn := range s.engine.dialReplicas() {
+				if err := s.engine.AddReplica(s.ctx, replica, conn); err != nil {
+					slog.Error("Failed to re-sync replica", "node", s.name, "replica", replica, "error", err)
+					_ = conn.Close()
+				}
+			}
+			payload := ""
+			if s.IsLeader() {
+				payload = leaderHeartbeat
+			}
+			s.engine.connections.Heartbeat(payload)
+			s.electLeader()
+		}
+	}
+}
+
+// electLeader picks the alive replica with the lowest name as the leader
+// if the current leader has not been heard from for HeartbeatTimeout
+func (s *Storage) electLeader() {
+	leader := s.heartbeats.Leader()
+
+	if s.IsLeader() {
+		if leader != "" && leader < s.name && s.heartbeats.Alive(leader) {
+			slog.Warn("Current node "+s.name+" steps down", "leader", leader)
+			s.setLeader(false)
+		}
+		return
+	}
+
+	if leader != "" && s.heartbeats.Alive(leader) {
+		return
+	}
+	if leader == "" && time.Since(s.startedAt) < HeartbeatTimeout {
+		return // give the leader a chance to announce itself
+	}
+
+	candidate := s.name
+	for _, replica := range s.replicas {
+		if replica < candidate && s.heartbeats.Alive(replica) {
+			candidate = replica
+		}
+	}
+	if candidate == s.name {
+		slog.Info("Current node "+s.name+" becomes a leader", "previous", leader)
+		s.setLeader(true)
+	}
+}
+
 func (s *Storage) redirectIfNeeded(w http.ResponseWriter, r *http.Request) bool {
-	if s.curSelects < MaxRedirects {
+	if atomic.LoadInt32(&s.curSelects) <= s.redirects.MaxConcurrentSelects || len(s.replicas) == 0 {
 		return false
 	}
 
-	ttl, err := strconv.Atoi(r.URL.Query().Get("ttl"))
+	query := r.URL.Query() // a copy, so the decremented TTL must be encoded back explicitly
+	ttl, err := strconv.Atoi(query.Get("ttl"))
 	if err != nil {
-		ttl = int(MaxRedirects)
+		ttl = int(s.redirects.MaxRedirects)
 	}
 	if ttl <= 0 {
-		http.Error(w, "TTL is 0", http.StatusTooManyRequests)
+		writeError(w, http.StatusTooManyRequests, "TTL is 0")
 		return true
 	}
-	r.URL.Query().Set("ttl", strconv.Itoa(ttl-1))
+	query.Set("ttl", strconv.Itoa(ttl-1))
 
-	replica := s.replicas[rand.IntN(len(s.replicas))]
-	targetURL := &url.URL{Path: "/" + replica + "/select", RawQuery: r.URL.RawQuery}
+	replica := s.redirects.ChooseReplica(s.replicas)
+	targetURL := &url.URL{Path: "/" + replica + "/select", RawQuery: query.Encode()}
 	http.Redirect(w, r, targetURL.String(), http.StatusTemporaryRedirect)
 
 	return true
 }
 
+// awaitMinLSN waits up to MinLSNWait until the transactions of the min_lsn parameter are applied,
+// otherwise the select is redirected to the leader which has made them, it returns false
+// if the response is already written
+func (s *Storage) awaitMinLSN(w http.ResponseWriter, r *http.Request) bool {
+	param := r.URL.Query().Get("min_lsn")
+	if param == "" {
+		return true
+	}
+	minLSN, err := parseMinLSN(param)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), MinLSNWait)
+	defer cancel()
+	for node, lsn := range minLSN {
+		err := s.engine.WaitForLSN(ctx, node, lsn)
+		if err == nil {
+			continue
+		}
+		if leader := s.heartbeats.Leader(); errors.Is(err, context.DeadlineExceeded) && leader != "" && leader != s.name {
+			path := "/" + leader + strings.TrimPrefix(r.URL.Path, "/"+s.name)
+			http.Redirect(w, r, (&url.URL{Path: path, RawQuery: r.URL.RawQuery}).String(), http.StatusTemporaryRedirect)
+			return false
+		}
+		writeError(w, engineErrorStatus(err), "Transactions up to "+formatLSN(node, lsn)+" are not applied yet")
+		return false
+	}
+	return true
+}
+
+func (s *Storage) setCommittedLSN(w http.ResponseWriter, lsn uint64) {
+	w.Header().Set(CommittedLSNHeader, formatLSN(s.name, lsn))
+}
+
 func (s *Storage) selectHandler(w http.ResponseWriter, r *http.Request) {
 	atomic.AddInt32(&s.curSelects, 1)
 	defer atomic.AddInt32(&s.curSelects, -1)
@@ -120,154 +509,1423 @@ func (s *Storage) selectHandler(w http.ResponseWriter, r *http.Request) {
 	if s.redirectIfNeeded(w, r) {
 		return
 	}
+	if !s.awaitMinLSN(w, r) {
+		return
+	}
+	s.metrics.Selects.Add(1)
+
+	// the validators are taken before the read, so they may only be older than the data
+	state := s.engine.State()
+	w.Header().Set("Vary", "Accept") // NDJSON is negotiated by Accept
 
 	rectParam := r.URL.Query().Get("rect")
+	where, err := parseWhereParams(r.URL.Query()["where"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	var data map[string]*geojson.Feature
-	if rectParam == "" {
-		data = s.engine.GetAllData()
-	} else {
-		coordinates, err := parseRectParam(rectParam)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+	var rect *[4]float64
+	if rectParam != "" {
+		coordinates, parseErr := parseRectParam(rectParam)
+		if parseErr != nil {
+			writeError(w, http.StatusBadRequest, parseErr.Error())
 			return
 		}
-		data = s.engine.GetData(coordinates)
-	}
-
-	fc := &geojson.FeatureCollection{
-		Features: make([]*geojson.Feature, 0, len(data)),
+		rect = &coordinates
 	}
 
-	for _, f := range data {
-		fc.Features = append(fc.Features, f)
+	var data map[string]*geojson.Feature
+	switch {
+	case len(where) > 0:
+		data, err = s.engine.GetDataFiltered(r.Context(), rect, where)
+	case rect == nil:
+		data, err = s.engine.GetAllData(r.Context())
+	default:
+		data, err = s.engine.GetData(r.Context(), *rect)
 	}
-
-	bytes, err := json.Marshal(fc)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, engineErrorStatus(err), "Failed to select features")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(bytes); err != nil {
-		slog.Error("Failed to respond with all features", err)
+	features := featuresOf(data)
+	if !expiring(features) && notModified(w, r, vclockETag(state.Vclock), state.Modified) {
+		return
+	}
+	if wantsSorted(r) {
+		sortByID(features)
+	}
+	if fields := r.URL.Query().Get("fields"); fields != "" {
+		features = projectProperties(features, strings.Split(fields, ","))
 	}
+	s.writeSelected(w, r, features)
 }
 
-func (s *Storage) insertHandler(w http.ResponseWriter, r *http.Request) {
-	s.upsertHandler(w, r, false)
-}
+// selectAtHandler returns the features as of ts, the unix time which may be fractional.
+// The state before the last snapshot is not retained and is rejected with 410,
+// the storage which is not durable has no WAL to replay and rejects it with 501
+func (s *Storage) selectAtHandler(w http.ResponseWriter, r *http.Request) {
+	ts, err := strconv.ParseFloat(r.URL.Query().Get("ts"), 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "ts parameter must be a unix timestamp")
+		return
+	}
+	data, err := s.engine.SelectAt(r.Context(), time.UnixMilli(int64(ts*1000)))
+	if errors.Is(err, ErrBeforeSnapshot) {
+		writeError(w, http.StatusGone, err.Error())
+		return
+	}
+	if errors.Is(err, ErrNotDurable) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if errors.Is(err, ErrSnapshotRunning) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to select features")
+		return
+	}
 
-func (s *Storage) replaceHandler(w http.ResponseWriter, r *http.Request) {
-	s.upsertHandler(w, r, true)
+	features := featuresOf(data)
+	if wantsSorted(r) {
+		sortByID(features)
+	}
+	s.writeSelected(w, r, features)
 }
 
-func (s *Storage) upsertHandler(w http.ResponseWriter, r *http.Request, replace bool) {
-	if !s.leader {
-		slog.Warn("Current node " + s.name + " is not a leader")
+func (s *Storage) selectPolygonHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.awaitMinLSN(w, r) {
 		return
 	}
+	s.metrics.Selects.Add(1)
 
 	bytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, bodyErrorStatus(err), err.Error())
 		return
 	}
 
-	feature, err := geojson.UnmarshalFeature(bytes)
+	geometry, err := geojson.UnmarshalGeometry(bytes)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if feature.ID == nil {
-		http.Error(w, "Missing field ID", http.StatusBadRequest)
+
+	polygon, ok := geometry.Geometry().(orb.Polygon)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Body must be a GeoJSON Polygon")
 		return
 	}
 
-	ID, ok := feature.ID.(string)
-	if !ok {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	data, err := s.engine.GetDataInPolygon(r.Context(), polygon)
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to select features")
 		return
 	}
 
-	if replace && !s.engine.Exists(ID) {
-		http.Error(w, "Feature does not exist", http.StatusNotFound)
+	s.writeSelected(w, r, featuresOf(data))
+}
+
+func (s *Storage) withinHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.awaitMinLSN(w, r) {
 		return
 	}
+	s.metrics.Selects.Add(1)
 
-	if err := s.engine.ApplyTransaction(Upsert, feature); err != nil {
-		http.Error(w, "Failed to save feature", http.StatusInternalServerError)
+	center, radius, err := parseWithinParams(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	features, err := s.engine.GetWithin(r.Context(), center, radius)
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to select features")
+		return
+	}
+
+	s.writeSelected(w, r, features)
 }
 
-func (s *Storage) deleteHandler(w http.ResponseWriter, r *http.Request) {
-	if !s.leader {
-		slog.Warn("Current node " + s.name + " is not a leader")
+// historyHandler responds with the latest versions of the feature ?id=, the current one goes first,
+// ?limit= bounds the number of versions
+func (s *Storage) historyHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ID := query.Get("id")
+	if ID == "" {
+		writeError(w, http.StatusBadRequest, "Missing id parameter")
 		return
 	}
+	limit := HistorySize
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "Invalid limit parameter")
+			return
+		}
+	}
 
-	bytes, err := io.ReadAll(r.Body)
+	features, err := s.engine.GetHistory(r.Context(), ID, limit)
+	if errors.Is(err, ErrFeatureNotFound) {
+		writeError(w, http.StatusNotFound, "Feature does not exist")
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, engineErrorStatus(err), "Failed to get history")
 		return
 	}
 
-	feature, err := geojson.UnmarshalFeature(bytes)
+	writeFeatures(w, r, features)
+}
+
+// subscribeHandler streams the applied changes as server-sent events,
+// the optional ?rect= limits them to the features within or leaving the rect
+func (s *Storage) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	rect, err := parseSubscriptionRect(r.URL.Query().Get("rect"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	if feature.ID == nil {
-		http.Error(w, "Missing field ID", http.StatusBadRequest)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming is not supported")
 		return
 	}
 
-	ID, ok := feature.ID.(string)
-	if !ok {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	subscriber := s.engine.subscribers.Subscribe(rect)
+	defer s.engine.subscribers.Unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case event, ok := <-subscriber.events:
+			if !ok {
+				return // dropped as a slow consumer
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				slog.Error("Failed to marshal change event", "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.LSN, event.Action, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// watchHandler streams the applied changes over websocket, the client sends WatchMessage first
+// and the connection is closed if the client is too slow to read the changes
+func (s *Storage) watchHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("Upgrade error", "error", err)
 		return
 	}
+	defer conn.Close()
 
-	if !s.engine.Exists(ID) {
-		http.Error(w, "Feature does not exist", http.StatusNotFound)
+	var message WatchMessage
+	_ = conn.SetReadDeadline(time.Now().Add(WatchTimeout))
+	err = conn.ReadJSON(&message)
+	var rect *orb.Bound
+	if err == nil {
+		rect, err = message.bound()
+	}
+	if err != nil {
+		closeWatcher(conn, websocket.ClosePolicyViolation, "Invalid subscribe message: "+err.Error())
 		return
 	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	subscriber := s.engine.subscribers.Subscribe(rect)
+	defer s.engine.subscribers.Unsubscribe(subscriber)
+
+	// the client messages are discarded, reading detects the closed connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
 
-	if err := s.engine.ApplyTransaction(Delete, feature); err != nil {
-		http.Error(w, "Failed to delete feature", http.StatusInternalServerError)
+	for {
+		select {
+		case <-closed:
+			return
+		case <-s.ctx.Done():
+			closeWatcher(conn, websocket.CloseGoingAway, "Node "+s.name+" is stopped")
+			return
+		case event, ok := <-subscriber.events:
+			if !ok {
+				closeWatcher(conn, websocket.CloseTryAgainLater, "Too slow to read the changes")
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(WatchTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		}
 	}
+}
 
-	w.WriteHeader(http.StatusOK)
+func closeWatcher(conn *websocket.Conn, code int, text string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(WatchTimeout))
+}
+
+// parseSubscriptionRect returns nil for the empty rect, so the subscriber gets all the changes
+func parseSubscriptionRect(rectParam string) (*orb.Bound, error) {
+	if rectParam == "" {
+		return nil, nil
+	}
+	coordinates, err := parseRectParam(rectParam)
+	if err != nil {
+		return nil, err
+	}
+	return &orb.Bound{Min: orb.Point{coordinates[0], coordinates[1]}, Max: orb.Point{coordinates[2], coordinates[3]}}, nil
 }
 
-func (s *Storage) snapshotHandler(w http.ResponseWriter, _ *http.Request) {
-	if err := s.engine.MakeSnapshot(); err != nil {
-		http.Error(w, "Failed to make snapshot", http.StatusInternalServerError)
+func (s *Storage) extentHandler(w http.ResponseWriter, r *http.Request) {
+	extent, ok, err := s.engine.Extent(r.Context())
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to get extent")
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	bytes, err := json.Marshal(&Extent{extent[0], extent[1], extent[2], extent[3]})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(bytes); err != nil {
+		slog.Error("Failed to respond with extent", "error", err)
+	}
 }
 
-// utils
+func (s *Storage) insertHandler(w http.ResponseWriter, r *http.Request) {
+	s.upsertHandler(w, r, false)
+}
 
-func parseRectParam(rectParam string) ([4]float64, error) {
-	coordinates := strings.Split(rectParam, ",")
-	if len(coordinates) != 4 {
-		return [4]float64{}, fmt.Errorf("rect parameter must contain exactly 4 values")
+func (s *Storage) replaceHandler(w http.ResponseWriter, r *http.Request) {
+	s.upsertHandler(w, r, true)
+}
+
+func (s *Storage) upsertHandler(w http.ResponseWriter, r *http.Request, replace bool) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
 	}
 
-	var result [4]float64
-	for i, str := range coordinates {
-		value, err := strconv.ParseFloat(str, 64)
-		if err != nil {
-			return [4]float64{}, err
-		}
-		result[i] = value
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+
+	feature, err := geojson.UnmarshalFeature(bytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateFeature(feature, s.wgs84); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ID := feature.ID.(string)
+
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if ifMatch := r.Header.Get("If-Match"); replace && ifMatch != "" {
+		expectedLSN, err := strconv.ParseUint(strings.Trim(ifMatch, `"`), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "If-Match must be an LSN")
+			return
+		}
+
+		lsn, err := s.engine.ApplyTransactionIfMatch(r.Context(), Upsert, feature, expectedLSN, idempotencyKey)
+		switch {
+		case errors.Is(err, ErrAlreadyApplied):
+			s.setCommittedLSN(w, lsn)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(http.StatusOK)
+			return
+		case err != nil:
+			writeApplyError(w, err, "Failed to save feature")
+			return
+		}
+
+		s.metrics.Replaces.Add(1)
+		s.setCommittedLSN(w, lsn)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if replace {
+		exists, err := s.engine.Exists(r.Context(), ID)
+		if err != nil {
+			writeError(w, engineErrorStatus(err), "Failed to check feature")
+			return
+		}
+		if !exists {
+			writeError(w, http.StatusNotFound, "Feature does not exist")
+			return
+		}
+	}
+
+	lsn, created, err := s.engine.Upsert(r.Context(), Upsert, feature, idempotencyKey)
+	switch {
+	case errors.Is(err, ErrAlreadyApplied):
+		s.setCommittedLSN(w, lsn)
+		w.Header().Set("Idempotent-Replayed", "true") // the retry gets the response of the original request
+		w.WriteHeader(http.StatusOK)
+		return
+	case err != nil:
+		writeApplyError(w, err, "Failed to save feature")
+		return
+	}
+
+	if replace {
+		s.metrics.Replaces.Add(1)
+	} else {
+		s.metrics.Inserts.Add(1)
+	}
+
+	s.setCommittedLSN(w, lsn)
+	if created && !replace {
+		location := &url.URL{Path: "/feature", RawQuery: url.Values{"id": {ID}}.Encode()}
+		w.Header().Set("Location", location.String())
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// featureHandler returns the stored feature by ?id=
+func (s *Storage) featureHandler(w http.ResponseWriter, r *http.Request) {
+	ID := r.URL.Query().Get("id")
+	if ID == "" {
+		writeError(w, http.StatusBadRequest, "Missing id parameter")
+		return
+	}
+
+	feature, lsn, err := s.engine.GetFeature(r.Context(), ID)
+	if errors.Is(err, ErrFeatureNotFound) {
+		writeError(w, http.StatusNotFound, "Feature does not exist")
+		return
+	}
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to get feature")
+		return
+	}
+	if notModified(w, r, `"`+strconv.FormatUint(lsn, 10)+`"`, time.Time{}) {
+		return // the ETag is the LSN accepted by If-Match of the replace
+	}
+
+	data, err := feature.MarshalJSON()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(data); err != nil {
+		slog.Error("Failed to respond with feature", "error", err)
+	}
+}
+
+// patchHandler merges {"id": ..., "properties": {...}} into the stored feature keeping its geometry
+func (s *Storage) patchHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	var patch Patch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		writeError(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+	if patch.ID == "" {
+		writeError(w, http.StatusBadRequest, "Missing field ID")
+		return
+	}
+	if _, _, err := expiresAt(&geojson.Feature{Properties: patch.Properties}); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lsn, err := s.engine.Patch(r.Context(), &patch)
+	if err != nil {
+		writeApplyError(w, err, "Failed to patch feature")
+		return
+	}
+	s.metrics.Replaces.Add(1)
+
+	s.setCommittedLSN(w, lsn)
+	w.WriteHeader(http.StatusOK)
+}
+
+// moveHandler replaces the geometry of the stored feature by {"id": ..., "geometry": {...}} keeping its properties
+func (s *Storage) moveHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	var move Move
+	if err := json.NewDecoder(r.Body).Decode(&move); err != nil {
+		writeError(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+	if move.ID == "" {
+		writeError(w, http.StatusBadRequest, "Missing field ID")
+		return
+	}
+	if err := validateGeometry(move.geometry(), s.wgs84); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lsn, err := s.engine.Move(r.Context(), &move)
+	if err != nil {
+		writeApplyError(w, err, "Failed to move feature")
+		return
+	}
+	s.metrics.Replaces.Add(1)
+
+	s.setCommittedLSN(w, lsn)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Storage) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	if ID := r.URL.Query().Get("id"); ID != "" {
+		s.deleteByIDHandler(w, r, ID)
+		return
+	}
+
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+
+	feature, err := geojson.UnmarshalFeature(bytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if feature.ID == nil {
+		writeError(w, http.StatusBadRequest, "Missing field ID")
+		return
+	}
+
+	ID, ok := feature.ID.(string)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Field ID must be a string")
+		return
+	}
+
+	exists, err := s.engine.Exists(r.Context(), ID)
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to check feature")
+		return
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "Feature does not exist")
+		return
+	}
+
+	lsn, err := s.engine.ApplyTransaction(r.Context(), Delete, feature, "")
+	if err != nil {
+		writeApplyError(w, err, "Failed to delete feature")
+		return
+	}
+	s.metrics.Deletes.Add(1)
+
+	s.setCommittedLSN(w, lsn)
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteByIDHandler deletes the feature without a body, the engine takes its stored geometry
+func (s *Storage) deleteByIDHandler(w http.ResponseWriter, r *http.Request, ID string) {
+	lsn, err := s.engine.DeleteByID(r.Context(), ID)
+	if err != nil {
+		writeApplyError(w, err, "Failed to delete feature")
+		return
+	}
+	s.metrics.Deletes.Add(1)
+
+	s.setCommittedLSN(w, lsn)
+	w.WriteHeader(http.StatusOK)
+}
+
+// truncateHandler deletes all the features of the node
+func (s *Storage) truncateHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	lsn, err := s.engine.Truncate(r.Context())
+	if err != nil {
+		writeApplyError(w, err, "Failed to truncate features")
+		return
+	}
+
+	s.setCommittedLSN(w, lsn)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Storage) exportHandler(w http.ResponseWriter, r *http.Request) {
+	features, err := s.engine.Export(r.Context())
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to export features")
+		return
+	}
+
+	writeFeatures(w, r, features)
+}
+
+// importHandler upserts the features of the FeatureCollection, the ones with an invalid ID or geometry
+// are skipped, ?mode=replace deletes the stored features which are not in the collection
+func (s *Storage) importHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	replace, err := parseImportMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(bytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	valid := make([]*geojson.Feature, 0, len(fc.Features))
+	skipped := 0
+	for _, feature := range fc.Features {
+		if err := s.validateImported(feature); err != nil {
+			slog.Warn("Skipping imported feature", "node", s.name, "id", feature.ID, "error", err)
+			skipped++
+			continue
+		}
+		valid = append(valid, feature)
+	}
+
+	result, err := s.engine.Import(r.Context(), valid, replace)
+	result.Skipped = skipped
+	s.metrics.Inserts.Add(uint64(result.Imported))
+	s.metrics.Deletes.Add(uint64(result.Deleted))
+	if result.LSN > 0 {
+		s.setCommittedLSN(w, result.LSN) // the features imported before a failure are committed as well
+	}
+	if err != nil {
+		writeApplyError(w, err, fmt.Sprintf("Failed to import features after %d of them", result.Imported))
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(data); err != nil {
+		slog.Error("Failed to respond with import result", "error", err)
+	}
+}
+
+// BatchOpResult is the result of an operation of /batch, Status is the one the single request would get
+type BatchOpResult struct {
+	Op     string `json:"op"`
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	LSN    uint64 `json:"lsn,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchHandler applies an array of {op, feature} as a single group, the replicas never see a part of it.
+// The invalid batch is rejected as a whole, ?on_error=stop applies nothing if any operation fails
+// and is the default, ?on_error=continue skips the failed operations
+func (s *Storage) batchHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	var stopOnError bool
+	switch r.URL.Query().Get("on_error") {
+	case "", "stop":
+		stopOnError = true
+	case "continue":
+	default:
+		writeError(w, http.StatusBadRequest, "on_error must be stop or continue")
+		return
+	}
+
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+	var ops []BatchOp
+	if err := json.Unmarshal(bytes, &ops); err != nil {
+		writeError(w, http.StatusBadRequest, "Body must be an array of {op, feature}: "+err.Error())
+		return
+	}
+	for i, op := range ops {
+		if err := s.validateBatchOp(op); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Operation %d: %v", i, err))
+			return
+		}
+	}
+
+	applied, err := s.engine.Batch(r.Context(), ops, stopOnError)
+	if err != nil && applied == nil {
+		writeError(w, engineErrorStatus(err), "Failed to apply batch")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to save batch: "+err.Error())
+		return
+	}
+
+	results := make([]BatchOpResult, len(ops))
+	var lsn uint64
+	for i, op := range ops {
+		results[i] = BatchOpResult{Op: op.Op, ID: op.Feature.ID.(string), LSN: applied[i].lsn}
+		switch err := applied[i].err; {
+		case err == nil:
+			results[i].Status = http.StatusOK
+			if op.Op == BatchInsert && applied[i].created {
+				results[i].Status = http.StatusCreated
+			}
+			lsn = max(lsn, applied[i].lsn)
+			s.countBatchOp(op.Op)
+		case errors.Is(err, ErrFeatureNotFound):
+			results[i].Status, results[i].Error = http.StatusNotFound, "Feature does not exist"
+		case errors.Is(err, ErrBatchAborted):
+			results[i].Status, results[i].Error = http.StatusFailedDependency, err.Error()
+		default:
+			results[i].Status, results[i].Error = applyErrorStatus(err), err.Error()
+		}
+	}
+	if lsn > 0 {
+		s.setCommittedLSN(w, lsn)
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(data); err != nil {
+		slog.Error("Failed to respond with batch results", "error", err)
+	}
+}
+
+// validateBatchOp checks the operation like the single request would, the deletion needs only the ID
+func (s *Storage) validateBatchOp(op BatchOp) error {
+	if op.Feature == nil {
+		return errors.New("missing feature")
+	}
+	switch op.Op {
+	case BatchInsert, BatchReplace:
+		return validateFeature(op.Feature, s.wgs84)
+	case BatchDelete:
+		if _, ok := op.Feature.ID.(string); !ok {
+			return errors.New("field ID must be a string")
+		}
+		return nil
+	default:
+		return fmt.Errorf("op must be %s, %s or %s", BatchInsert, BatchReplace, BatchDelete)
+	}
+}
+
+func (s *Storage) countBatchOp(op string) {
+	switch op {
+	case BatchInsert:
+		s.metrics.Inserts.Add(1)
+	case BatchReplace:
+		s.metrics.Replaces.Add(1)
+	case BatchDelete:
+		s.metrics.Deletes.Add(1)
+	}
+}
+
+func (s *Storage) validateImported(feature *geojson.Feature) error {
+	if err := validateFeature(feature, s.wgs84); err != nil {
+		return err
+	}
+	if feature.ID == "" {
+		return fmt.Errorf("field ID must be a non-empty string")
+	}
+	return nil
+}
+
+// ValidationReport tells which features of the collection would be inserted and why the others would not
+type ValidationReport struct {
+	Valid    int                 `json:"valid"`
+	Invalid  int                 `json:"invalid"`
+	Features []FeatureValidation `json:"features"`
+}
+
+type FeatureValidation struct {
+	Index int    `json:"index"`
+	ID    any    `json:"id,omitempty"`
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// validateHandler checks the posted features like insert does without going to the engine
+func (s *Storage) validateHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+	fc, err := geojson.UnmarshalFeatureCollection(bytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	report := ValidationReport{Features: make([]FeatureValidation, 0, len(fc.Features))}
+	for i, feature := range fc.Features {
+		validation := FeatureValidation{Index: i, ID: feature.ID, Valid: true}
+		if err := validateFeature(feature, s.wgs84); err != nil {
+			validation.Valid, validation.Error = false, err.Error()
+			report.Invalid++
+		} else {
+			report.Valid++
+		}
+		report.Features = append(report.Features, validation)
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(data); err != nil {
+		slog.Error("Failed to respond with validation report", "error", err)
+	}
+}
+
+// parseImportMode returns true for the replace mode, the default mode appends the features
+func parseImportMode(mode string) (bool, error) {
+	switch mode {
+	case "", "append":
+		return false, nil
+	case "replace":
+		return true, nil
+	default:
+		return false, fmt.Errorf("mode parameter must be append or replace")
+	}
+}
+
+func (s *Storage) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	written, err := s.engine.MakeSnapshot(r.Context())
+	if errors.Is(err, ErrSnapshotRunning) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to make snapshot")
+		return
+	}
+
+	w.Header().Set("X-Snapshot-Written", strconv.FormatBool(written))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Storage) snapshotsHandler(w http.ResponseWriter, _ *http.Request) {
+	snapshots, err := s.engine.Snapshots()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	bytes, err := json.Marshal(snapshots)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(bytes); err != nil {
+		slog.Error("Failed to respond with snapshots", "error", err)
+	}
+}
+
+// restoreHandler replaces the stored features with the snapshot given by its name from /snapshots
+func (s *Storage) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	name := r.URL.Query().Get("snapshot")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, "snapshot parameter is required")
+		return
+	}
+
+	result, err := s.engine.Restore(r.Context(), name)
+	s.metrics.Inserts.Add(uint64(result.Imported))
+	s.metrics.Deletes.Add(uint64(result.Deleted))
+	if errors.Is(err, ErrNoSnapshot) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, ErrSnapshotRunning) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if result.LSN > 0 {
+		s.setCommittedLSN(w, result.LSN)
+	}
+	if err != nil {
+		writeError(w, engineErrorStatus(err), fmt.Sprintf("Failed to restore features after %d of them", result.Imported))
+		return
+	}
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(bytes); err != nil {
+		slog.Error("Failed to respond with restore result", "error", err)
+	}
+}
+
+// resyncHandler re-sends the whole state of the leader to the replica given by its name,
+// the replica overwrites the features diverged from the leader
+func (s *Storage) resyncHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.IsLeader() {
+		s.redirectToLeader(w, r)
+		return
+	}
+
+	replica := r.URL.Query().Get("replica")
+	if replica == "" {
+		writeError(w, http.StatusBadRequest, "replica parameter is required")
+		return
+	}
+
+	result, err := s.engine.Resync(r.Context(), replica)
+	if errors.Is(err, ErrNoReplica) {
+		writeError(w, http.StatusNotFound, "Replica "+replica+" is not connected")
+		return
+	}
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to re-sync replica "+replica)
+		return
+	}
+
+	bytes, err := json.Marshal(&result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(bytes); err != nil {
+		slog.Error("Failed to respond with re-sync result", "error", err)
+	}
+}
+
+func (s *Storage) compactHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := s.engine.CompactWAL(r.Context())
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to compact WAL")
+		return
+	}
+
+	bytes, err := json.Marshal(&result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(bytes); err != nil {
+		slog.Error("Failed to respond with compaction result", "error", err)
+	}
+}
+
+// healthHandler is 200 whenever the process is up, the recovering node reports it in the body,
+// whether the node may be routed to is told by /ready
+func (s *Storage) healthHandler(w http.ResponseWriter, _ *http.Request) {
+	state := s.engine.State()
+	bytes, err := json.Marshal(&HealthResponse{
+		Name:       s.name,
+		Leader:     s.IsLeader(),
+		LSN:        state.Vclock[s.engine.origin()],
+		Vclock:     state.Vclock,
+		Features:   state.Features,
+		Recovering: state.Recovering,
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(bytes); err != nil {
+		slog.Error("Failed to respond with health", "error", err)
+	}
+}
+
+// readyHandler responds with 503 until the node can serve the requests: the engine has replayed the WAL
+// and a follower hears from its leader, so it receives the changes. Unlike /health, which is 200
+// whenever the process is up, a not ready node is alive but should not be routed to
+func (s *Storage) readyHandler(w http.ResponseWriter, _ *http.Request) {
+	switch {
+	case s.ctx.Err() != nil:
+		writeError(w, http.StatusServiceUnavailable, "Node "+s.name+" is stopped")
+	case !s.engine.Ready():
+		writeError(w, http.StatusServiceUnavailable, "Node "+s.name+" is restoring the data")
+	case !s.IsLeader() && len(s.replicas) > 0 && !s.heartbeats.Alive(s.heartbeats.Leader()):
+		writeError(w, http.StatusServiceUnavailable, "Node "+s.name+" is not connected to a leader")
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// vclockHandler responds with the highest applied LSN of every origin,
+// the clock is read from the state published by the engine after each apply
+func (s *Storage) vclockHandler(w http.ResponseWriter, _ *http.Request) {
+	bytes, err := json.Marshal(s.engine.State().Vclock)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(bytes); err != nil {
+		slog.Error("Failed to respond with vclock", "error", err)
+	}
+}
+
+func (s *Storage) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.engine.Stats(r.Context())
+	if err != nil {
+		writeError(w, engineErrorStatus(err), "Failed to get stats")
+		return
+	}
+
+	bytes, err := json.Marshal(stats)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(bytes); err != nil {
+		slog.Error("Failed to respond with stats", "error", err)
+	}
+}
+
+func (s *Storage) metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value any
+	}{
+		{"storage_inserts_total", "counter", "Total number of inserted features.", s.metrics.Inserts.Load()},
+		{"storage_replaces_total", "counter", "Total number of replaced features.", s.metrics.Replaces.Load()},
+		{"storage_deletes_total", "counter", "Total number of deleted features.", s.metrics.Deletes.Load()},
+		{"storage_selects_total", "counter", "Total number of served selects.", s.metrics.Selects.Load()},
+		{"storage_snapshots_total", "counter", "Total number of snapshots made.", s.metrics.Snapshots.Load()},
+		{"storage_features", "gauge", "Current number of stored features.", s.engine.State().Features},
+		{"storage_wal_bytes", "gauge", "Current size of the WAL file in bytes.", s.metrics.WALBytes.Load()},
+		{"storage_wal_syncs_total", "counter", "Total number of WAL flushes to the disk.", s.metrics.WALSyncs.Load()},
+		{"storage_engine_queue_depth", "gauge", "Current number of commands waiting for the engine.", s.engine.QueueDepth()},
+		{"storage_replication_connections", "gauge", "Current number of replication connections.", s.connections.Len() + s.engine.connections.Len()},
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		if err := writeMetric(w, m.name, m.kind, m.help, s.name, m.value); err != nil {
+			slog.Error("Failed to respond with metrics", "error", err)
+			return
+		}
+	}
+}
+
+// utils
+
+// ReplicasAt maps the replicas to the same address, it is the case
+// when all of them are served by a single process
+func ReplicasAt(address string, names ...string) map[string]string {
+	replicas := make(map[string]string, len(names))
+	for _, name := range names {
+		replicas[name] = "http://" + address
+	}
+	return replicas
+}
+
+func replicaNames(replicas map[string]string) []string {
+	names := make([]string, 0, len(replicas))
+	for name := range replicas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// withEngineTimeout limits the time the handler may wait for the engine,
+// the request context is also done when the client disconnects
+func withEngineTimeout(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), EngineTimeout)
+		defer cancel()
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// vclockETag is the weak ETag of the data, it changes with every applied transaction
+func vclockETag(vclock map[string]uint64) string {
+	names := make([]string, 0, len(vclock))
+	for name := range vclock {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := fnv.New64a()
+	for _, name := range names {
+		_, _ = fmt.Fprintf(hash, "%s:%d;", name, vclock[name])
+	}
+	return fmt.Sprintf(`W/"%x"`, hash.Sum64())
+}
+
+// expiring checks whether any of the features expires, such a result changes when the feature
+// expires before the sweep deletes it by a transaction, so it is not validated by the vclock
+func expiring(features []*geojson.Feature) bool {
+	for _, feature := range features {
+		if _, ok := feature.Properties[ExpiresAtProperty]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the validators of the response and writes 304 if the request has them already:
+// If-None-Match is compared weakly and takes precedence over If-Modified-Since,
+// the zero modified time is unknown and is not sent
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	matched := false
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				matched = true
+			}
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() {
+		matched = !modified.Truncate(time.Second).After(since)
+	}
+
+	if matched {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return matched
+}
+
+// withMaxBody fails the reads of the request body after limit bytes
+func withMaxBody(limit int64, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		handler(w, r)
+	}
+}
+
+// bodyErrorStatus is 413 if the request body is over the limit and 400 otherwise
+func bodyErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// engineErrorStatus is 503 if the engine is stopped or has not responded in time and 500 otherwise
+func engineErrorStatus(err error) int {
+	if errors.Is(err, ErrEngineStopped) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// applyErrorStatus maps the rejections of a write to the client errors and the failures to persist it to 500
+func applyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidFeature):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrFeatureNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrKeyReused):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrWALWrite):
+		return http.StatusInternalServerError
+	}
+	return engineErrorStatus(err)
+}
+
+// writeApplyError responds with the status of the failed write, the rejections are explained to the client,
+// the failures are reported without the internal details except whether the WAL is not written
+func writeApplyError(w http.ResponseWriter, err error, failed string) {
+	status := applyErrorStatus(err)
+	switch {
+	case errors.Is(err, ErrFeatureNotFound):
+		writeError(w, status, "Feature does not exist")
+	case status < http.StatusInternalServerError:
+		writeError(w, status, failed+": "+err.Error())
+	case errors.Is(err, ErrWALWrite):
+		writeError(w, status, failed+": "+ErrWALWrite.Error())
+	default:
+		writeError(w, status, failed)
+	}
+}
+
+func featuresOf(data map[string]*geojson.Feature) []*geojson.Feature {
+	features := make([]*geojson.Feature, 0, len(data))
+	for _, f := range data {
+		features = append(features, f)
+	}
+	return features
+}
+
+// sortByID orders the features so that consecutive selects return them in the same order
+func sortByID(features []*geojson.Feature) {
+	sort.Slice(features, func(i, j int) bool {
+		return features[i].ID.(string) < features[j].ID.(string)
+	})
+}
+
+// wantsSorted checks whether the client did not opt out of sorting by ?sort=none
+func wantsSorted(r *http.Request) bool {
+	return r.URL.Query().Get("sort") != "none"
+}
+
+// projectProperties returns the copies of the features with only the given properties,
+// the missing ones are omitted and the geometry is shared with the original features
+func projectProperties(features []*geojson.Feature, fields []string) []*geojson.Feature {
+	projected := make([]*geojson.Feature, 0, len(features))
+	for _, feature := range features {
+		clone := *feature
+		clone.Properties = make(geojson.Properties, len(fields))
+		for _, field := range fields {
+			if value, ok := feature.Properties[field]; ok {
+				clone.Properties[field] = value
+			}
+		}
+		projected = append(projected, &clone)
+	}
+	return projected
+}
+
+// ErrorResponse is the body of every failed request
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// writeError responds with the status code and the message as JSON
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(ErrorResponse{Error: msg, Code: code}); err != nil {
+		slog.Error("Failed to respond with error", "error", err)
+	}
+}
+
+// wantsNDJSON checks whether the client asked for one feature per line
+// by the Accept header or the format query parameter
+func wantsNDJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// writeSelected responds with the selected features shaped by the encoding of the storage
+// and the request, the export and the history are never rounded
+func (s *Storage) writeSelected(w http.ResponseWriter, r *http.Request, features []*geojson.Feature) {
+	encoding, err := s.encoding.withQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeFeatures(w, r, encoding.apply(features))
+}
+
+func writeFeatures(w http.ResponseWriter, r *http.Request, features []*geojson.Feature) {
+	if wantsNDJSON(r) {
+		writeNDJSON(w, features)
+		return
+	}
+	var bbox geojson.BBox
+	if wantsBBox(r) {
+		bbox = boundOf(features)
+	}
+	writeFeatureCollection(w, features, bbox)
+}
+
+// wantsBBox checks whether the collection must have the bbox of its features, NDJSON has none
+func wantsBBox(r *http.Request) bool {
+	want, _ := strconv.ParseBool(r.URL.Query().Get("bbox"))
+	return want
+}
+
+// boundOf returns the bbox of the feature geometries, nil if there are none
+func boundOf(features []*geojson.Feature) geojson.BBox {
+	var bound orb.Bound
+	found := false
+	for _, f := range features {
+		if f.Geometry == nil {
+			continue
+		}
+		if !found {
+			bound, found = f.Geometry.Bound(), true
+		} else {
+			bound = bound.Union(f.Geometry.Bound())
+		}
+	}
+	if !found {
+		return nil
+	}
+	return geojson.NewBBox(bound)
+}
+
+// writeNDJSON streams the features one per line flushing after each of them
+func writeNDJSON(w http.ResponseWriter, features []*geojson.Feature) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+
+	encoder := json.NewEncoder(w)
+	for _, f := range features {
+		if err := encoder.Encode(f); err != nil {
+			slog.Error("Failed to respond with features", "error", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// writeFeatureCollection streams the encoding of the features as a GeoJSON FeatureCollection
+// one by one instead of marshalling the whole collection, so the encoded response is not buffered.
+// The features themselves are still materialised by the engine before, the bbox, the sorting and
+// the validators need all of them. The bbox is computed beforehand since it precedes the features
+func writeFeatureCollection(w http.ResponseWriter, features []*geojson.Feature, bbox geojson.BBox) {
+	w.Header().Set("Content-Type", "application/json")
+	flusher, _ := w.(http.Flusher)
+
+	header := `{"type":"FeatureCollection",`
+	if bbox != nil {
+		data, err := json.Marshal(bbox)
+		if err != nil {
+			slog.Error("Failed to respond with features", "error", err)
+			return
+		}
+		header += `"bbox":` + string(data) + ","
+	}
+	if _, err := io.WriteString(w, header+`"features":[`); err != nil {
+		slog.Error("Failed to respond with features", "error", err)
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	written := 0
+	for _, f := range features {
+		if written > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				slog.Error("Failed to respond with features", "error", err)
+				return
+			}
+		}
+		if err := encoder.Encode(f); err != nil {
+			slog.Error("Failed to respond with features", "error", err)
+			return
+		}
+		written++
+		if flusher != nil && written%StreamChunkSize == 0 {
+			flusher.Flush()
+		}
+	}
+
+	if _, err := io.WriteString(w, "]}"); err != nil {
+		slog.Error("Failed to respond with features", "error", err)
+	}
+}
+
+func parseRectParam(rectParam string) ([4]float64, error) {
+	coordinates := strings.Split(rectParam, ",")
+	if len(coordinates) != 4 {
+		return [4]float64{}, fmt.Errorf("rect parameter must contain exactly 4 values")
+	}
+
+	var result [4]float64
+	for i, str := range coordinates {
+		value, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return [4]float64{}, err
+		}
+		result[i] = value
+	}
+	// minX > maxX crosses the antimeridian, the latitude does not wrap
+	if result[1] > result[3] {
+		return [4]float64{}, fmt.Errorf("rect minY %v is greater than maxY %v", result[1], result[3])
 	}
 
 	return result, nil
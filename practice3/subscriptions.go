@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// SubscriberBufferSize is the number of events buffered for a subscriber,
+// the subscriber is dropped when it falls further behind
+const SubscriberBufferSize = 256
+
+// WatchTimeout bounds waiting for the subscribe message and writing an event to a watcher
+const WatchTimeout = 5 * time.Second
+
+// WatchMessage is the first message of the /watch client, the empty rect subscribes to all the changes
+type WatchMessage struct {
+	Rect []float64 `json:"rect"`
+}
+
+func (m *WatchMessage) bound() (*orb.Bound, error) {
+	if m.Rect == nil {
+		return nil, nil
+	}
+	if len(m.Rect) != 4 {
+		return nil, fmt.Errorf("rect must contain exactly 4 values")
+	}
+	return &orb.Bound{Min: orb.Point{m.Rect[0], m.Rect[1]}, Max: orb.Point{m.Rect[2], m.Rect[3]}}, nil
+}
+
+// ChangeEvent is a change of the feature streamed to the subscribers
+type ChangeEvent struct {
+	Action  ActionType       `json:"action"`
+	Name    string           `json:"name"`
+	LSN     uint64           `json:"lsn"`
+	Feature *geojson.Feature `json:"feature"`
+
+	// bounds are the new and the previous bounds of the feature, so the subscriber
+	// is notified when the feature leaves its rect as well
+	bounds []orb.Bound
+}
+
+// Subscriber receives the events within rect or all of them if rect is nil,
+// events is closed when the subscriber is dropped
+type Subscriber struct {
+	rect   *orb.Bound
+	events chan *ChangeEvent
+}
+
+func (s *Subscriber) wants(event *ChangeEvent) bool {
+	if s.rect == nil {
+		return true
+	}
+	for _, bound := range event.bounds {
+		if bound.Intersects(*s.rect) {
+			return true
+		}
+	}
+	return false
+}
+
+// SubscriberRegistry fans out the applied transactions to the subscribers without blocking the engine
+type SubscriberRegistry struct {
+	mu          sync.Mutex
+	subscribers map[*Subscriber]struct{}
+}
+
+func NewSubscriberRegistry() *SubscriberRegistry {
+	return &SubscriberRegistry{subscribers: make(map[*Subscriber]struct{})}
+}
+
+func (r *SubscriberRegistry) Subscribe(rect *orb.Bound) *Subscriber {
+	subscriber := &Subscriber{rect: rect, events: make(chan *ChangeEvent, SubscriberBufferSize)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribers[subscriber] = struct{}{}
+	return subscriber
+}
+
+func (r *SubscriberRegistry) Unsubscribe(subscriber *Subscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.subscribers[subscriber]; ok {
+		close(subscriber.events)
+		delete(r.subscribers, subscriber)
+	}
+}
+
+// Close ends the streams of all the subscribers
+func (r *SubscriberRegistry) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for subscriber := range r.subscribers {
+		close(subscriber.events)
+		delete(r.subscribers, subscriber)
+	}
+}
+
+func (r *SubscriberRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.subscribers)
+}
+
+// Publish drops the subscribers whose buffer is full
+func (r *SubscriberRegistry) Publish(event *ChangeEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for subscriber := range r.subscribers {
+		if !subscriber.wants(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			slog.Warn("Subscriber is too slow, dropping it", "lsn", event.LSN)
+			close(subscriber.events)
+			delete(r.subscribers, subscriber)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/paulmach/orb/geojson"
+	"os"
+	"time"
+)
+
+// ErrBeforeSnapshot is returned for the time before the last snapshot: the WAL records
+// older than the snapshot are removed once it is written, so that state is lost
+var ErrBeforeSnapshot = errors.New("state before the last snapshot is not retained")
+
+// persistedState is the content of the snapshot and the WALs read at once by the engine,
+// the time travel replays it without touching the live state
+type persistedState struct {
+	snapshot     []byte
+	snapshotTime time.Time // zero if there is no snapshot
+	wals         [][]byte  // the rotated WAL and the WAL in the replay order
+}
+
+// readPersisted reads the data files, it runs on the engine goroutine which is the only writer
+// of the WAL and is refused during a snapshot since it replaces the files in the background
+func (e *Engine) readPersisted() (*persistedState, error) {
+	if !e.durable {
+		return nil, ErrNotDurable // there is no WAL to replay
+	}
+	if e.snapshotting {
+		return nil, ErrSnapshotRunning
+	}
+	if err := e.syncWAL(); err != nil {
+		return nil, err
+	}
+
+	state := &persistedState{}
+	if path, snapshotTime, ok := e.latestSnapshot(); ok {
+		var err error
+		state.snapshotTime = snapshotTime
+		if state.snapshot, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for _, walFile := range []string{e.rotatedWALFile(), e.walFile} {
+		wal, err := os.ReadFile(walFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		state.wals = append(state.wals, wal)
+	}
+	return state, nil
+}
+
+// at replays the transactions written to the WAL not after the given time on top of the snapshot.
+// The records without the timestamp precede the timestamps and are always replayed,
+// the records dropped by the WAL compaction are not replayed as well
+func (s *persistedState) at(at time.Time) (map[string]*geojson.Feature, error) {
+	if !s.snapshotTime.IsZero() && at.Before(s.snapshotTime) {
+		return nil, ErrBeforeSnapshot
+	}
+
+	features := make(map[string]*Feature)
+	vclock := make(map[string]uint64)
+	if s.snapshot != nil {
+		var err error
+		if features, vclock, err = decodeSnapshot(s.snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, wal := range s.wals {
+		txs, err := readWALRecords(bytes.NewReader(wal))
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range txs {
+			if tx.Timestamp != 0 && time.Unix(0, tx.Timestamp).After(at) {
+				continue
+			}
+			if tx.Lsn <= vclock[tx.origin()] {
+				continue // the replicas resend the applied transactions
+			}
+			if tx.validate() != nil {
+				continue // the engine has skipped it as well
+			}
+			vclock[tx.origin()] = tx.Lsn
+			if tx.Action == Truncate {
+				clear(features)
+				continue
+			}
+			features[tx.Feature.ID.(string)] = &Feature{Shard: tx.Shard, Name: tx.Name, LSN: tx.Lsn, Feature: tx.Feature, Deleted: tx.Action == Delete}
+		}
+	}
+
+	result := make(map[string]*geojson.Feature, len(features))
+	for ID, feature := range features {
+		if !feature.Deleted && !feature.expired(at) {
+			result[ID] = feature.Feature
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// Topology is the layout of the cluster: the nodes and the leaders of every shard
+type Topology struct {
+	Nodes   [][]string `json:"nodes"`
+	Leaders [][]string `json:"leaders"`
+
+	ring *HashRing
+}
+
+func NewTopology(nodes [][]string, leaders [][]string) *Topology {
+	return &Topology{Nodes: nodes, Leaders: leaders, ring: NewHashRing(len(nodes))}
+}
+
+// LoadTopology reads the topology from the JSON file {"nodes": [[...]], "leaders": [[...]]}
+func LoadTopology(path string) (*Topology, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var topology Topology
+	if err := json.Unmarshal(data, &topology); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if err := topology.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return NewTopology(topology.Nodes, topology.Leaders), nil
+}
+
+// validate checks that every shard has nodes and at least one leader among them
+func (t *Topology) validate() error {
+	if len(t.Nodes) == 0 {
+		return fmt.Errorf("no shards")
+	}
+	if len(t.Leaders) != len(t.Nodes) {
+		return fmt.Errorf("%d shards have leaders, want %d", len(t.Leaders), len(t.Nodes))
+	}
+	for shard, nodes := range t.Nodes {
+		if len(nodes) == 0 {
+			return fmt.Errorf("shard %d has no nodes", shard)
+		}
+		if len(t.Leaders[shard]) == 0 {
+			return fmt.Errorf("shard %d has no leader", shard)
+		}
+		for _, leader := range t.Leaders[shard] {
+			if !slices.Contains(nodes, leader) {
+				return fmt.Errorf("leader %s is not a node of shard %d", leader, shard)
+			}
+		}
+	}
+	return nil
+}
+
+// allNodes returns the nodes of every shard
+func (t *Topology) allNodes() []string {
+	nodes := make([]string, 0)
+	for _, shard := range t.Nodes {
+		nodes = append(nodes, shard...)
+	}
+	return nodes
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"github.com/paulmach/orb/geojson"
 )
 
@@ -9,11 +10,81 @@ type ActionType string
 const (
 	Upsert ActionType = "upsert"
 	Delete ActionType = "delete"
+	// Truncate deletes all the features by a single transaction without a feature
+	Truncate ActionType = "truncate"
 )
 
+// known checks whether this version can apply the action, the others are made by a newer version
+func (a ActionType) known() bool {
+	switch a {
+	case Upsert, Delete, Truncate:
+		return true
+	}
+	return false
+}
+
 type Transaction struct {
 	Action  ActionType       `json:"action"`
+	Shard   string           `json:"shard,omitempty"`
 	Name    string           `json:"name"`
 	Lsn     uint64           `json:"lsn"`
 	Feature *geojson.Feature `json:"feature"`
+
+	// Resync is set by the forced re-sync, the replica applies the transaction even if its vclock
+	// has passed the LSN, so the diverged features are overwritten by the state of the sender
+	Resync bool `json:"resync,omitempty"`
+
+	// Batch is the LSN of the last transaction of the batch the transaction is made by, the batch
+	// is written to the WAL at once and is never split between the replication messages
+	Batch uint64 `json:"batch,omitempty"`
+
+	// Timestamp is the unix time in nanoseconds when the transaction was first written to a WAL
+	Timestamp int64 `json:"timestamp,omitempty"`
+
+	// IdempotencyKey is given by the client to make retries of the transaction safe
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// origin is the vclock key of the node which made the transaction
+func (tx *Transaction) origin() string {
+	return vclockKey(tx.Shard, tx.Name)
+}
+
+// validate rejects the transaction the engine can not apply: the action must be known, the feature
+// must have a string ID, and the upsert must have a geometry, since the feature is indexed by its bounds
+func (tx *Transaction) validate() error {
+	if !tx.Action.known() {
+		return fmt.Errorf("%w %q", ErrUnknownAction, tx.Action)
+	}
+	if tx.Action == Truncate {
+		return nil
+	}
+	switch {
+	case tx.Feature == nil:
+		return fmt.Errorf("%w: missing feature", ErrInvalidFeature)
+	case tx.Feature.ID == nil:
+		return fmt.Errorf("%w: missing field ID", ErrInvalidFeature)
+	}
+	if _, ok := tx.Feature.ID.(string); !ok {
+		return fmt.Errorf("%w: field ID must be a string", ErrInvalidFeature)
+	}
+	if tx.Action == Upsert && tx.Feature.Geometry == nil {
+		return fmt.Errorf("%w: missing geometry", ErrInvalidFeature)
+	}
+	return nil
+}
+
+// sameBatch checks whether both transactions are made by the same batch
+func sameBatch(a *Transaction, b *Transaction) bool {
+	return a.Batch != 0 && a.Batch == b.Batch && a.origin() == b.origin()
+}
+
+// vclockKey namespaces the node by its shard as shard/name, since the leader of every shard
+// counts its LSNs independently and the node names are unique only within a shard.
+// The transactions without a shard are keyed by the node name
+func vclockKey(shard string, name string) string {
+	if shard == "" {
+		return name
+	}
+	return shard + "/" + name
 }
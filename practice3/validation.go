@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"math"
+)
+
+// CoordinateBounds are the plausible lon/lat ranges of the coordinates
+var CoordinateBounds = orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{180, 90}}
+
+// validateFeature runs the checks of insert: the ID is a string, the geometry is valid
+// and the expiration time is a number
+func validateFeature(feature *geojson.Feature, wgs84 bool) error {
+	if feature.ID == nil {
+		return fmt.Errorf("missing field ID")
+	}
+	if _, ok := feature.ID.(string); !ok {
+		return fmt.Errorf("field ID must be a string")
+	}
+	if err := validateGeometry(feature.Geometry, wgs84); err != nil {
+		return err
+	}
+	_, _, err := expiresAt(feature)
+	return err
+}
+
+// validateGeometry rejects geometries without points and the ones with coordinates
+// which are not finite, wgs84 also rejects the coordinates outside CoordinateBounds
+// since the projected ones break the distance and bounding box computations
+func validateGeometry(geometry orb.Geometry, wgs84 bool) error {
+	if geometry == nil {
+		return fmt.Errorf("missing geometry")
+	}
+
+	points := 0
+	var err error
+	walkPoints(geometry, func(point orb.Point) {
+		points++
+		if err != nil {
+			return
+		}
+		for _, value := range point {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				err = fmt.Errorf("coordinates %v are not finite", point)
+				return
+			}
+		}
+		if !wgs84 {
+			return
+		}
+		if lon := point.Lon(); lon < CoordinateBounds.Min.Lon() || lon > CoordinateBounds.Max.Lon() {
+			err = fmt.Errorf("longitude %v of coordinates %v is out of [%v, %v], the coordinates must be WGS84",
+				lon, point, CoordinateBounds.Min.Lon(), CoordinateBounds.Max.Lon())
+		} else if lat := point.Lat(); lat < CoordinateBounds.Min.Lat() || lat > CoordinateBounds.Max.Lat() {
+			err = fmt.Errorf("latitude %v of coordinates %v is out of [%v, %v], the coordinates must be WGS84",
+				lat, point, CoordinateBounds.Min.Lat(), CoordinateBounds.Max.Lat())
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if points == 0 {
+		return fmt.Errorf("geometry %s has no coordinates", geometry.GeoJSONType())
+	}
+	return nil
+}
+
+func walkPoints(geometry orb.Geometry, visit func(orb.Point)) {
+	switch g := geometry.(type) {
+	case orb.Point:
+		visit(g)
+	case orb.MultiPoint:
+		for _, point := range g {
+			visit(point)
+		}
+	case orb.LineString:
+		for _, point := range g {
+			visit(point)
+		}
+	case orb.MultiLineString:
+		for _, line := range g {
+			walkPoints(line, visit)
+		}
+	case orb.Ring:
+		for _, point := range g {
+			visit(point)
+		}
+	case orb.Polygon:
+		for _, ring := range g {
+			walkPoints(ring, visit)
+		}
+	case orb.MultiPolygon:
+		for _, polygon := range g {
+			walkPoints(polygon, visit)
+		}
+	case orb.Bound:
+		visit(g.Min)
+		visit(g.Max)
+	case orb.Collection:
+		for _, child := range g {
+			walkPoints(child, visit)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// WALFormat is the encoding of the WAL records
+type WALFormat int
+
+const (
+	// TextWAL writes one JSON transaction per line
+	TextWAL WALFormat = iota
+	// BinaryWAL writes a 4-byte big-endian length followed by the JSON transaction
+	BinaryWAL
+)
+
+// WALSyncPolicy is when the appended WAL records are flushed to the disk by fsync,
+// the records which are not flushed may be lost if the machine crashes
+type WALSyncPolicy struct {
+	mode     walSyncMode
+	interval time.Duration
+}
+
+type walSyncMode int
+
+const (
+	syncNever walSyncMode = iota
+	syncEveryWrite
+	syncInterval
+)
+
+var (
+	// SyncNever leaves flushing the WAL to the operating system
+	SyncNever = WALSyncPolicy{mode: syncNever}
+	// SyncEveryWrite flushes the WAL before a write is acknowledged
+	SyncEveryWrite = WALSyncPolicy{mode: syncEveryWrite}
+
+	// DefaultWALSync is the policy of the storage nodes
+	DefaultWALSync = SyncNever
+)
+
+// SyncInterval flushes the records appended to the WAL every interval in a single group commit
+func SyncInterval(interval time.Duration) WALSyncPolicy {
+	return WALSyncPolicy{mode: syncInterval, interval: interval}
+}
+
+func (p WALSyncPolicy) String() string {
+	switch p.mode {
+	case syncNever:
+		return "never"
+	case syncEveryWrite:
+		return "every_write"
+	case syncInterval:
+		return "interval=" + p.interval.String()
+	default:
+		return fmt.Sprintf("WALSyncPolicy(%d)", int(p.mode))
+	}
+}
+
+// ParseWALSync reads the policy written by String, the interval may also be given alone, e.g. 10ms
+func ParseWALSync(value string) (WALSyncPolicy, error) {
+	switch value {
+	case "never":
+		return SyncNever, nil
+	case "every_write":
+		return SyncEveryWrite, nil
+	}
+	interval, err := time.ParseDuration(strings.TrimPrefix(value, "interval="))
+	if err != nil || interval <= 0 {
+		return WALSyncPolicy{}, fmt.Errorf("unknown WAL sync policy %q", value)
+	}
+	return SyncInterval(interval), nil
+}
+
+// MaxWALRecordSize protects from allocating a huge buffer for a corrupted length
+const MaxWALRecordSize = 64 << 20
+
+// errCorruptedRecord is the binary record whose length cannot be trusted, so the next record cannot be found
+var errCorruptedRecord = errors.New("corrupted WAL record")
+
+func (f WALFormat) String() string {
+	switch f {
+	case TextWAL:
+		return "text"
+	case BinaryWAL:
+		return "binary"
+	default:
+		return fmt.Sprintf("WALFormat(%d)", int(f))
+	}
+}
+
+func ParseWALFormat(value string) (WALFormat, error) {
+	for _, format := range []WALFormat{TextWAL, BinaryWAL} {
+		if format.String() == value {
+			return format, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown WAL format %q", value)
+}
+
+// encodeWALRecord returns the bytes appended to the WAL for the transaction
+func encodeWALRecord(format WALFormat, tx *Transaction) ([]byte, error) {
+	data, err := json.Marshal(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case TextWAL:
+		return append(data, '\n'), nil
+	case BinaryWAL:
+		record := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(record, uint32(len(data)))
+		return append(record, data...), nil
+	default:
+		return nil, fmt.Errorf("unknown WAL format %v", format)
+	}
+}
+
+// readWALRecords decodes the transactions of both formats, the format is detected by
+// every record since a text WAL may be continued by binary records after migration,
+// a truncated last record is dropped and corrupted text lines are skipped, the records
+// from a corrupted binary length on are dropped since their boundaries are lost
+func readWALRecords(r io.Reader) ([]Transaction, error) {
+	wal, _, err := readWALRecordEnds(r)
+	return wal, err
+}
+
+// readWALRecordEnds is readWALRecords which also returns the offset after every transaction,
+// so the WAL can be cut after the last complete one
+func readWALRecordEnds(r io.Reader) ([]Transaction, []int64, error) {
+	reader := bufio.NewReader(r)
+	wal := make([]Transaction, 0)
+	ends := make([]int64, 0)
+	offset := int64(0)
+	for {
+		first, err := reader.Peek(1)
+		if errors.Is(err, io.EOF) {
+			return wal, ends, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var data []byte
+		if first[0] == '{' || first[0] == '\n' {
+			data, err = reader.ReadBytes('\n')
+			if errors.Is(err, io.EOF) && len(data) > 0 {
+				err = nil // the last line of the text WAL may have no newline
+			}
+			offset += int64(len(data))
+		} else {
+			data, err = readBinaryRecord(reader)
+			offset += 4 + int64(len(data))
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			slog.Warn("WAL ends with a truncated record", "error", err)
+			return wal, ends, nil
+		}
+		if errors.Is(err, errCorruptedRecord) {
+			slog.Error("WAL is corrupted after the complete records", "records", len(wal), "error", err)
+			return wal, ends, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(data) == 0 || data[0] == '\n' {
+			continue
+		}
+		var tx Transaction
+		if err := json.Unmarshal(data, &tx); err != nil {
+			slog.Error("Failed to unmarshal transaction from WAL", "error", err)
+			continue
+		}
+		wal = append(wal, tx)
+		ends = append(ends, offset)
+	}
+}
+
+func readBinaryRecord(reader *bufio.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > MaxWALRecordSize {
+		return nil, fmt.Errorf("%w: %d bytes exceed %d bytes", errCorruptedRecord, size, MaxWALRecordSize)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geo"
+	"github.com/paulmach/orb/geojson"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// DistanceProperty holds the distance in meters from the center of the /within query
+const DistanceProperty = "_distance_m"
+
+// distanceTo returns the great-circle distance in meters from
+// the point to the nearest vertex of the geometry
+func distanceTo(geometry orb.Geometry, point orb.Point) float64 {
+	distance := math.Inf(1)
+	walkPoints(geometry, func(vertex orb.Point) {
+		distance = min(distance, geo.Distance(point, vertex))
+	})
+	return distance
+}
+
+// parseWithinParams reads the center and the radius of the /within query
+func parseWithinParams(query url.Values) (orb.Point, float64, error) {
+	var values [3]float64
+	for i, name := range []string{"lon", "lat", "radius_m"} {
+		value, err := strconv.ParseFloat(query.Get(name), 64)
+		if err != nil {
+			return orb.Point{}, 0, fmt.Errorf("%s parameter must be a number", name)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return orb.Point{}, 0, fmt.Errorf("%s parameter must be finite", name)
+		}
+		values[i] = value
+	}
+
+	center, radius := orb.Point{values[0], values[1]}, values[2]
+	if !CoordinateBounds.Contains(center) {
+		return orb.Point{}, 0, fmt.Errorf("center %v is out of %v-%v", center, CoordinateBounds.Min, CoordinateBounds.Max)
+	}
+	if radius <= 0 {
+		return orb.Point{}, 0, fmt.Errorf("radius_m parameter must be positive")
+	}
+	return center, radius, nil
+}
+
+// sortByDistance orders the features returned by /within from the nearest one
+func sortByDistance(features []*geojson.Feature) {
+	sort.SliceStable(features, func(i, j int) bool {
+		return features[i].Properties.MustFloat64(DistanceProperty, 0) < features[j].Properties.MustFloat64(DistanceProperty, 0)
+	})
+}